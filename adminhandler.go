@@ -1,15 +1,22 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
+	"time"
 
 	goboardbackend "github.com/dguihal/goboard/internal/backend"
-	goboardcookie "github.com/dguihal/goboard/internal/cookie"
+	goboardhub "github.com/dguihal/goboard/internal/hub"
+	goboardstore "github.com/dguihal/goboard/internal/store"
+	goboardtoken "github.com/dguihal/goboard/internal/token"
 	goboarduser "github.com/dguihal/goboard/internal/user"
 	"github.com/gorilla/mux"
 )
@@ -17,6 +24,24 @@ import (
 const tokenMinLen int = 0
 const tokenWarnLen int = 12
 
+// Moderator recorded when the admin token is used without a logged in user
+const adminModerator = "admin"
+
+// Context key of the name of the authenticated user or API token (see allow)
+type adminIdentityKey struct{}
+
+// Default and maximum number of moderation log entries returned
+const (
+	modLogDefaultLimit = 50
+	modLogMaxLimit     = 1000
+)
+
+// Headers of a backup response
+const (
+	backupChecksumHeader = "X-Backup-SHA256" // Hex sha256 of the (uncompressed) database
+	backupSizeHeader     = "X-Backup-Size"   // Size of the (uncompressed) database
+)
+
 // AdminHandler represents the handler of admin URLs
 type AdminHandler struct {
 	GoBoardHandler
@@ -28,12 +53,37 @@ type AdminHandler struct {
 func NewAdminHandler(adminToken string) (a *AdminHandler) {
 	a = &AdminHandler{}
 
-	a.supportedOps = []SupportedOp{
-		{"/admin/user/", "/admin/user/{login}", "DELETE", a.deleteUser}, // Delete a user
-		{"/admin/user/", "/admin/user/{login}", "GET", a.getUser},       // Get a user info
-		{"/admin/post/", "/admin/post/{id}", "DELETE", a.deletePost},    // Delete a post
+	// Roles needed by users and scopes needed by API tokens
+	moderator := func(h RESTEndpointHandler) RESTEndpointHandler {
+		return a.allow(goboarduser.RoleModerator, goboardtoken.ScopeAdminPosts, h)
+	}
+	indexer := func(h RESTEndpointHandler) RESTEndpointHandler {
+		return a.allow(goboarduser.RoleAdmin, goboardtoken.ScopeAdminPosts, h)
+	}
+	admin := func(h RESTEndpointHandler) RESTEndpointHandler {
+		return a.allow(goboarduser.RoleAdmin, goboardtoken.ScopeAdminUsers, h)
+	}
+
+	// Posts operations are available for each board
+	a.boardOps = []SupportedOp{
+		{"/admin/post/", "/admin/post/{id}", "DELETE", moderator(a.deletePost)},        // Delete a post (leaves a tombstone)
+		{"/admin/post/", "/admin/post/{id}/restore", "POST", moderator(a.restorePost)}, // Restore a deleted post
+		{"/admin/posts/", "/admin/posts/delete", "POST", moderator(a.deletePosts)},     // Delete posts matching criteria
+		{"/admin/modlog", "/admin/modlog", "GET", moderator(a.getModLog)},              // Get the moderation log
+		{"/admin/search/", "/admin/search/reindex", "POST", indexer(a.reindex)},        // Rebuild search index
 	}
 
+	a.supportedOps = append([]SupportedOp{
+		{"/admin/user/", "/admin/user/{login}", "DELETE", admin(a.deleteUser)},    // Delete a user
+		{"/admin/user/", "/admin/user/{login}", "GET", admin(a.getUser)},          // Get a user info
+		{"/admin/user/", "/admin/user/{login}/role", "PUT", admin(a.setUserRole)}, // Change the role of a user
+		{"/admin/tokens", "/admin/tokens", "GET", admin(a.getTokens)},             // List API tokens
+		{"/admin/tokens", "/admin/tokens", "POST", admin(a.createToken)},          // Create an API token
+		{"/admin/tokens", "/admin/tokens/{id}", "DELETE", admin(a.deleteToken)},   // Revoke an API token
+		{"/admin/spam", "/admin/spam", "GET", moderator(a.getSpamStats)},          // Get the anti-spam rejection counters
+		{"/admin/backup", "/admin/backup", "GET", admin(a.backup)},                // Download a snapshot of the database
+	}, a.boardOps...)
+
 	if len(adminToken) <= tokenMinLen {
 		log.Println("Admin token empty : for security reasongs, this means that no admin operations will be authorized")
 	} else if len(adminToken) < tokenWarnLen {
@@ -45,14 +95,13 @@ func NewAdminHandler(adminToken string) (a *AdminHandler) {
 
 func (a *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
-	reqAdminToken := r.Header.Get("Token-Id")
-	if !a.checkAdminToken(reqAdminToken) {
-		w.WriteHeader(http.StatusUnauthorized)
+	if a.Boards.ForRequest(r) == nil {
+		http.Error(w, "Unknown board", http.StatusNotFound)
 		return
 	}
 
 	for _, op := range a.supportedOps {
-		if r.Method == op.Method && strings.HasPrefix(r.URL.Path, op.PathBase) {
+		if op.matches(r) {
 			// Call specific handling method
 			op.handler(w, r)
 			return
@@ -63,11 +112,60 @@ func (a *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 }
 
+// allow restricts an operation to the admin token (superuser), to API tokens granted scope
+// and to logged in users having at least role
+// Answers 401 without any valid credential and 403 when the role or the scopes are not enough
+func (a *AdminHandler) allow(role string, scope string, h RESTEndpointHandler) RESTEndpointHandler {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if token := r.Header.Get("Token-Id"); len(token) > 0 {
+			if !a.checkAdminToken(token) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			identity := a.loginFromCookies(r)
+			if len(identity) == 0 {
+				identity = adminModerator
+			}
+			h(w, r.WithContext(context.WithValue(r.Context(), adminIdentityKey{}, identity)))
+			return
+		}
+
+		if t, ok, err := tokenFromRequest(a.Store, r); ok {
+			switch {
+			case errors.Is(err, goboardtoken.ErrInvalidToken):
+				w.WriteHeader(http.StatusUnauthorized)
+			case err != nil:
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Println(err.Error())
+			case !t.HasScope(scope):
+				w.WriteHeader(http.StatusForbidden)
+			default:
+				h(w, r.WithContext(context.WithValue(r.Context(), adminIdentityKey{}, t.Name)))
+			}
+			return
+		}
+
+		login := a.loginFromCookies(r)
+		if len(login) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		user, err := a.Store.GetUser(login)
+		if err != nil || !user.HasRole(role) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), adminIdentityKey{}, login)))
+	}
+}
+
 func (a *AdminHandler) deleteUser(w http.ResponseWriter, r *http.Request) {
 
 	login := (mux.Vars(r))["login"]
 
-	if err := goboarduser.DeleteUser(a.Db, login); err != nil {
+	if err := a.Store.DeleteUser(login); err != nil {
 		if uerr, ok := err.(*goboarduser.Error); ok {
 			if uerr.ErrCode == goboarduser.UserDoesNotExistsError {
 				w.WriteHeader(http.StatusNotFound)
@@ -84,7 +182,14 @@ func (a *AdminHandler) deleteUser(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if err := goboardcookie.DeleteCookiesForUser(a.Db, login); err != nil {
+	if err := a.Store.DeleteSessionsForUser(login); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err.Error())
+		return
+	}
+	a.BasicAuth.Forget(login)
+
+	if err := a.Store.DeleteTokensForUser(login); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Println(err.Error())
 		return
@@ -106,20 +211,202 @@ func (a *AdminHandler) deletePost(w http.ResponseWriter, rq *http.Request) {
 		return
 	}
 
-	if err := goboardbackend.DeletePost(a.Db, id); err != nil {
+	board := a.Boards.ForRequest(rq)
+	post, err := a.Store.DeletePost(board.Key, id, a.moderation(rq))
+	if errors.Is(err, goboardbackend.ErrPostDeleted) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Println(err.Error())
 		return
 	}
+	if post.ID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	a.Hub.Publish(goboardhub.Deletion(board.Name, []uint64{id}))
 
 	w.WriteHeader(http.StatusOK)
 }
 
+func (a *AdminHandler) restorePost(w http.ResponseWriter, rq *http.Request) {
+
+	id, err := strconv.ParseUint(mux.Vars(rq)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	board := a.Boards.ForRequest(rq)
+	post, err := a.Store.RestorePost(board.Key, id, a.moderation(rq))
+	if errors.Is(err, goboardbackend.ErrPostNotDeleted) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err.Error())
+		return
+	}
+	if post.ID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	a.Hub.Publish(goboardhub.Event{Type: goboardhub.RestoreEvent, Board: board.Name, ID: id, Post: post})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// bulkDeletion is the response of a bulk deletion
+type bulkDeletion struct {
+	DryRun bool     `json:"dry_run"`
+	IDs    []uint64 `json:"ids"` // Matching posts ids, oldest first
+}
+
+// deletePosts deletes every post matching the criteria of the request in a single transaction
+// Matching posts are only listed when dry_run is set
+func (a *AdminHandler) deletePosts(w http.ResponseWriter, r *http.Request) {
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	board := a.Boards.ForRequest(r)
+	f := goboardbackend.PostFilter{Login: r.FormValue("login"), Info: r.FormValue("info")}
+
+	var err error
+	for name, id := range map[string]*uint64{"from_id": &f.FromID, "to_id": &f.ToID} {
+		if v := r.FormValue(name); len(v) > 0 {
+			if *id, err = strconv.ParseUint(v, 10, 64); err != nil {
+				http.Error(w, "Invalid "+name+" parameter: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if f.From, err = parseSearchDate(r.FormValue("from"), false, board.Location); err != nil {
+		http.Error(w, "Invalid from parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.To, err = parseSearchDate(r.FormValue("to"), true, board.Location); err != nil {
+		http.Error(w, "Invalid to parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.IsEmpty() {
+		http.Error(w, "At least one of login, info, from_id, to_id, from or to is required", http.StatusBadRequest)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(r.FormValue("dry_run"))
+
+	ids, err := a.Store.DeleteMatchingPosts(board.Key, f, a.moderation(r), dryRun)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err.Error())
+		return
+	}
+	if ids == nil {
+		ids = []uint64{}
+	}
+
+	// A single event, subscribers would be dropped as too slow by one event per post
+	if !dryRun && len(ids) > 0 {
+		a.Hub.Publish(goboardhub.Deletion(board.Name, ids))
+	}
+
+	data, err := json.Marshal(bulkDeletion{DryRun: dryRun, IDs: ids})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// moderation describes a moderation request: the authenticated user or API token name and the reason parameter
+func (a *AdminHandler) moderation(r *http.Request) goboardbackend.Moderation {
+	by, _ := r.Context().Value(adminIdentityKey{}).(string)
+	return goboardbackend.Moderation{
+		Time:   goboardbackend.PostTime{Time: time.Now()},
+		By:     by,
+		Reason: r.FormValue("reason"),
+	}
+}
+
+// getModLog returns the moderation log of a board, newest first
+func (a *AdminHandler) getModLog(w http.ResponseWriter, r *http.Request) {
+
+	board := a.Boards.ForRequest(r)
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = modLogDefaultLimit
+	} else if limit > modLogMaxLimit {
+		limit = modLogMaxLimit
+	}
+
+	before, err := strconv.ParseUint(r.URL.Query().Get("before"), 10, 64)
+	if err != nil {
+		before = 0
+	}
+
+	entries, err := a.Store.GetModLog(board.Key, limit, before)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []goboardbackend.ModLogEntry{}
+	}
+
+	for i := range entries {
+		entries[i].Time.Time = entries[i].Time.In(board.Location)
+	}
+	if len(entries) == limit && entries[len(entries)-1].ID > 1 {
+		w.Header().Set("X-Next-Before", strconv.FormatUint(entries[len(entries)-1].ID, 10))
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+func (a *AdminHandler) reindex(w http.ResponseWriter, r *http.Request) {
+
+	board := a.Boards.ForRequest(r)
+	count, err := a.Store.RebuildSearchIndex(board.Key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprintf(w, "%d posts indexed", count); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
 func (a *AdminHandler) getUser(w http.ResponseWriter, r *http.Request) {
 
 	login := (mux.Vars(r))["login"]
 
-	if user, err := goboarduser.GetUser(a.Db, login); err != nil {
+	if user, err := a.Store.GetUser(login); err != nil {
 		w.WriteHeader(http.StatusNotFound)
 	} else {
 		data, err := json.Marshal(user)
@@ -135,6 +422,222 @@ func (a *AdminHandler) getUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// setUserRole changes the role of a user, given by the role parameter
+func (a *AdminHandler) setUserRole(w http.ResponseWriter, r *http.Request) {
+
+	login := (mux.Vars(r))["login"]
+	role := r.FormValue("role")
+
+	if !goboarduser.ValidRole(role) {
+		http.Error(w, fmt.Sprintf("Invalid role %q", role), http.StatusBadRequest)
+		return
+	}
+
+	if err := a.Store.SetUserRole(login, role); err != nil {
+		if uerr, ok := err.(*goboarduser.Error); ok && uerr.ErrCode == goboarduser.UserDoesNotExistsError {
+			http.Error(w, fmt.Sprintf("User %s Not found", login), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getSpamStats returns the number of posts rejected by each anti-spam filter since startup
+func (a *AdminHandler) getSpamStats(w http.ResponseWriter, r *http.Request) {
+
+	data, err := json.Marshal(a.Spam.Stats())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// newAPIToken is the response to an API token creation, the only one giving its value
+type newAPIToken struct {
+	goboardtoken.APIToken
+	Token string `json:"token"`
+}
+
+// getTokens lists the API tokens, without their hashed secrets
+func (a *AdminHandler) getTokens(w http.ResponseWriter, r *http.Request) {
+
+	tokens, err := a.Store.GetTokens()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err.Error())
+		return
+	}
+
+	for i := range tokens {
+		tokens[i].HashedSecret = nil
+	}
+	if tokens == nil {
+		tokens = []goboardtoken.APIToken{}
+	}
+
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// createToken creates an API token from the name, scope (repeated) and expires (RFC3339, optional) parameters
+func (a *AdminHandler) createToken(w http.ResponseWriter, r *http.Request) {
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := r.FormValue("name")
+	if len(name) == 0 {
+		http.Error(w, "Missing name parameter", http.StatusBadRequest)
+		return
+	}
+
+	scopes := r.Form["scope"]
+	if len(scopes) == 0 {
+		http.Error(w, "At least one scope parameter is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range scopes {
+		if !goboardtoken.ValidScope(scope) {
+			http.Error(w, fmt.Sprintf("Invalid scope %q", scope), http.StatusBadRequest)
+			return
+		}
+	}
+
+	expires, err := parseTokenExpires(r.FormValue("expires"))
+	if err != nil {
+		http.Error(w, "Invalid expires parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, value := goboardtoken.New(name, scopes, expires)
+	if err := a.Store.AddToken(t); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err.Error())
+		return
+	}
+
+	t.HashedSecret = nil
+	data, err := json.Marshal(newAPIToken{APIToken: t, Token: value})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// parseTokenExpires reads the optional expiration date (RFC3339) of a new API token, nil if empty
+func parseTokenExpires(v string) (*time.Time, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// deleteToken revokes an API token
+func (a *AdminHandler) deleteToken(w http.ResponseWriter, r *http.Request) {
+
+	id := (mux.Vars(r))["id"]
+
+	if err := a.Store.DeleteToken(id); errors.Is(err, goboardtoken.ErrTokenNotFound) {
+		http.Error(w, fmt.Sprintf("Token %s Not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminHandler) backup(w http.ResponseWriter, r *http.Request) {
+
+	snapshotter, ok := a.Store.(goboardstore.Snapshotter)
+	if !ok {
+		http.Error(w, "Backup is not supported by this storage", http.StatusNotImplemented)
+		return
+	}
+
+	compress := r.URL.Query().Get("compress")
+	if len(compress) > 0 && compress != "gzip" {
+		http.Error(w, "Unsupported compression (gzip only)", http.StatusBadRequest)
+		return
+	}
+
+	// Large databases take longer than the server write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Could not clear backup write deadline: %v", err)
+	}
+
+	started := false
+	err := snapshotter.Snapshot(func(snap goboardstore.Snapshot) error {
+
+		// The snapshot doesn't change, so the checksum is computed first to be sent in headers
+		h := sha256.New()
+		if _, err := snap.WriteTo(h); err != nil {
+			return err
+		}
+
+		fileName := "goboard-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+
+		w.Header().Set(backupChecksumHeader, hex.EncodeToString(h.Sum(nil)))
+		w.Header().Set(backupSizeHeader, strconv.FormatInt(snap.Size(), 10))
+		started = true
+
+		if compress == "gzip" {
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+fileName+`.gz"`)
+
+			gz := gzip.NewWriter(w)
+			if _, err := snap.WriteTo(gz); err != nil {
+				return err
+			}
+			return gz.Close()
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+fileName+`"`)
+		w.Header().Set("Content-Length", strconv.FormatInt(snap.Size(), 10))
+		_, err := snap.WriteTo(w)
+		return err
+	})
+
+	if err != nil {
+		log.Printf("Backup failed: %v", err)
+		if !started {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
+
 func (a *AdminHandler) checkAdminToken(token string) bool {
 	return len(a.adminToken) > tokenMinLen && token == a.adminToken
 }
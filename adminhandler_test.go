@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+
+	goboardhub "github.com/dguihal/goboard/internal/hub"
+)
+
+func TestDeletePostRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		deleted string   // Rendering of deleted posts
+		ids     []uint64 // Backend once post 2 is deleted
+		status  int      // Status of post 2 once deleted
+	}{
+		{"placeholder", deletedPlaceholder, []uint64{3, 2, 1}, http.StatusOK},
+		{"hidden", deletedHide, []uint64{3, 1}, http.StatusNotFound},
+	}
+
+	ids := func(posts []testPost) (ids []uint64) {
+		for _, p := range posts {
+			ids = append(ids, p.ID)
+		}
+		return
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig()
+			config.Boards = map[string]BoardConfig{"mod": {DeletedPosts: tc.deleted}}
+			s := newTestServer(t, config, nil)
+			for _, m := range []string{"one", "two", "three"} {
+				s.post(t, "/b/mod", m)
+			}
+
+			for _, step := range []struct {
+				name   string
+				method string
+				path   string
+				header http.Header
+				status int
+			}{
+				{"without token", http.MethodDelete, "/b/mod/admin/post/2", nil, http.StatusUnauthorized},
+				{"with a wrong token", http.MethodDelete, "/b/mod/admin/post/2", http.Header{"Token-Id": {"wrong"}}, http.StatusUnauthorized},
+				{"unknown post", http.MethodDelete, "/b/mod/admin/post/9", admin(), http.StatusNotFound},
+				{"delete", http.MethodDelete, "/b/mod/admin/post/2", admin(), http.StatusOK},
+				{"delete again", http.MethodDelete, "/b/mod/admin/post/2", admin(), http.StatusConflict},
+			} {
+				if status, body := s.do(t, step.method, step.path, nil, step.header); status != step.status {
+					t.Fatalf("%s: status %d, want %d: %s", step.name, status, step.status, body)
+				}
+			}
+
+			posts := s.backend(t, "/b/mod")
+			if got := ids(posts); !slices.Equal(got, tc.ids) {
+				t.Errorf("backend ids %v, want %v", got, tc.ids)
+			}
+			for _, p := range posts {
+				if p.ID == 2 && (p.Message != deletedMessage || p.Deleted == nil || len(p.Info) > 0) {
+					t.Errorf("deleted post %+v, want a placeholder", p)
+				}
+			}
+			if status, _ := s.do(t, http.MethodGet, "/b/mod/post/2/json", nil, nil); status != tc.status {
+				t.Errorf("deleted post: status %d, want %d", status, tc.status)
+			}
+
+			if status, body := s.do(t, http.MethodPost, "/b/mod/admin/post/2/restore", nil, admin()); status != http.StatusOK {
+				t.Fatalf("restore: status %d: %s", status, body)
+			}
+			posts = s.backend(t, "/b/mod")
+			if got := ids(posts); !slices.Equal(got, []uint64{3, 2, 1}) || posts[1].Message != "two" || posts[1].Deleted != nil {
+				t.Errorf("backend %+v once restored, want post 2 back", posts)
+			}
+		})
+	}
+}
+
+func TestDeletePostsPublishesOneEvent(t *testing.T) {
+	const posts = 2 * goboardhub.DefaultBufferSize
+
+	s := newTestServer(t, testConfig(), nil)
+	for i := 0; i < posts; i++ {
+		s.post(t, "", "spam")
+	}
+
+	// Not read until the end, as a slow client
+	sub := s.Hub.Subscribe(goboardhub.DefaultBufferSize)
+	defer s.Hub.Unsubscribe(sub)
+
+	status, body := s.do(t, http.MethodPost, "/admin/posts/delete", url.Values{"from_id": {"1"}}, admin())
+	if status != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", status, body)
+	}
+
+	if n := len(sub.C); n != 1 {
+		t.Fatalf("%d events, want 1", n)
+	}
+	e, ok := <-sub.C
+	if !ok {
+		t.Fatal("subscriber dropped")
+	}
+	if e.Type != goboardhub.DeleteEvent || len(e.IDs) != posts {
+		t.Errorf("event %v with %d ids, want %v with %d", e.Type, len(e.IDs), goboardhub.DeleteEvent, posts)
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,7 +14,9 @@ import (
 	"time"
 
 	goboardbackend "github.com/dguihal/goboard/internal/backend"
-	goboardcookie "github.com/dguihal/goboard/internal/cookie"
+	goboardhub "github.com/dguihal/goboard/internal/hub"
+	goboardstore "github.com/dguihal/goboard/internal/store"
+	goboardtoken "github.com/dguihal/goboard/internal/token"
 	"github.com/gorilla/mux"
 )
 
@@ -23,6 +27,18 @@ var allowedFormats = map[string]bool{
 	"raw":  true,
 }
 
+// Maximum time a long polling request on backend is held
+const maxLongPollWait = 60 * time.Second
+
+// Message of the placeholders shown instead of deleted posts
+const deletedMessage = "[deleted]"
+
+// Delay between keep alive comments sent on event streams
+const streamKeepAlive = 30 * time.Second
+
+// Number of posts read at once when replaying the posts missed by a reconnecting stream client
+const streamReplayPageSize = 500
+
 var knownHeaders = map[string]string{
 	"application/xml":  "xml",
 	"text/xml":         "xml",
@@ -33,37 +49,45 @@ var knownHeaders = map[string]string{
 // BackendHandler represents the handler of backend URLs
 type BackendHandler struct {
 	GoBoardHandler
-
-	historySize int
 }
 
 // NewBackendHandler creates an BackendHandler object
-func NewBackendHandler(historySize int, frontLocation string) (b *BackendHandler) {
+func NewBackendHandler() (b *BackendHandler) {
 	b = &BackendHandler{}
 
 	b.supportedOps = []SupportedOp{
-		{"/backend", "/backend", "GET", b.getBackend},          // Get backend (in xml)
-		{"/backend", "/backend/{format}", "GET", b.getBackend}, // Get backend (in specific format)
-		{"/post", "/post", "POST", b.post},                     // Post new message
-		{"/post/", "/post/{id}", "GET", b.getPost},             // Get a specific message (in xml)
-		{"/post/", "/post/{id}/{format}", "GET", b.getPost},    // Get a specific message (in specific format)
+		{"/backend/stream", "/backend/stream", "GET", b.stream},                      // Stream new posts (Server-Sent Events)
+		{"/backend", "/backend", "GET", b.getBackend},                                // Get backend (in xml)
+		{"/backend", "/backend/{format}", "GET", b.getBackend},                       // Get backend (in specific format)
+		{"/post", "/post", "POST", b.post},                                           // Post new message
+		{"/archive/", "/archive/{year}/{month}/{day}", "GET", b.getArchive},          // Get posts of a day (in xml)
+		{"/archive/", "/archive/{year}/{month}/{day}/{format}", "GET", b.getArchive}, // Get posts of a day (in specific format)
+		{"/search", "/search", "GET", b.search},                                      // Search in history (in xml)
+		{"/search", "/search/{format}", "GET", b.search},                             // Search in history (in specific format)
+		{"/post/", "/post/{id}/replies", "GET", b.getReplies},                        // Get answers to a message (in xml)
+		{"/post/", "/post/{id}/replies/{format}", "GET", b.getReplies},               // Get answers to a message (in specific format)
+		{"/post/", "/post/{id}/revisions", "GET", b.getRevisions},                    // Get previous versions of a message (in xml)
+		{"/post/", "/post/{id}/revisions/{format}", "GET", b.getRevisions},           // Get previous versions of a message (in specific format)
+		{"/post/", "/post/{id}", "PUT", b.editPost},                                  // Edit a message
+		{"/post/", "/post/{id}", "GET", b.getPost},                                   // Get a specific message (in xml)
+		{"/post/", "/post/{id}/{format}", "GET", b.getPost},                          // Get a specific message (in specific format)
 	}
 
-	if location, err := time.LoadLocation(frontLocation); err == nil {
-		goboardbackend.TZLocation = location
-	} else {
-		// Falls back to current Location
-		goboardbackend.TZLocation = time.Now().Location()
-	}
+	// Every backend operation is available for each board
+	b.boardOps = b.supportedOps
 
-	b.historySize = historySize
 	return
 }
 
 func (b *BackendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
+	if b.Boards.ForRequest(r) == nil {
+		http.Error(w, "Unknown board", http.StatusNotFound)
+		return
+	}
+
 	for _, op := range b.supportedOps {
-		if r.Method == op.Method && strings.HasPrefix(r.URL.Path, op.PathBase) {
+		if op.matches(r) {
 			// Call specific handling method
 			op.handler(w, r)
 			return
@@ -76,48 +100,245 @@ func (b *BackendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (b *BackendHandler) getBackend(w http.ResponseWriter, r *http.Request) {
 
+	board := b.Boards.ForRequest(r)
+
 	lastStr := r.URL.Query().Get("last")
 	last, err := strconv.ParseUint(lastStr, 10, 64)
 	if err != nil {
 		last = 0
 	}
 
-	posts, err := goboardbackend.GetBackend(b.Db, b.historySize, last)
+	before, err := strconv.ParseUint(r.URL.Query().Get("before"), 10, 64)
+	if err != nil {
+		before = 0
+	}
 
-	if err == nil {
-		if len(posts) == 0 || posts[0].ID == 0 {
-			w.WriteHeader(http.StatusNoContent)
-		} else {
-			vars := mux.Vars(r)
-			format := guessFormat(vars["format"], r.Header.Get("Accept"))
-
-			var data []byte
-
-			switch format {
-			case "json":
-				data = postsToJSON(posts)
-				w.Header().Set("Content-Type", "application/json")
-			case "tsv":
-				data = postsToTsv(posts)
-				w.Header().Set("Content-Type", "text/tab-separated-values")
-			default: // "xml" or ""
-				data = postsToXML(posts, r.Header.Get("Location"))
-				w.Header().Set("Content-Type", "application/xml")
-			}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > board.HistorySize {
+		limit = board.HistorySize
+	}
 
-			w.WriteHeader(http.StatusOK)
-			if _, err := w.Write(data); err != nil {
-				log.Printf("Error writing response: %v", err)
+	posts, err := b.Store.GetHistory(board.Key, limit, last, before)
+
+	// Long polling: wait for a new post if there's nothing to send yet
+	// Posts left out of the response (hidden tombstones) don't count, the wait goes on after them
+	// Pages of older posts (before) never get new posts, they are not held
+	if wait := parseWait(r.URL.Query().Get("wait")); err == nil && wait > 0 && before == 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		after := last
+		for err == nil && !hasVisiblePosts(board, posts) {
+			if len(posts) > 0 && posts[0].ID > after {
+				after = posts[0].ID
 			}
-			if _, err := w.Write([]byte("\n")); err != nil {
-				log.Printf("Error writing response: %v", err)
+			notified, ok := goboardbackend.WaitForPost(ctx, board.Key, after)
+			if !ok {
+				break
 			}
+			// Waits for a post after the one notified next time, even if it is not found here
+			after = notified
+			posts, err = b.Store.GetHistory(board.Key, limit, last, before)
+		}
+		cancel()
+	}
+
+	if err == nil {
+		// More posts may be found before the oldest one returned
+		if len(posts) == limit && len(posts) > 0 && posts[len(posts)-1].ID > last+1 {
+			w.Header().Set("X-Next-Before", strconv.FormatUint(posts[len(posts)-1].ID, 10))
 		}
+		writePosts(w, r, board, posts)
 	} else {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// writePosts sends a list of posts (newest first) in the requested backend format
+func writePosts(w http.ResponseWriter, r *http.Request, board *BoardSettings, posts []goboardbackend.Post) {
+	posts = renderDeleted(board, posts)
+	if len(posts) == 0 || posts[0].ID == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	goboardbackend.Localize(posts, board.Location)
+
+	vars := mux.Vars(r)
+	format := guessFormat(vars["format"], r.Header.Get("Accept"))
+
+	var data []byte
+
+	switch format {
+	case "json":
+		data = postsToJSON(posts)
+		w.Header().Set("Content-Type", "application/json")
+	case "tsv":
+		data = postsToTsv(posts)
+		w.Header().Set("Content-Type", "text/tab-separated-values")
+	default: // "xml" or ""
+		data = postsToXML(posts, r.Header.Get("Location"))
+		w.Header().Set("Content-Type", "application/xml")
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+	if _, err := w.Write([]byte("\n")); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// renderDeleted replaces tombstones by placeholders, or leaves them out if the board hides them
+// Who deleted a post and why is only shown in the moderation log
+func renderDeleted(board *BoardSettings, posts []goboardbackend.Post) []goboardbackend.Post {
+	rendered := posts[:0]
+	for _, p := range posts {
+		if p.Deleted != nil {
+			if board.HideDeleted {
+				continue
+			}
+			p = goboardbackend.Post{
+				ID:      p.ID,
+				Time:    p.Time,
+				Message: deletedMessage,
+				Deleted: &goboardbackend.Moderation{Time: p.Deleted.Time},
+			}
+		}
+		rendered = append(rendered, p)
+	}
+	return rendered
+}
+
+// hasVisiblePosts tells if writePosts has something to send among posts
+func hasVisiblePosts(board *BoardSettings, posts []goboardbackend.Post) bool {
+	for _, p := range posts {
+		if p.ID != 0 && (p.Deleted == nil || !board.HideDeleted) {
+			return true
+		}
+	}
+	return false
+}
+
+// getArchive returns all posts of a day (in backend timezone)
+func (b *BackendHandler) getArchive(w http.ResponseWriter, r *http.Request) {
+
+	board := b.Boards.ForRequest(r)
+
+	vars := mux.Vars(r)
+	day, err := time.ParseInLocation("2006/01/02", vars["year"]+"/"+vars["month"]+"/"+vars["day"], board.Location)
+	if err != nil {
+		http.Error(w, "Invalid date, expected /archive/YYYY/MM/DD", http.StatusBadRequest)
+		return
+	}
+
+	posts, err := b.Store.GetArchive(board.Key, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writePosts(w, r, board, posts)
+}
+
+// search returns the posts matching q (and optionally login, from and to), newest first
+func (b *BackendHandler) search(w http.ResponseWriter, r *http.Request) {
+
+	board := b.Boards.ForRequest(r)
+	params := r.URL.Query()
+
+	q := goboardbackend.SearchQuery{
+		Text:  params.Get("q"),
+		Login: params.Get("login"),
+	}
+	if len(goboardbackend.SearchTerms(q.Text)) == 0 {
+		http.Error(w, "Missing or too short search terms (q parameter)", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if q.From, err = parseSearchDate(params.Get("from"), false, board.Location); err != nil {
+		http.Error(w, "Invalid from parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.To, err = parseSearchDate(params.Get("to"), true, board.Location); err != nil {
+		http.Error(w, "Invalid to parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit, err := strconv.Atoi(params.Get("limit"))
+	if err != nil || limit <= 0 || limit > board.HistorySize {
+		limit = board.HistorySize
+	}
+
+	posts, err := b.Store.Search(board.Key, q, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writePosts(w, r, board, posts)
+}
+
+// parseSearchDate reads a date as 2006-01-02, 20060102150405 (backend format) or RFC3339
+// When endOfDay is set, a date without time designates the end of that day
+func parseSearchDate(dateStr string, endOfDay bool, loc *time.Location) (t time.Time, err error) {
+	if len(dateStr) == 0 {
+		return
+	}
+
+	if t, err = time.ParseInLocation("2006-01-02", dateStr, loc); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return
+	}
+	if t, err = time.ParseInLocation(goboardbackend.PostTimeFormat, dateStr, loc); err == nil {
+		return
+	}
+	return time.Parse(time.RFC3339, dateStr)
+}
+
+// getReplies returns the posts referencing a post
+func (b *BackendHandler) getReplies(w http.ResponseWriter, r *http.Request) {
+
+	board := b.Boards.ForRequest(r)
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Missing required post id as unsigned int PATH variable", http.StatusBadRequest)
+		return
+	}
+
+	posts, err := b.Store.GetReplies(board.Key, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writePosts(w, r, board, posts)
+}
+
+// parseWait reads a long polling duration ("30s" or "30"), capped to maxLongPollWait
+func parseWait(waitStr string) time.Duration {
+	if len(waitStr) == 0 {
+		return 0
+	}
+
+	wait, err := time.ParseDuration(waitStr)
+	if err != nil {
+		secs, err := strconv.ParseUint(waitStr, 10, 32)
+		if err != nil {
+			return 0
+		}
+		wait = time.Duration(secs) * time.Second
+	}
+
+	if wait > maxLongPollWait {
+		wait = maxLongPollWait
+	}
+	return wait
+}
+
 // TODO : Manage returning an original posted data for a specific id as text
 //
 //	Maybe consider allowing this only for admins (not sure it is relevant)
@@ -133,17 +354,21 @@ func (b *BackendHandler) getPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	post, err := goboardbackend.GetPost(b.Db, id)
+	board := b.Boards.ForRequest(r)
+	post, err := b.Store.GetPost(board.Key, id)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-
-	if post.ID == 0 {
+	posts := renderDeleted(board, []goboardbackend.Post{post})
+	if len(posts) == 0 || posts[0].ID == 0 {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
+	goboardbackend.Localize(posts, board.Location)
+	post = posts[0]
+
 	var data []byte
 	format := guessFormat(vars["format"], r.Header.Get("Accept"))
 	switch format {
@@ -186,43 +411,415 @@ func (b *BackendHandler) post(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	message, err := goboardbackend.SanitizeAndValidate(r.FormValue("message"))
+	rawInfo := r.FormValue("info")
+	if len(rawInfo) == 0 {
+		rawInfo = r.Header.Get("User-Agent")
+	}
+
+	login, ok := b.postAuthor(w, r)
+	if !ok {
+		return
+	}
+
+	if !b.Guard.AllowPost(w, r, login) {
+		return
+	}
+
+	board := b.Boards.ForRequest(r)
+	p, err := newPost(board, r.FormValue("message"), rawInfo, login)
 	// Validation failed
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	rawInfo := r.FormValue("info")
-	if len(rawInfo) == 0 {
-		rawInfo = r.Header.Get("User-Agent")
+	candidate := SpamCandidate{Board: board, Post: p, IP: b.Guard.ClientIP(r)}
+	if rej := b.Spam.Check(candidate); rej != nil {
+		if rej.Shadow {
+			id, err := b.Spam.ShadowPostID(b.Store, board)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("X-Post-Id", strconv.FormatUint(id, 10))
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			http.Error(w, rej.Reason, rej.Status)
+		}
+		return
 	}
-	info := goboardbackend.Sanitize(rawInfo)
-	login := ""
 
-	for _, c := range r.Cookies() {
-		var err error
-		if login, err = goboardcookie.LoginForCookie(b.Db, c); err == nil && len(login) > 0 {
-			break
-		}
+	// Try to store it
+	if postID, err := savePost(b.Store, b.Hub, board, p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else {
+		b.Spam.Remember(candidate)
+		w.Header().Set("X-Post-Id", strconv.FormatUint(postID, 10))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// editPost replaces the message of a post by its author, within the board edit window
+func (b *BackendHandler) editPost(w http.ResponseWriter, r *http.Request) {
+
+	board := b.Boards.ForRequest(r)
+	if board.EditWindow <= 0 {
+		http.Error(w, "Posts can't be edited on this board", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Missing required post id as unsigned int PATH variable", http.StatusBadRequest)
+		return
 	}
 
-	// Build Post object to store
-	p := goboardbackend.Post{
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	login := b.loginFromCookies(r)
+	if len(login) == 0 {
+		http.Error(w, "Only authenticated users can edit their posts", http.StatusUnauthorized)
+		return
+	}
+
+	post, err := b.Store.GetPost(board.Key, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if post.ID == 0 || post.Deleted != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	if post.Login != login {
+		http.Error(w, "Only the author of a post can edit it", http.StatusForbidden)
+		return
+	}
+	if now.Sub(post.Time.Time) > board.EditWindow {
+		http.Error(w, "Edit window is over", http.StatusForbidden)
+		return
+	}
+
+	rawMessage := r.FormValue("message")
+	message, err := goboardbackend.SanitizeAndValidateWithTags(rawMessage, board.AllowedTags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	post, err = b.Store.EditPost(board.Key, id, message, rawMessage, now, board.Location)
+	if err != nil && !errors.Is(err, goboardbackend.ErrPostDeleted) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if post.ID == 0 {
+		// Deleted in between
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b.Hub.Publish(goboardhub.Event{Type: goboardhub.EditEvent, Board: board.Name, ID: id, Post: post})
+
+	w.Header().Set("X-Post-Id", strconv.FormatUint(id, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getRevisions returns a post along with its previous versions, oldest first
+func (b *BackendHandler) getRevisions(w http.ResponseWriter, r *http.Request) {
+
+	board := b.Boards.ForRequest(r)
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Missing required post id as unsigned int PATH variable", http.StatusBadRequest)
+		return
+	}
+
+	post, err := b.Store.GetPost(board.Key, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if post.ID == 0 || post.Deleted != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	revs, err := b.Store.GetRevisions(board.Key, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	posts := []goboardbackend.Post{post}
+	goboardbackend.Localize(posts, board.Location)
+	goboardbackend.LocalizeRevisions(revs, board.Location)
+
+	if revs == nil {
+		revs = []goboardbackend.PostRevision{}
+	}
+	history := goboardbackend.PostHistory{Post: posts[0], Revisions: revs}
+	history.Post.RawMessage = ""
+
+	var data []byte
+	switch guessFormat(mux.Vars(r)["format"], r.Header.Get("Accept")) {
+	case "json":
+		data, err = json.Marshal(history)
+		w.Header().Set("Content-Type", "application/json")
+	default:
+		data, err = xml.Marshal(history)
+		w.Header().Set("Content-Type", "application/xml")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// newPost builds a Post object to store on a board from user provided data
+func newPost(board *BoardSettings, rawMessage string, rawInfo string, login string) (p goboardbackend.Post, err error) {
+	message, err := goboardbackend.SanitizeAndValidateWithTags(rawMessage, board.AllowedTags)
+	if err != nil {
+		return
+	}
+
+	p = goboardbackend.Post{
 		Time:       goboardbackend.PostTime{Time: time.Now()},
 		Login:      login,
-		Info:       info,
+		Info:       goboardbackend.SanitizeWithTags(rawInfo, board.AllowedTags),
 		Message:    message,
-		RawMessage: r.FormValue("message"),
+		RawMessage: rawMessage,
 	}
+	return
+}
 
-	// Try to store it
-	if postID, err := goboardbackend.PostMessage(b.Db, p); err != nil {
+// savePost stores a post on a board and notifies hub subscribers
+// Subscribers get the post as stored, with its refs and normalized time
+func savePost(s goboardstore.Store, h *goboardhub.Hub, board *BoardSettings, p goboardbackend.Post) (postID uint64, err error) {
+	if postID, err = s.PostMessage(board.Key, p, board.Location); err != nil {
+		return
+	}
+
+	stored, err := s.GetPost(board.Key, postID)
+	if err != nil || stored.ID == 0 {
+		// The post is stored anyway, stream clients get it back on reconnection
+		log.Printf("Could not read post %d of board %s back: %v", postID, board.Name, err)
+		return postID, nil
+	}
+	h.Publish(goboardhub.Event{Type: goboardhub.PostEvent, Board: board.Name, ID: postID, Post: stored})
+	return
+}
+
+// postAuthor returns the login signing a post, answering the error and returning false if authentication fails
+// Credentials sent in an Authorization header (HTTP Basic, or Bearer API token) take precedence over the session cookie.
+// Posts made with an API token are signed with its owner login for personal API keys, with its name otherwise
+func (b *BackendHandler) postAuthor(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if login, password, ok := r.BasicAuth(); ok {
+		return login, b.checkBasicAuth(w, r, login, password)
+	}
+
+	t, ok, err := tokenFromRequest(b.Store, r)
+	if !ok {
+		return b.loginFromCookies(r), true
+	}
+	switch {
+	case errors.Is(err, goboardtoken.ErrInvalidToken):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return "", false
+	case err != nil:
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-	} else {
-		w.Header().Set("X-Post-Id", strconv.FormatUint(postID, 10))
-		w.WriteHeader(http.StatusNoContent)
+		return "", false
+	case !t.HasScope(goboardtoken.ScopePost):
+		http.Error(w, "API token is not allowed to post", http.StatusForbidden)
+		return "", false
+	}
+	return t.Author(), true
+}
+
+// tokenFromRequest returns the API token sent in an "Authorization: Bearer" header, ok is false if none was sent
+// Unknown, revoked and expired tokens are reported as goboardtoken.ErrInvalidToken
+func tokenFromRequest(s goboardstore.TokenStore, r *http.Request) (t goboardtoken.APIToken, ok bool, err error) {
+	scheme, value, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return t, false, nil
+	}
+
+	id, secret, err := goboardtoken.Parse(strings.TrimSpace(value))
+	if err != nil {
+		return t, true, err
+	}
+
+	t, err = s.GetToken(id)
+	if errors.Is(err, goboardtoken.ErrTokenNotFound) {
+		return goboardtoken.APIToken{}, true, goboardtoken.ErrInvalidToken
+	} else if err != nil {
+		return goboardtoken.APIToken{}, true, err
 	}
+
+	now := time.Now()
+	if !t.Check(secret, now) {
+		return goboardtoken.APIToken{}, true, goboardtoken.ErrInvalidToken
+	}
+	if t.NeedsTouch(now) {
+		if err := s.TouchToken(id, now); err != nil {
+			log.Printf("Error recording API token use: %v", err)
+		}
+	}
+	return t, true, nil
+}
+
+// stream pushes new posts and deletions to the client as Server-Sent Events
+// Posts missed since Last-Event-ID (or last query parameter) are sent first
+func (b *BackendHandler) stream(w http.ResponseWriter, r *http.Request) {
+
+	if b.Hub == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	board := b.Boards.ForRequest(r)
+	rc := http.NewResponseController(w)
+
+	// Subscribe before fetching history so that no post is lost in between
+	sub := b.Hub.Subscribe(goboardhub.DefaultBufferSize)
+	defer b.Hub.Unsubscribe(sub)
+
+	lastStr := r.Header.Get("Last-Event-ID")
+	if len(lastStr) == 0 {
+		lastStr = r.URL.Query().Get("last")
+	}
+	last, err := strconv.ParseUint(lastStr, 10, 64)
+	if err != nil {
+		last = 0
+	}
+
+	// Every missed post is replayed, page by page
+	var missed []goboardbackend.Post
+	if last > 0 {
+		if missed, err = b.Store.GetOldest(board.Key, streamReplayPageSize, last); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Stream lifetime is not bound to server WriteTimeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Could not disable write deadline for stream: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		full := len(missed) == streamReplayPageSize
+		if len(missed) > 0 {
+			next := missed[len(missed)-1].ID
+			for _, p := range renderDeleted(board, missed) {
+				if err := writeSSEPost(w, board, p); err != nil {
+					return
+				}
+			}
+			last = next
+		}
+		if err := rc.Flush(); err != nil {
+			log.Printf("Streaming not supported: %v", err)
+			return
+		}
+		if !full {
+			break
+		}
+		// The client resumes from the last post sent when it reconnects
+		if missed, err = b.Store.GetOldest(board.Key, streamReplayPageSize, last); err != nil {
+			log.Printf("Could not replay posts of board %s: %v", board.Name, err)
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-sub.C:
+			if !ok {
+				// Too slow or server shutting down
+				return
+			}
+			if e.Board != board.Name {
+				continue
+			}
+			switch e.Type {
+			case goboardhub.PostEvent:
+				if e.ID <= last {
+					continue // Already sent from history
+				}
+				err = writeSSEPost(w, board, e.Post)
+			case goboardhub.EditEvent, goboardhub.RestoreEvent:
+				err = writeSSEUpdate(w, board, e.Type, e.Post)
+			case goboardhub.DeleteEvent:
+				err = writeSSEDelete(w, e)
+			}
+			if err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeSSEPost writes a post as a Server-Sent Event, using postsToJSON data format
+func writeSSEPost(w http.ResponseWriter, board *BoardSettings, p goboardbackend.Post) error {
+	posts := []goboardbackend.Post{p}
+	goboardbackend.Localize(posts, board.Location)
+	data := postsToJSON(posts)
+	_, err := fmt.Fprintf(w, "id: %d\nevent: post\ndata: %s\n\n", p.ID, data)
+	return err
+}
+
+// writeSSEUpdate writes an edited or restored post as a Server-Sent Event of type event,
+// without an id as it is not a new post
+func writeSSEUpdate(w http.ResponseWriter, board *BoardSettings, event string, p goboardbackend.Post) error {
+	posts := []goboardbackend.Post{p}
+	goboardbackend.Localize(posts, board.Location)
+	data := postsToJSON(posts)
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+// sseDeletion is the data of delete Server-Sent Events
+type sseDeletion struct {
+	ID  uint64   `json:"id,omitempty"` // Only set if a single post is deleted
+	IDs []uint64 `json:"ids"`
+}
+
+// writeSSEDelete writes the posts of a DeleteEvent as a single Server-Sent Event
+func writeSSEDelete(w http.ResponseWriter, e goboardhub.Event) error {
+	data, err := json.Marshal(sseDeletion{ID: e.ID, IDs: e.IDs})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: delete\ndata: %s\n\n", data)
+	return err
 }
 
 // Guess backend format to deliver based on :
@@ -273,11 +870,7 @@ func postsToXML(posts []goboardbackend.Post, backendLocation string) []byte {
 	}
 
 	var i int
-	var p goboardbackend.Post
-	for i, p = range posts {
-		if p.ID == 0 {
-			break
-		}
+	for i = 0; i < len(posts) && posts[i].ID != 0; i++ {
 		posts[i].RawMessage = "" // Don't print rawData field
 	}
 
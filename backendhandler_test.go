@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+	goboardhub "github.com/dguihal/goboard/internal/hub"
+	goboardstore "github.com/dguihal/goboard/internal/store"
+)
+
+// historyCountingStore counts the GetHistory calls of the handlers
+type historyCountingStore struct {
+	goboardstore.Store
+	histories atomic.Int32
+}
+
+func (s *historyCountingStore) GetHistory(board string, limit int, last uint64, before uint64) ([]goboardbackend.Post, error) {
+	s.histories.Add(1)
+	return s.Store.GetHistory(board, limit, last, before)
+}
+
+func TestPostRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		form   url.Values
+		header http.Header
+		status int
+		want   testPost // Login, Info and Message of the stored post
+	}{
+		{"message with info", url.Values{"message": {"hello"}, "info": {"tester"}}, nil, http.StatusNoContent, testPost{Info: "tester", Message: "hello"}},
+		{"user agent as info", url.Values{"message": {"hi"}}, http.Header{"User-Agent": {"tribune/1.0"}}, http.StatusNoContent, testPost{Info: "tribune/1.0", Message: "hi"}},
+		{"markup is escaped", url.Values{"message": {"<script>x</script>"}, "info": {"tester"}}, nil, http.StatusNoContent, testPost{Info: "tester", Message: "&lt;script&gt;x&lt;/script&gt;"}},
+		{"empty message", url.Values{"message": {""}}, nil, http.StatusBadRequest, testPost{}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, testConfig(), nil)
+			s.post(t, "", "first")
+
+			if status, body := s.do(t, http.MethodPost, "/post", tc.form, tc.header); status != tc.status {
+				t.Fatalf("post: status %d, want %d: %s", status, tc.status, body)
+			}
+
+			posts := s.backend(t, "")
+			if tc.status != http.StatusNoContent {
+				if len(posts) != 1 {
+					t.Errorf("%d posts in backend, want 1", len(posts))
+				}
+				return
+			}
+			if len(posts) != 2 || posts[0].ID != 2 || posts[1].ID != 1 {
+				t.Fatalf("backend %+v, want posts 2 and 1", posts)
+			}
+			got := posts[0]
+			if got.Login != tc.want.Login || got.Info != tc.want.Info || got.Message != tc.want.Message {
+				t.Errorf("post %+v, want %+v", got, tc.want)
+			}
+
+			status, body := s.do(t, http.MethodGet, "/post/"+strconv.FormatUint(got.ID, 10)+"/json", nil, nil)
+			if status != http.StatusOK {
+				t.Fatalf("get post: status %d", status)
+			}
+			var single testPost
+			if err := json.Unmarshal([]byte(body), &single); err != nil {
+				t.Fatal(err)
+			}
+			if single.ID != got.ID || single.Message != got.Message || single.Info != got.Info {
+				t.Errorf("post %+v, want %+v as in backend", single, got)
+			}
+		})
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	const wait = 300 * time.Millisecond
+
+	tests := []struct {
+		name     string
+		deleted  string // Rendering of deleted posts
+		query    string
+		status   int
+		blocks   bool  // Held for the whole wait
+		maxReads int32 // GetHistory calls of the request
+	}{
+		{"new posts are answered at once", "", "last=1&wait=1", http.StatusOK, false, 1},
+		{"nothing new is held", "", "last=3&wait=300ms", http.StatusNoContent, true, 1},
+		{"hidden deleted posts are held", deletedHide, "last=2&wait=300ms", http.StatusNoContent, true, 2},
+		{"shown deleted posts are answered", deletedPlaceholder, "last=2&wait=300ms", http.StatusOK, false, 1},
+		{"pages of older posts are not held", "", "before=1&wait=300ms", http.StatusNoContent, false, 1},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// Waiters are woken by board, every test gets its own
+			board := "lp" + string(rune('a'+i))
+			config := testConfig()
+			config.Boards = map[string]BoardConfig{board: {DeletedPosts: tc.deleted}}
+			store := &historyCountingStore{Store: goboardstore.NewMemoryStore()}
+			s := newTestServer(t, config, store)
+
+			for _, m := range []string{"one", "two", "three"} {
+				s.post(t, "/b/"+board, m)
+			}
+			if status, _ := s.do(t, http.MethodDelete, "/b/"+board+"/admin/post/3", nil, admin()); status != http.StatusOK {
+				t.Fatalf("delete: status %d", status)
+			}
+
+			store.histories.Store(0)
+			start := time.Now()
+			status, _ := s.do(t, http.MethodGet, "/b/"+board+"/backend/tsv?"+tc.query, nil, nil)
+			elapsed := time.Since(start)
+
+			if status != tc.status {
+				t.Errorf("status %d, want %d", status, tc.status)
+			}
+			if held := elapsed >= wait; held != tc.blocks {
+				t.Errorf("answered after %v, held: %v, want %v", elapsed, held, tc.blocks)
+			}
+			if n := store.histories.Load(); n > tc.maxReads {
+				t.Errorf("%d history reads, want at most %d", n, tc.maxReads)
+			}
+		})
+	}
+}
+
+func TestLongPollWakesUp(t *testing.T) {
+	config := testConfig()
+	config.Boards = map[string]BoardConfig{"wake": {}}
+	s := newTestServer(t, config, nil)
+	s.post(t, "/b/wake", "first")
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		s.post(t, "/b/wake", "second")
+	}()
+
+	start := time.Now()
+	status, body := s.do(t, http.MethodGet, "/b/wake/backend/tsv?last=1&wait=5", nil, nil)
+	elapsed := time.Since(start)
+
+	if status != http.StatusOK {
+		t.Fatalf("status %d, want %d", status, http.StatusOK)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("answered after %v, want when the post is made", elapsed)
+	}
+	if len(body) == 0 || body[0] != '2' {
+		t.Errorf("body %q, want post 2", body)
+	}
+}
+
+func TestWriteSSEDelete(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []uint64
+		want string
+	}{
+		{"single post", []uint64{3}, "event: delete\ndata: {\"id\":3,\"ids\":[3]}\n\n"},
+		{"several posts", []uint64{1, 2, 5}, "event: delete\ndata: {\"ids\":[1,2,5]}\n\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if err := writeSSEDelete(w, goboardhub.Deletion("board", tc.ids)); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Body.String(); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPostPublishesStoredPost(t *testing.T) {
+	s := newTestServer(t, testConfig(), nil)
+	first := s.post(t, "", "first")
+	ref, err := s.Store.GetPost("", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := s.Hub.Subscribe(goboardhub.DefaultBufferSize)
+	defer s.Hub.Unsubscribe(sub)
+
+	id := s.post(t, "", ref.Time.In(time.UTC).Format("15:04:05")+" indeed")
+	stored, err := s.Store.GetPost("", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := <-sub.C
+	if e.Type != goboardhub.PostEvent || e.Post.ID != id {
+		t.Fatalf("event %v of post %d, want %v of post %d", e.Type, e.Post.ID, goboardhub.PostEvent, id)
+	}
+	if len(e.Post.Refs) != 1 || e.Post.Refs[0] != first {
+		t.Errorf("refs %v, want [%d]", e.Post.Refs, first)
+	}
+	if !e.Post.Time.Equal(stored.Time.Time) {
+		t.Errorf("time %v, want stored time %v", e.Post.Time, stored.Time)
+	}
+}
+
+func TestStreamReplay(t *testing.T) {
+	const total = 2*streamReplayPageSize + 10
+
+	s := newTestServer(t, testConfig(), nil)
+	for i := 0; i < total; i++ {
+		p := goboardbackend.Post{Time: goboardbackend.PostTime{Time: time.Now()}, Message: "old"}
+		if _, err := s.Store.PostMessage("", p, time.UTC); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		header http.Header
+		last   uint64 // Posts after this one are replayed, up to the last stored one
+	}{
+		{"nothing missed", "", nil, total},
+		{"new client", "", http.Header{"Last-Event-ID": {"0"}}, total},
+		{"part of a page", "", http.Header{"Last-Event-ID": {strconv.Itoa(total - 10)}}, total - 10},
+		{"several pages", "", http.Header{"Last-Event-ID": {"5"}}, 5},
+		{"last parameter", "?last=" + strconv.Itoa(streamReplayPageSize), nil, streamReplayPageSize},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/backend/stream"+tc.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			resp, err := s.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			// Ids of the post events, replayed ones then the live one
+			ids := make(chan uint64)
+			go func() {
+				defer close(ids)
+				r := bufio.NewReader(resp.Body)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if v, ok := strings.CutPrefix(strings.TrimSpace(line), "id: "); ok {
+						id, _ := strconv.ParseUint(v, 10, 64)
+						select {
+						case ids <- id:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}
+			}()
+
+			live := s.post(t, "", "live")
+
+			want := tc.last + 1
+			for id := range ids {
+				if id == live && want > total {
+					return
+				}
+				if id != want {
+					t.Fatalf("post %d, want %d", id, want)
+				}
+				want++
+			}
+			t.Fatalf("stream ended before the live post %d, last post %d", live, want-1)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	goboarduser "github.com/dguihal/goboard/internal/user"
+)
+
+// Time during which a successful HTTP Basic authentication is remembered
+const basicAuthCacheTTL = 5 * time.Minute
+
+// BasicAuthCache remembers the successful HTTP Basic authentications, so that bcrypt does not run
+// on every request of a client. Only salted hashes of the credentials are kept, in memory
+type BasicAuthCache struct {
+	ttl  time.Duration
+	salt []byte
+
+	mu        sync.Mutex
+	entries   map[string]basicAuthEntry // By login
+	lastSweep time.Time
+}
+
+type basicAuthEntry struct {
+	digest  [sha256.Size]byte
+	expires time.Time
+}
+
+// NewBasicAuthCache creates an empty cache whose entries are valid for ttl
+func NewBasicAuthCache(ttl time.Duration) *BasicAuthCache {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		log.Fatalf("Could not generate basic auth cache salt: %v", err)
+	}
+	return &BasicAuthCache{ttl: ttl, salt: salt, entries: map[string]basicAuthEntry{}}
+}
+
+func (c *BasicAuthCache) digest(login string, password string) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(c.salt)
+	h.Write([]byte(login))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+
+	var d [sha256.Size]byte
+	copy(d[:], h.Sum(nil))
+	return d
+}
+
+// Check tells if login was authenticated with password less than the cache ttl ago
+func (c *BasicAuthCache) Check(login string, password string) bool {
+	if c == nil {
+		return false
+	}
+
+	d := c.digest(login, password)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[login]
+	if !ok || !time.Now().Before(e.expires) {
+		return false
+	}
+	return subtle.ConstantTimeCompare(d[:], e.digest[:]) == 1
+}
+
+// Add remembers a successful authentication of login with password
+func (c *BasicAuthCache) Add(login string, password string) {
+	if c == nil {
+		return
+	}
+
+	d := c.digest(login, password)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastSweep) >= c.ttl {
+		for l, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, l)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[login] = basicAuthEntry{digest: d, expires: now.Add(c.ttl)}
+}
+
+// Forget drops the authentication of login, when its password changes or its account is deleted
+func (c *BasicAuthCache) Forget(login string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, login)
+}
+
+// checkBasicAuth authenticates the credentials of an "Authorization: Basic" header, answering the error if it fails
+// Attempts are limited like logins, cached successes skip bcrypt
+func (h *GoBoardHandler) checkBasicAuth(w http.ResponseWriter, r *http.Request, login string, password string) bool {
+	if h.BasicAuth.Check(login, password) {
+		return true
+	}
+
+	// Checked before bcrypt runs
+	if !h.Guard.AllowLogin(w, r, login) {
+		return false
+	}
+
+	if err := h.Store.AuthUser(login, password); err != nil {
+		if uerr, ok := err.(*goboarduser.Error); ok && uerr.ErrCode == goboarduser.AuthenticationFailed {
+			h.Guard.LoginFailed(login)
+			w.Header().Set("WWW-Authenticate", `Basic realm="goboard", charset="UTF-8"`)
+			http.Error(w, "Authentication failed", http.StatusUnauthorized)
+		} else {
+			log.Printf("Error during basic authentication of %s: %v", login, err)
+			http.Error(w, "Internal server error during authentication", http.StatusInternalServerError)
+		}
+		return false
+	}
+
+	h.Guard.LoginSucceeded(login)
+	h.BasicAuth.Add(login, password)
+	return true
+}
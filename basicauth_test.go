@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+)
+
+// basicAuth returns the headers of HTTP Basic credentials
+func basicAuth(login string, password string) http.Header {
+	req := &http.Request{Header: http.Header{}}
+	req.SetBasicAuth(login, password)
+	return req.Header
+}
+
+func TestBasicAuthCacheForget(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, s *testServer) // Run once alice is logged in with a cookie
+		old    int                               // Status of a post with the old password once changed
+	}{
+		{"nothing changed", func(t *testing.T, s *testServer) {}, http.StatusNoContent},
+		{"password changed", func(t *testing.T, s *testServer) {
+			form := url.Values{"current_password": {"secret"}, "new_password": {"changed"}}
+			if status, body := s.do(t, http.MethodPost, "/user/password", form, nil); status != http.StatusNoContent {
+				t.Fatalf("change password: status %d: %s", status, body)
+			}
+		}, http.StatusUnauthorized},
+		{"account deleted", func(t *testing.T, s *testServer) {
+			if status, body := s.do(t, http.MethodDelete, "/user/me", nil, nil); status != http.StatusNoContent {
+				t.Fatalf("delete account: status %d: %s", status, body)
+			}
+		}, http.StatusUnauthorized},
+		{"account deleted by an admin", func(t *testing.T, s *testServer) {
+			if status, body := s.do(t, http.MethodDelete, "/admin/user/alice", nil, admin()); status != http.StatusOK {
+				t.Fatalf("delete user: status %d: %s", status, body)
+			}
+		}, http.StatusUnauthorized},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, testConfig(), nil)
+			if err := s.Store.AddUser("alice", "secret"); err != nil {
+				t.Fatal(err)
+			}
+
+			// Cached by the first post
+			form := url.Values{"message": {"hello"}}
+			if status, body := s.do(t, http.MethodPost, "/post", form, basicAuth("alice", "secret")); status != http.StatusNoContent {
+				t.Fatalf("post: status %d: %s", status, body)
+			}
+
+			jar, err := cookiejar.New(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Client().Jar = jar
+			if status, body := s.do(t, http.MethodPost, "/user/login", url.Values{"login": {"alice"}, "password": {"secret"}}, nil); status != http.StatusOK {
+				t.Fatalf("login: status %d: %s", status, body)
+			}
+			tc.change(t, s)
+			s.Client().Jar = nil
+
+			if status, body := s.do(t, http.MethodPost, "/post", form, basicAuth("alice", "secret")); status != tc.old {
+				t.Errorf("post with the old password: status %d, want %d: %s", status, tc.old, body)
+			}
+		})
+	}
+}
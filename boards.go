@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+	"github.com/gorilla/mux"
+)
+
+// boardPathPrefix is the route prefix of board specific operations
+const boardPathPrefix = "/b/{board}"
+
+// Renderings of deleted posts in backends
+const (
+	deletedPlaceholder = "placeholder" // Post id and time are kept, with a placeholder message
+	deletedHide        = "hide"        // Post is left out
+)
+
+// defaultBoardName is the name of the board served by unprefixed routes if not configured
+const defaultBoardName = "default"
+
+var boardNameReg = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// BoardConfig holds the configuration of a board
+// Empty values are inherited from the global configuration
+type BoardConfig struct {
+	MaxHistorySize  int      `yaml:"MaxHistorySize"`
+	BackendTimeZone string   `yaml:"BackendTimeZone"`
+	AllowedTags     []string `yaml:"AllowedTags"`
+	// -1 disables edition on this board
+	EditWindow   time.Duration `yaml:"EditWindow"`
+	DeletedPosts string        `yaml:"DeletedPosts"`
+}
+
+// BoardSettings holds the settings of a board served by the process
+type BoardSettings struct {
+	Name        string
+	Key         string // Storage key of the board
+	HistorySize int
+	Location    *time.Location
+	AllowedTags map[string]bool
+	EditWindow  time.Duration // 0 if posts can't be edited
+	HideDeleted bool          // Deleted posts are left out of backends instead of shown as placeholders
+}
+
+// Boards is the set of boards served by the process
+type Boards struct {
+	Default *BoardSettings
+	byName  map[string]*BoardSettings
+}
+
+// NewBoards creates the boards declared in the configuration
+// The default board is stored in historical buckets, so that existing databases are kept
+func NewBoards(config *Config) (*Boards, error) {
+	bs := &Boards{byName: map[string]*BoardSettings{}}
+
+	defaultName := config.DefaultBoard
+	if len(defaultName) == 0 {
+		defaultName = defaultBoardName
+	}
+
+	boardConfigs := map[string]BoardConfig{}
+	for name, bc := range config.Boards {
+		boardConfigs[name] = bc
+	}
+	if _, ok := boardConfigs[defaultName]; !ok {
+		boardConfigs[defaultName] = BoardConfig{}
+	}
+
+	for name, bc := range boardConfigs {
+		if !boardNameReg.MatchString(name) {
+			return nil, fmt.Errorf("invalid board name %q", name)
+		}
+
+		board := &BoardSettings{
+			Name:        name,
+			Key:         name,
+			HistorySize: bc.MaxHistorySize,
+		}
+		if name == defaultName {
+			board.Key = goboardbackend.DefaultBoard
+			bs.Default = board
+		}
+
+		if board.HistorySize <= 0 {
+			board.HistorySize = config.MaxHistorySize
+		}
+
+		switch {
+		case bc.EditWindow > 0:
+			board.EditWindow = bc.EditWindow
+		case bc.EditWindow == 0 && config.EditWindow > 0:
+			board.EditWindow = config.EditWindow
+		}
+
+		deleted := bc.DeletedPosts
+		if len(deleted) == 0 {
+			deleted = config.DeletedPosts
+		}
+		switch deleted {
+		case "", deletedPlaceholder:
+		case deletedHide:
+			board.HideDeleted = true
+		default:
+			return nil, fmt.Errorf("board %s: invalid DeletedPosts %q (%s or %s)", name, deleted, deletedPlaceholder, deletedHide)
+		}
+
+		tz := bc.BackendTimeZone
+		if len(tz) == 0 {
+			tz = config.BackendTimeZone
+		}
+		if location, err := time.LoadLocation(tz); err == nil {
+			board.Location = location
+		} else {
+			// Falls back to current Location
+			log.Printf("Board %s: invalid timezone %s, using local time", name, tz)
+			board.Location = time.Now().Location()
+		}
+
+		tags, err := goboardbackend.TagSet(bc.AllowedTags)
+		if err != nil {
+			return nil, fmt.Errorf("board %s: %w", name, err)
+		}
+		board.AllowedTags = tags
+
+		bs.byName[name] = board
+	}
+
+	return bs, nil
+}
+
+// ForRequest returns the board targeted by a request (nil if it does not exist)
+func (bs *Boards) ForRequest(r *http.Request) *BoardSettings {
+	name, ok := mux.Vars(r)["board"]
+	if !ok {
+		return bs.Default
+	}
+	return bs.byName[name]
+}
+
+// ByName returns a board from its name (nil if it does not exist)
+func (bs *Boards) ByName(name string) *BoardSettings {
+	return bs.byName[name]
+}
+
+// All returns every board, sorted by name
+func (bs *Boards) All() []*BoardSettings {
+	all := make([]*BoardSettings, 0, len(bs.byName))
+	for _, b := range bs.byName {
+		all = append(all, b)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	goboardsession "github.com/dguihal/goboard/internal/session"
+)
+
+// CookieConfig holds the attributes of session cookies and the protections against cross-site requests
+type CookieConfig struct {
+	Secure   bool   `yaml:"Secure"`   // Cookies are only sent over HTTPS
+	SameSite string `yaml:"SameSite"` // "lax" (default), "strict" or "none" (requires Secure)
+	Domain   string `yaml:"Domain"`   // Domain of the cookies, the host of the requests if empty
+
+	// Origins (scheme://host[:port]) of other sites allowed to send cookie authenticated requests
+	TrustedOrigins []string `yaml:"TrustedOrigins"`
+	// Also accept GET /user/logout, which any page can trigger (compatibility with older clients)
+	GetLogout bool `yaml:"GetLogout"`
+}
+
+var sameSiteModes = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// check validates the configuration and sets its defaults
+func (c *CookieConfig) check() error {
+	c.SameSite = strings.ToLower(c.SameSite)
+	if len(c.SameSite) == 0 {
+		c.SameSite = "lax"
+	}
+	if _, ok := sameSiteModes[c.SameSite]; !ok {
+		return fmt.Errorf("invalid Cookies.SameSite %q", c.SameSite)
+	}
+	if c.SameSite == "none" && !c.Secure {
+		return fmt.Errorf("Cookies.SameSite none requires Cookies.Secure")
+	}
+
+	for i, o := range c.TrustedOrigins {
+		origin, ok := parseOrigin(o)
+		if !ok {
+			return fmt.Errorf("invalid trusted origin %q", o)
+		}
+		c.TrustedOrigins[i] = origin
+	}
+	return nil
+}
+
+// apply sets the configured attributes on a cookie
+func (c CookieConfig) apply(cookie *http.Cookie) {
+	cookie.Secure = c.Secure
+	cookie.SameSite = sameSiteModes[c.SameSite]
+	cookie.Domain = c.Domain
+}
+
+// OriginGuard rejects cross-site requests which could act on behalf of a logged in user (CSRF)
+// State changing requests sending a session cookie, and authentications, must come from the board
+// itself or from a trusted origin, as well as those sending HTTP Basic credentials, which browsers also send by
+// themselves. Requests from other clients (no Origin nor Referer header) are accepted
+type OriginGuard struct {
+	trusted map[string]bool
+}
+
+// Authentications are checked even without cookie, so that a site can't log its visitors in an account it controls
+var originCheckedPaths = map[string]bool{"/user/add": true, "/user/login": true}
+
+// NewOriginGuard creates an OriginGuard trusting the configured origins
+func NewOriginGuard(config CookieConfig) *OriginGuard {
+	g := &OriginGuard{trusted: map[string]bool{}}
+	for _, o := range config.TrustedOrigins {
+		g.trusted[o] = true
+	}
+	return g
+}
+
+// Middleware answers 403 to the rejected requests
+func (g *OriginGuard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.allow(r) {
+			http.Error(w, "Cross-site request rejected", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (g *OriginGuard) allow(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	_, err := r.Cookie(goboardsession.CookieName)
+	_, _, basic := r.BasicAuth()
+	if err != nil && !basic && !originCheckedPaths[r.URL.Path] {
+		return true
+	}
+
+	source := r.Header.Get("Origin")
+	if len(source) == 0 {
+		source = r.Header.Get("Referer")
+	}
+	if len(source) == 0 {
+		return true
+	}
+
+	origin, ok := parseOrigin(source)
+	if !ok {
+		// Including "null", sent by sandboxed and privacy sensitive contexts
+		return false
+	}
+	u, _ := url.Parse(origin)
+	return strings.EqualFold(u.Host, r.Host) || g.trusted[origin]
+}
+
+// parseOrigin returns the scheme://host[:port] part of a URL, lower cased
+func parseOrigin(s string) (string, bool) {
+	u, err := url.Parse(s)
+	if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return "", false
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), true
+}
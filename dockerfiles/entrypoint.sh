@@ -24,6 +24,11 @@ else
 	sed -i -e "s#AdminToken: .*#AdminToken: ${ADMIN_TOKEN}#" "${GOBOARD_CONFIG_FILE}"
 fi
 
+if [ -n "${SESSION_SECRET}" ]; then
+	sed -i -e "/^SessionSecret/d" "${GOBOARD_CONFIG_FILE}"
+	echo "SessionSecret: ${SESSION_SECRET}" >> "${GOBOARD_CONFIG_FILE}"
+fi
+
 sed -i -e "s#^GoBoardDBFile: .*#GoBoardDBFile: ${GOBOARD_DB_FILE}#" "${GOBOARD_CONFIG_FILE}"
 sed -i -e "s#^SwaggerPath: .*#SwaggerPath: ${SWAGGER_PATH}#" "${GOBOARD_CONFIG_FILE}"
 sed -i -e "s#WebuiPath: .*#WebuiPath: ${WEBUI_PATH}#" "${GOBOARD_CONFIG_FILE}"
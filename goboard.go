@@ -12,6 +12,9 @@ import (
 	"syscall"
 	"time"
 
+	goboardhub "github.com/dguihal/goboard/internal/hub"
+	goboardsession "github.com/dguihal/goboard/internal/session"
+	goboardstore "github.com/dguihal/goboard/internal/store"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	bolt "go.etcd.io/bbolt"
@@ -33,8 +36,33 @@ type Config struct {
 	SwaggerPath       string      `yaml:"SwaggerPath"`
 	WebuiPath         string      `yaml:"WebuiPath"`
 	AdminToken        string      `yaml:"AdminToken"`
+	Storage           string      `yaml:"Storage"`
+	GoBoardSQLiteFile string      `yaml:"GoBoardSQLiteFile"`
+
+	// Time during which authors can edit their posts (0 to disable edition)
+	EditWindow time.Duration `yaml:"EditWindow"`
+	// Rendering of deleted posts in backends: "placeholder" (default) or "hide"
+	DeletedPosts string `yaml:"DeletedPosts"`
+	// Key of the hashes of session tokens stored in database (changing it closes every session)
+	SessionSecret string `yaml:"SessionSecret"`
+
+	DefaultBoard string                 `yaml:"DefaultBoard"`
+	Boards       map[string]BoardConfig `yaml:"Boards"`
+
+	Cookies   CookieConfig    `yaml:"Cookies"`
+	OIDC      OIDCConfig      `yaml:"OIDC"`
+	Retention RetentionConfig `yaml:"Retention"`
+	RateLimit RateLimitConfig `yaml:"RateLimit"`
+	Spam      SpamConfig      `yaml:"Spam"`
 }
 
+// Supported storages
+const (
+	storageBolt   = "bolt"
+	storageSQLite = "sqlite"
+	storageMemory = "memory"
+)
+
 // RESTEndpointHandler defines a handler function for a REST Endpoint
 type RESTEndpointHandler func(http.ResponseWriter, *http.Request)
 
@@ -46,26 +74,63 @@ type SupportedOp struct {
 	handler  RESTEndpointHandler
 }
 
+// matches tells if a request has been routed to this endpoint
+// Falls back to PathBase when the request was not routed by mux
+func (op SupportedOp) matches(r *http.Request) bool {
+	if r.Method != op.Method {
+		return false
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return strings.TrimPrefix(tpl, boardPathPrefix) == op.RestPath
+		}
+	}
+	return strings.HasPrefix(r.URL.Path, op.PathBase)
+}
+
 // GoBoardHandler Base Class for endpoint handlers
 type GoBoardHandler struct {
-	Db           *bolt.DB
-	supportedOps []SupportedOp
+	Store         goboardstore.Store
+	Hub           *goboardhub.Hub
+	Boards        *Boards
+	Guard         *FloodGuard
+	Spam          *SpamChain
+	SessionHasher goboardsession.Hasher
+	BasicAuth     *BasicAuthCache
+	supportedOps  []SupportedOp
+	boardOps      []SupportedOp // Operations also served under boardPathPrefix
+}
+
+// registerOps adds the routes of a handler to a router
+func registerOps(r *mux.Router, h http.Handler, g *GoBoardHandler) {
+	for _, op := range g.supportedOps {
+		r.Handle(op.RestPath, h).Methods(op.Method)
+	}
+	for _, op := range g.boardOps {
+		r.Handle(boardPathPrefix+op.RestPath, h).Methods(op.Method)
+	}
 }
 
 // Command line arguments management
 var configFilePath string
 var showHelp bool
+var restoreFilePath string
+var restoreChecksum string
 
 func init() {
 	const (
 		defaultConfigFilePath = "goboard.yaml"
 		usageC                = "Path to `goboard config file`"
 		usageH                = "Show help"
+		usageR                = "Replace the bolt database by a `snapshot` (from /admin/backup) before starting"
+		usageS                = "Expected sha256 `checksum` of the restored snapshot (X-Backup-SHA256 header of the backup)"
 	)
 	flag.StringVar(&configFilePath, "config", defaultConfigFilePath, usageC)
 	flag.StringVar(&configFilePath, "C", defaultConfigFilePath, usageC+" (shorthand)")
 	flag.BoolVar(&showHelp, "help", false, usageH)
 	flag.BoolVar(&showHelp, "h", false, usageH+" (shorthand)")
+	flag.StringVar(&restoreFilePath, "restore", "", usageR)
+	flag.StringVar(&restoreChecksum, "restore-sha256", "", usageS)
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -92,10 +157,81 @@ func loadConfig(path string) (*Config, error) {
 	if config.AccessLogFileMode == 0 {
 		config.AccessLogFileMode = 0660
 	}
+	if len(config.Storage) == 0 {
+		config.Storage = storageBolt
+	}
+	if len(config.GoBoardSQLiteFile) == 0 {
+		config.GoBoardSQLiteFile = "goboard.sqlite"
+	}
+	if config.Retention.Interval <= 0 {
+		config.Retention.Interval = time.Hour
+	}
+	if config.Retention.BatchSize <= 0 {
+		config.Retention.BatchSize = 500
+	}
+	if config.Retention.ArchiveMaxSize <= 0 {
+		config.Retention.ArchiveMaxSize = 64 << 20
+	}
+	if config.Spam.RulesReload <= 0 {
+		config.Spam.RulesReload = 10 * time.Second
+	}
+	if err := config.Cookies.check(); err != nil {
+		return nil, err
+	}
+	if err := config.OIDC.check(); err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
 
+func openStore(config *Config) (goboardstore.Store, error) {
+	switch config.Storage {
+	case storageBolt:
+		db, err := bolt.Open(config.GoBoardDBFile, config.GoBoardDBFileMode, &bolt.Options{Timeout: 1 * time.Second})
+		if err != nil {
+			return nil, err
+		}
+		// Sessions used to be stored as cookies, without any index by login
+		n, err := goboardsession.MigrateLegacyCookies(db)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("could not migrate cookies to sessions: %w", err)
+		}
+		if n > 0 {
+			log.Printf("%d cookies migrated to sessions", n)
+		}
+		// Sessions used to be stored with their token, restored dumps may contain such sessions too
+		if n, err = goboardsession.HashTokens(db, goboardsession.NewHasher(config.SessionSecret)); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("could not hash session tokens: %w", err)
+		}
+		if n > 0 {
+			log.Printf("%d session tokens hashed", n)
+		}
+		return goboardstore.NewBoltStore(db), nil
+	case storageSQLite:
+		s, err := goboardstore.NewSQLiteStore(config.GoBoardSQLiteFile, config.GoBoardDBFileMode)
+		if err != nil {
+			return nil, err
+		}
+		n, err := s.HashSessionTokens(goboardsession.NewHasher(config.SessionSecret))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("could not hash session tokens: %w", err)
+		}
+		if n > 0 {
+			log.Printf("%d session tokens hashed", n)
+		}
+		return s, nil
+	case storageMemory:
+		log.Println("Using memory storage: nothing will be persisted")
+		return goboardstore.NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage %s", config.Storage)
+	}
+}
+
 func setupLogging(logFile string, mode os.FileMode) *os.File {
 	var fiAccessLog *os.File
 	var err error
@@ -152,30 +288,55 @@ func setupWebui(r *mux.Router, templateHandler *TemplateHandler, webuiPath strin
 	}
 }
 
-func setupRouter(db *bolt.DB, config *Config) *mux.Router {
+func setupRouter(store goboardstore.Store, postHub *goboardhub.Hub, boards *Boards, guard *FloodGuard, spam *SpamChain, config *Config) *mux.Router {
 	mainRouter := mux.NewRouter().StrictSlash(true)
 	r := mainRouter
 
+	// Cross-site request forgery protection of cookie authenticated operations
+	r.Use(NewOriginGuard(config.Cookies).Middleware)
+
+	hasher := goboardsession.NewHasher(config.SessionSecret)
+	basicAuth := NewBasicAuthCache(basicAuthCacheTTL)
+
 	// Backend operations
-	backendHandler := NewBackendHandler(config.MaxHistorySize, config.BackendTimeZone)
-	backendHandler.Db = db
-	for _, op := range backendHandler.supportedOps {
-		r.Handle(op.RestPath, backendHandler).Methods(op.Method)
-	}
+	backendHandler := NewBackendHandler()
+	backendHandler.Store = store
+	backendHandler.Hub = postHub
+	backendHandler.Boards = boards
+	backendHandler.Guard = guard
+	backendHandler.Spam = spam
+	backendHandler.SessionHasher = hasher
+	backendHandler.BasicAuth = basicAuth
+	registerOps(r, backendHandler, &backendHandler.GoBoardHandler)
 
 	// User operations
-	userHandler := NewUserHandler(config.CookieDuration)
-	userHandler.Db = db
-	for _, op := range userHandler.supportedOps {
-		r.Handle(op.RestPath, userHandler).Methods(op.Method)
-	}
+	userHandler := NewUserHandler(config.CookieDuration, config.Cookies, NewOIDCLogin(config.OIDC))
+	userHandler.Store = store
+	userHandler.Guard = guard
+	userHandler.SessionHasher = hasher
+	userHandler.BasicAuth = basicAuth
+	registerOps(r, userHandler, &userHandler.GoBoardHandler)
 
 	// Admin operations
 	adminHandler := NewAdminHandler(config.AdminToken)
-	adminHandler.Db = db
-	for _, op := range adminHandler.supportedOps {
-		r.Handle(op.RestPath, adminHandler).Methods(op.Method)
-	}
+	adminHandler.Store = store
+	adminHandler.Hub = postHub
+	adminHandler.Boards = boards
+	adminHandler.Guard = guard
+	adminHandler.Spam = spam
+	adminHandler.SessionHasher = hasher
+	adminHandler.BasicAuth = basicAuth
+	registerOps(r, adminHandler, &adminHandler.GoBoardHandler)
+
+	// Websocket operations
+	wsHandler := NewWSHandler()
+	wsHandler.Store = store
+	wsHandler.Hub = postHub
+	wsHandler.Boards = boards
+	wsHandler.Guard = guard
+	wsHandler.Spam = spam
+	wsHandler.SessionHasher = hasher
+	registerOps(r, wsHandler, &wsHandler.GoBoardHandler)
 
 	templateHandler := NewTemplateHandler()
 	setupSwagger(r, templateHandler, config.SwaggerPath)
@@ -203,15 +364,77 @@ func main() {
 		defer fiAccessLog.Close()
 	}
 
+	// Restore a backup before opening database
+	if len(restoreFilePath) > 0 {
+		if config.Storage != storageBolt {
+			log.Fatalf("error: only bolt storage can be restored")
+		}
+		if err := goboardstore.RestoreBoltSnapshot(restoreFilePath, config.GoBoardDBFile, config.GoBoardDBFileMode, restoreChecksum); err != nil {
+			log.Fatalf("error: restore failed: %v", err)
+		}
+		log.Printf("%s restored from %s", config.GoBoardDBFile, restoreFilePath)
+	}
+
+	if len(config.SessionSecret) == 0 {
+		log.Println("SessionSecret is not set: session tokens are hashed without secret")
+	}
+
 	// Open database
-	db, err := bolt.Open(config.GoBoardDBFile, config.GoBoardDBFileMode, &bolt.Options{Timeout: 1 * time.Second})
+	store, err := openStore(config)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	defer store.Close()
+
+	boards, err := NewBoards(config)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+
+	// Posts events dispatcher
+	postHub := goboardhub.New()
+
+	// History pruning
+	pruneCtx, stopPruning := context.WithCancel(context.Background())
+	pruneDone := make(chan struct{})
+	if config.Retention.Enabled() {
+		pruner, err := NewPruner(config.Retention, store, boards)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		go func() {
+			pruner.Run(pruneCtx)
+			close(pruneDone)
+		}()
+	} else {
+		close(pruneDone)
+	}
+
+	// Expired sessions removal
+	sweepCtx, stopSweeping := context.WithCancel(context.Background())
+	sweepDone := make(chan struct{})
+	go func() {
+		sweepSessions(sweepCtx, store)
+		close(sweepDone)
+	}()
+
+	// Flood protection
+	guard, err := NewFloodGuard(config.RateLimit)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+
+	// Anti-spam filters, the rules file is reloaded until exit
+	spam, err := NewSpamChain(config.Spam)
 	if err != nil {
 		log.Fatalf("error: %v", err)
 	}
-	defer db.Close()
+	spamCtx, stopSpam := context.WithCancel(context.Background())
+	defer stopSpam()
+	go spam.Run(spamCtx)
 
 	// Initialize router
-	mainRouter := setupRouter(db, config)
+	mainRouter := setupRouter(store, postHub, boards, guard, spam, config)
 
 	fmt.Println("GoBoard version ", goBoardVer, " starting on port", config.ListenPort)
 
@@ -226,6 +449,9 @@ func main() {
 		IdleTimeout:       5 * time.Minute,
 	}
 
+	// Ends long lived streams so that Shutdown doesn't wait for them
+	server.RegisterOnShutdown(postHub.Close)
+
 	go func() {
 		log.Println("Server starting on", server.Addr)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -247,6 +473,12 @@ func main() {
 	if err := server.Shutdown(ctx); err != nil {
 		log.Printf("Server shutdown error: %v", err)
 	}
+
+	// Database must not be closed during a pruning batch or a sessions sweep
+	stopPruning()
+	<-pruneDone
+	stopSweeping()
+	<-sweepDone
 }
 
 //http://thenewstack.io/make-a-restful-json-api-go/
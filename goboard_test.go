@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	goboardhub "github.com/dguihal/goboard/internal/hub"
+	goboardstore "github.com/dguihal/goboard/internal/store"
+)
+
+const testAdminToken = "test-admin-token"
+
+// testServer is a board server started for a test
+type testServer struct {
+	*httptest.Server
+	Store goboardstore.Store
+	Hub   *goboardhub.Hub
+}
+
+// testConfig returns a configuration without limits nor filters
+func testConfig() *Config {
+	return &Config{
+		BackendTimeZone: "UTC",
+		MaxHistorySize:  50,
+		CookieDuration:  1,
+		AdminToken:      testAdminToken,
+	}
+}
+
+// newTestServer starts a server on store (a MemoryStore if nil), closed at the end of the test
+func newTestServer(t *testing.T, config *Config, store goboardstore.Store) *testServer {
+	t.Helper()
+
+	if store == nil {
+		store = goboardstore.NewMemoryStore()
+	}
+	boards, err := NewBoards(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard, err := NewFloodGuard(config.RateLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spam, err := NewSpamChain(config.Spam)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := goboardhub.New()
+
+	s := &testServer{Server: httptest.NewServer(setupRouter(store, hub, boards, guard, spam, config)), Store: store, Hub: hub}
+	t.Cleanup(func() {
+		hub.Close()
+		s.Close()
+	})
+	return s
+}
+
+// do sends a request and returns the response status and body
+func (s *testServer) do(t *testing.T, method string, path string, form url.Values, header http.Header) (int, string) {
+	t.Helper()
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, s.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+// post posts a message anonymously on a board path ("" for the default board) and returns its id
+func (s *testServer) post(t *testing.T, boardPath string, message string) uint64 {
+	t.Helper()
+
+	resp, err := s.Client().PostForm(s.URL+boardPath+"/post", url.Values{"message": {message}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("post %q: status %d", message, resp.StatusCode)
+	}
+	id, err := strconv.ParseUint(resp.Header.Get("X-Post-Id"), 10, 64)
+	if err != nil {
+		t.Fatalf("post %q: invalid X-Post-Id: %v", message, err)
+	}
+	return id
+}
+
+// admin returns the headers of the requests of the admin token
+func admin() http.Header {
+	return http.Header{"Token-Id": {testAdminToken}}
+}
+
+// testPost is a post read from a json backend, times are left out as PostTime can't be parsed back
+type testPost struct {
+	ID      uint64   `json:"id"`
+	Login   string   `json:"login"`
+	Info    string   `json:"info"`
+	Message string   `json:"message"`
+	Refs    []uint64 `json:"refs"`
+	Deleted any      `json:"deleted"`
+}
+
+// backend returns the json backend of a board path ("" for the default board), newest post first
+func (s *testServer) backend(t *testing.T, boardPath string) []testPost {
+	t.Helper()
+
+	status, body := s.do(t, http.MethodGet, boardPath+"/backend/json", nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("backend: status %d", status)
+	}
+	var b struct {
+		Posts []testPost
+	}
+	if err := json.Unmarshal([]byte(body), &b); err != nil {
+		t.Fatalf("backend: %v", err)
+	}
+	return b.Posts
+}
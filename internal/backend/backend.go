@@ -1,8 +1,10 @@
 package backend
 
 import (
+	"bytes"
 	"encoding/json"
 	"encoding/xml"
+	"strings"
 	"time"
 
 	goboardutils "github.com/dguihal/goboard/internal/utils"
@@ -11,19 +13,49 @@ import (
 
 const backendBucketName string = "Backend"
 
+// DefaultBoard is the board stored in historical (unsuffixed) buckets
+const DefaultBoard = ""
+
+// Replies index: keys are referenced post id followed by replying post id
+const repliesBucketName string = "Replies"
+
+// Number of posts of the boards: keys are the names of the backend buckets
+const countsBucketName string = "PostCounts"
+
 // Post represents a user post
 type Post struct {
-	XMLName    xml.Name `xml:"post" json:"-"`
-	ID         uint64   `xml:"id,attr" json:"id"`
-	Time       PostTime `xml:"time,attr" json:"time"`
-	Login      string   `xml:"login" json:"login"`
-	Info       string   `xml:"info" json:"info"`
-	Message    string   `xml:"message" json:"message"`
-	RawMessage string   `xml:"-" json:"rawmessage,omitempty"`
+	XMLName    xml.Name    `xml:"post" json:"-"`
+	ID         uint64      `xml:"id,attr" json:"id"`
+	Time       PostTime    `xml:"time,attr" json:"time"`
+	Login      string      `xml:"login" json:"login"`
+	Info       string      `xml:"info" json:"info"`
+	Message    string      `xml:"message" json:"message"`
+	RawMessage string      `xml:"-" json:"rawmessage,omitempty"`
+	Refs       PostRefs    `xml:"refs,omitempty" json:"refs,omitempty"`          // Ids of the posts referenced by norloges
+	Edited     *PostTime   `xml:"edited,attr,omitempty" json:"edited,omitempty"` // Time of the last edit, nil if never edited
+	Deleted    *Moderation `xml:"deleted,omitempty" json:"deleted,omitempty"`    // Set on tombstones of deleted posts
 }
 
-// TZLocation is destination TZ location for backends in TSV and XML
-var TZLocation *time.Location
+// PostRefs is a list of post ids
+type PostRefs []uint64
+
+// MarshalXML converts a PostRefs to a list of ref elements
+func (r PostRefs) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(struct {
+		Refs []uint64 `xml:"ref"`
+	}{r}, start)
+}
+
+// Without returns the refs without id, in a new list
+func (r PostRefs) Without(id uint64) PostRefs {
+	var refs PostRefs
+	for _, ref := range r {
+		if ref != id {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
 
 // PostTime represents the timestamp of a user post
 type PostTime struct {
@@ -34,11 +66,35 @@ type PostTime struct {
 const PostTimeFormat = "20060102150405"
 
 // MarshalText converts a PostTime to a byte array
+// Time is formatted in its own location (see Localize)
 func (pt PostTime) MarshalText() (result []byte, err error) {
-	timeS := pt.In(TZLocation).Format(PostTimeFormat)
+	timeS := pt.Format(PostTimeFormat)
 	return []byte(timeS), nil
 }
 
+// Localize sets posts times in a board location before formatting them
+func Localize(posts []Post, loc *time.Location) {
+	for i := range posts {
+		posts[i].Time.Time = posts[i].Time.In(loc)
+		if posts[i].Edited != nil {
+			posts[i].Edited = &PostTime{posts[i].Edited.In(loc)}
+		}
+		if posts[i].Deleted != nil {
+			deleted := *posts[i].Deleted
+			deleted.Time.Time = deleted.Time.In(loc)
+			posts[i].Deleted = &deleted
+		}
+	}
+}
+
+// bucketName returns the name of a bucket for a board
+func bucketName(base string, board string) []byte {
+	if board == DefaultBoard {
+		return []byte(base)
+	}
+	return []byte(base + ":" + board)
+}
+
 // Board represents the base struture for a board backend
 type Board struct {
 	XMLName xml.Name `xml:"board" json:"-"`
@@ -46,47 +102,129 @@ type Board struct {
 	Posts   []Post   `xml:"" `
 }
 
-// DeletePost is a method for deleting a post from the history
-func DeletePost(db *bolt.DB, id uint64) (err error) {
+// PurgePosts removes posts from the history in a single transaction, without leaving tombstones
+// They are removed from the refs of their replies as well
+func PurgePosts(db *bolt.DB, board string, ids []uint64) (err error) {
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists([]byte(backendBucketName))
+		b, err := tx.CreateBucketIfNotExists(bucketName(backendBucketName, board))
 		if err != nil {
 			return err
 		}
+		rb := tx.Bucket(bucketName(repliesBucketName, board))
+
+		count, err := postCount(tx, b, board)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			key := goboardutils.IToB(id)
+
+			// Remove the post from the replies and search indexes
+			if v := b.Get(key); v != nil {
+				count--
+
+				var p Post
+				if err := json.Unmarshal(v, &p); err != nil {
+					return err
+				}
+
+				if err := deleteReplies(tx, board, p); err != nil {
+					return err
+				}
+
+				if err := unindexPost(tx, board, p); err != nil {
+					return err
+				}
+			}
+
+			if err := deleteRevisions(tx, board, id); err != nil {
+				return err
+			}
 
-		return b.Delete(goboardutils.IToB(id))
+			// Replies to the post
+			if rb != nil {
+				c := rb.Cursor()
+				for k, _ := c.Seek(key); k != nil && bytes.HasPrefix(k, key); k, _ = c.Seek(key) {
+					if err := dropRef(b, append([]byte{}, k[len(key):]...), id); err != nil {
+						return err
+					}
+					if err := c.Delete(); err != nil {
+						return err
+					}
+				}
+			}
+
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+		}
+		return setPostCount(tx, board, count)
 	})
 	return
 }
 
+// dropRef removes a purged post from the refs of one of its replies
+func dropRef(b *bolt.Bucket, replyKey []byte, id uint64) error {
+	v := b.Get(replyKey)
+	if v == nil {
+		return nil
+	}
+
+	var p Post
+	if err := json.Unmarshal(v, &p); err != nil {
+		return err
+	}
+	p.Refs = p.Refs.Without(id)
+
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return b.Put(replyKey, buf)
+}
+
 // GetBackend returns the last posts from the history
-func GetBackend(db *bolt.DB, historySize int, last uint64) (posts []Post, err error) {
+func GetBackend(db *bolt.DB, board string, historySize int, last uint64) (posts []Post, err error) {
+	return GetHistory(db, board, historySize, last, 0)
+}
+
+// GetHistory returns up to limit posts (newest first) with ids greater than last
+// and lower than before (if not 0)
+func GetHistory(db *bolt.DB, board string, limit int, last uint64, before uint64) (posts []Post, err error) {
 
-	posts = make([]Post, historySize)
+	posts = make([]Post, 0, limit)
 
 	err = db.View(func(tx *bolt.Tx) error {
 
-		b := tx.Bucket([]byte(backendBucketName))
+		b := tx.Bucket(bucketName(backendBucketName, board))
 		if b == nil {
 			return nil
 		}
 
 		c := b.Cursor()
-		var count int
 
-		for k, v := c.Last(); k != nil && count < historySize; k, v = c.Prev() {
+		k, v := c.Last()
+		if before > 0 {
+			// Seek positions on the first key >= before
+			if k, v = c.Seek(goboardutils.IToB(before)); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+
+		for ; k != nil && len(posts) < limit; k, v = c.Prev() {
 			var p Post
-			err = json.Unmarshal(v, &p)
-			if err != nil {
+			if err := json.Unmarshal(v, &p); err != nil {
 				return err
 			}
 
 			if p.ID <= last {
 				break
 			}
-			posts[count] = p
-			count++
+			posts = append(posts, p)
 		}
 
 		return nil
@@ -94,14 +232,158 @@ func GetBackend(db *bolt.DB, historySize int, last uint64) (posts []Post, err er
 	return
 }
 
+// GetOldest returns up to limit posts (oldest first) with ids greater than after
+func GetOldest(db *bolt.DB, board string, limit int, after uint64) (posts []Post, err error) {
+
+	err = db.View(func(tx *bolt.Tx) error {
+
+		b := tx.Bucket(bucketName(backendBucketName, board))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(goboardutils.IToB(after + 1)); k != nil && len(posts) < limit; k, v = c.Next() {
+			var p Post
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			posts = append(posts, p)
+		}
+
+		return nil
+	})
+	return
+}
+
+// CountPosts returns the number of posts of a board
+func CountPosts(db *bolt.DB, board string) (count int, err error) {
+
+	known := true
+	err = db.View(func(tx *bolt.Tx) error {
+		if cb := tx.Bucket([]byte(countsBucketName)); cb != nil {
+			if v := cb.Get(bucketName(backendBucketName, board)); v != nil {
+				count = int(goboardutils.BToI(v))
+				return nil
+			}
+		}
+		known = tx.Bucket(bucketName(backendBucketName, board)) == nil
+		return nil
+	})
+	if err != nil || known {
+		return
+	}
+
+	// Databases created before the posts were counted: counted once, then maintained on writes
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName(backendBucketName, board))
+		if b == nil {
+			return nil
+		}
+		if count, err = postCount(tx, b, board); err != nil {
+			return err
+		}
+		return setPostCount(tx, board, count)
+	})
+	return
+}
+
+// postCount returns the number of posts of the backend bucket b of a board
+// They are counted if the number is not recorded yet, it must be called before b is modified
+func postCount(tx *bolt.Tx, b *bolt.Bucket, board string) (int, error) {
+	if cb := tx.Bucket([]byte(countsBucketName)); cb != nil {
+		if v := cb.Get(bucketName(backendBucketName, board)); v != nil {
+			return int(goboardutils.BToI(v)), nil
+		}
+	}
+	return b.Stats().KeyN, nil
+}
+
+// setPostCount records the number of posts of a board
+func setPostCount(tx *bolt.Tx, board string, count int) error {
+	cb, err := tx.CreateBucketIfNotExists([]byte(countsBucketName))
+	if err != nil {
+		return err
+	}
+	return cb.Put(bucketName(backendBucketName, board), goboardutils.IToB(uint64(count)))
+}
+
+// GetArchive returns posts made between start (included) and end (excluded), newest first
+func GetArchive(db *bolt.DB, board string, start time.Time, end time.Time) (posts []Post, err error) {
+
+	err = db.View(func(tx *bolt.Tx) error {
+
+		b := tx.Bucket(bucketName(backendBucketName, board))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := seekTime(c, start); k != nil; k, v = c.Next() {
+			var p Post
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+
+			if !p.Time.Before(end) {
+				break
+			}
+			posts = append(posts, p)
+		}
+
+		return nil
+	})
+
+	// Newest first
+	for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+		posts[i], posts[j] = posts[j], posts[i]
+	}
+	return
+}
+
+// seekTime positions the cursor on the first post made at t or after
+// Posts ids are assumed to be ordered as posts times
+func seekTime(c *bolt.Cursor, t time.Time) (key []byte, value []byte) {
+	firstK, _ := c.First()
+	lastK, _ := c.Last()
+	if firstK == nil {
+		return nil, nil
+	}
+
+	var bestID uint64
+	found := false
+	lo, hi := goboardutils.BToI(firstK), goboardutils.BToI(lastK)
+
+	for lo <= hi {
+		mid := lo + (hi-lo)/2
+		k, v := c.Seek(goboardutils.IToB(mid))
+
+		var p Post
+		if err := json.Unmarshal(v, &p); err != nil || !p.Time.Before(t) {
+			bestID, found = goboardutils.BToI(k), true
+			if mid == 0 {
+				break
+			}
+			hi = mid - 1
+		} else {
+			lo = goboardutils.BToI(k) + 1
+		}
+	}
+
+	if !found {
+		return nil, nil
+	}
+	return c.Seek(goboardutils.IToB(bestID))
+}
+
 // GetPost returns a post from its id
-func GetPost(db *bolt.DB, id uint64) (post Post, err error) {
+func GetPost(db *bolt.DB, board string, id uint64) (post Post, err error) {
 
 	post = Post{}
 
 	err = db.View(func(tx *bolt.Tx) error {
 
-		b := tx.Bucket([]byte(backendBucketName))
+		b := tx.Bucket(bucketName(backendBucketName, board))
 		if b == nil {
 			return nil
 		}
@@ -120,13 +402,31 @@ func GetPost(db *bolt.DB, id uint64) (post Post, err error) {
 }
 
 // PostMessage adds a new message to the history
-func PostMessage(db *bolt.DB, post Post) (postID uint64, err error) {
+// Norloges of the message are resolved (in board location) to the ids of the posts they reference
+func PostMessage(db *bolt.DB, board string, post Post, loc *time.Location) (postID uint64, err error) {
+
+	norloges := ParseNorloges(post.Message)
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists([]byte(backendBucketName))
+		b, err := tx.CreateBucketIfNotExists(bucketName(backendBucketName, board))
+		if err != nil {
+			return err
+		}
+
+		post.Refs = nil
+		if len(norloges) > 0 {
+			if post.Refs, err = ResolveNorloges(norloges, post.Time.Time, loc, bucketPostsInRange(b)); err != nil {
+				return err
+			}
+		}
+
+		count, err := postCount(tx, b, board)
 		if err != nil {
 			return err
 		}
+		if err := setPostCount(tx, board, count+1); err != nil {
+			return err
+		}
 
 		id, err := b.NextSequence()
 		if err != nil {
@@ -141,8 +441,195 @@ func PostMessage(db *bolt.DB, post Post) (postID uint64, err error) {
 			return err
 		}
 
-		return b.Put(goboardutils.IToB(post.ID), buf)
+		if err = b.Put(goboardutils.IToB(post.ID), buf); err != nil {
+			return err
+		}
+
+		if err = indexPost(tx, board, post); err != nil {
+			return err
+		}
+
+		return putReplies(tx, board, post)
+	})
+
+	if err == nil {
+		NotifyPost(board, postID)
+	}
+	return
+}
+
+// putReplies adds the references of a post to the replies index
+func putReplies(tx *bolt.Tx, board string, p Post) error {
+	if len(p.Refs) == 0 {
+		return nil
+	}
+
+	rb, err := tx.CreateBucketIfNotExists(bucketName(repliesBucketName, board))
+	if err != nil {
+		return err
+	}
+	for _, ref := range p.Refs {
+		if err := rb.Put(append(goboardutils.IToB(ref), goboardutils.IToB(p.ID)...), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteReplies removes the references of a post from the replies index
+func deleteReplies(tx *bolt.Tx, board string, p Post) error {
+	rb := tx.Bucket(bucketName(repliesBucketName, board))
+	if rb == nil {
+		return nil
+	}
+
+	for _, ref := range p.Refs {
+		if err := rb.Delete(append(goboardutils.IToB(ref), goboardutils.IToB(p.ID)...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetReplies returns the posts referencing a post, newest first
+func GetReplies(db *bolt.DB, board string, id uint64) (posts []Post, err error) {
+
+	err = db.View(func(tx *bolt.Tx) error {
+
+		rb := tx.Bucket(bucketName(repliesBucketName, board))
+		b := tx.Bucket(bucketName(backendBucketName, board))
+		if rb == nil || b == nil {
+			return nil
+		}
+
+		prefix := goboardutils.IToB(id)
+		c := rb.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			v := b.Get(k[len(prefix):])
+			if v == nil {
+				continue
+			}
+
+			var p Post
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			posts = append(posts, p)
+		}
+
+		// Newest first
+		for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+			posts[i], posts[j] = posts[j], posts[i]
+		}
+		return nil
 	})
+	return
+}
+
+// BoardSequences returns the boards stored in a database with their last allocated post id
+func BoardSequences(db *bolt.DB) (seqs map[string]uint64, err error) {
+
+	seqs = map[string]uint64{}
 
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			n := string(name)
+			switch {
+			case n == backendBucketName:
+				seqs[DefaultBoard] = b.Sequence()
+			case strings.HasPrefix(n, backendBucketName+":"):
+				seqs[strings.TrimPrefix(n, backendBucketName+":")] = b.Sequence()
+			}
+			return nil
+		})
+	})
 	return
 }
+
+// ForEachPost calls fn for every post of a board, oldest first
+func ForEachPost(db *bolt.DB, board string, fn func(Post) error) error {
+
+	return db.View(func(tx *bolt.Tx) error {
+
+		b := tx.Bucket(bucketName(backendBucketName, board))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var p Post
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			return fn(p)
+		})
+	})
+}
+
+// ImportPosts stores posts keeping their ids, with their replies and search index entries
+// Posts with the same ids are replaced
+// The board sequence is raised to the highest id imported if needed
+func ImportPosts(db *bolt.DB, board string, posts []Post) error {
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketName(backendBucketName, board))
+		if err != nil {
+			return err
+		}
+
+		count, err := postCount(tx, b, board)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range posts {
+			buf, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			// A replaced post leaves neither its refs nor its terms behind
+			if v := b.Get(goboardutils.IToB(p.ID)); v == nil {
+				count++
+			} else {
+				var old Post
+				if err := json.Unmarshal(v, &old); err != nil {
+					return err
+				}
+				if err := deleteReplies(tx, board, old); err != nil {
+					return err
+				}
+				if err := unindexPost(tx, board, old); err != nil {
+					return err
+				}
+			}
+			if err := b.Put(goboardutils.IToB(p.ID), buf); err != nil {
+				return err
+			}
+			if p.ID > b.Sequence() {
+				if err := b.SetSequence(p.ID); err != nil {
+					return err
+				}
+			}
+
+			if err := indexPost(tx, board, p); err != nil {
+				return err
+			}
+			if err := putReplies(tx, board, p); err != nil {
+				return err
+			}
+		}
+		return setPostCount(tx, board, count)
+	})
+}
+
+// SetSequence sets the last allocated post id of a board
+func SetSequence(db *bolt.DB, board string, seq uint64) error {
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketName(backendBucketName, board))
+		if err != nil {
+			return err
+		}
+		return b.SetSequence(seq)
+	})
+}
@@ -17,17 +17,45 @@ import (
 
 // Sanitize is the entry point for the backend sanitizer
 func Sanitize(input string) string {
+	return SanitizeWithTags(input, allowedTags)
+}
+
+// SanitizeWithTags sanitizes, only keeping the tags of a TagSet
+func SanitizeWithTags(input string, tags map[string]bool) string {
 	tmp := stripCtlFromUTF8(input)
-	return htmlEscape(tmp)
+	return htmlEscape(tmp, tags)
 }
 
 // SanitizeAndValidate sanitizes and applies some validation rules
 func SanitizeAndValidate(input string) (string, error) {
-	tmp := Sanitize(input)
+	return SanitizeAndValidateWithTags(input, allowedTags)
+}
+
+// SanitizeAndValidateWithTags sanitizes (only keeping the tags of a TagSet) and applies some validation rules
+func SanitizeAndValidateWithTags(input string, tags map[string]bool) (string, error) {
+	tmp := SanitizeWithTags(input, tags)
 
 	return validate(tmp)
 }
 
+// TagSet builds a set of allowed tags for the sanitizer
+// Only tags allowed by default can be used, an empty list means all of them
+func TagSet(names []string) (map[string]bool, error) {
+	if len(names) == 0 {
+		return allowedTags, nil
+	}
+
+	tags := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if !allowedTags[name] {
+			return nil, fmt.Errorf("tag %s is not supported", name)
+		}
+		tags[name] = true
+	}
+	return tags, nil
+}
+
 // Remove unwanted (control) characters
 func stripCtlFromUTF8(str string) string {
 	return strings.Map(func(r rune) rune {
@@ -70,7 +98,7 @@ type token struct {
 // Used to cache regex object
 var urlReg *regexp.Regexp
 
-func htmlEscape(input string) string {
+func htmlEscape(input string, tags map[string]bool) string {
 
 	s := lang.NewStack()
 	tagCount := map[string]int{}
@@ -89,9 +117,9 @@ func htmlEscape(input string) string {
 
 		switch tt {
 		case html.StartTagToken:
-			handleStartTag(z, s, tagCount)
+			handleStartTag(z, s, tags, tagCount)
 		case html.EndTagToken:
-			handleEndTag(z, s, tagCount)
+			handleEndTag(z, s, tags, tagCount)
 		default:
 			handleText(z, s)
 		}
@@ -110,12 +138,12 @@ func htmlEscape(input string) string {
 	return str
 }
 
-func handleStartTag(z *html.Tokenizer, s *lang.Stack, tagCount map[string]int) {
+func handleStartTag(z *html.Tokenizer, s *lang.Stack, tags map[string]bool, tagCount map[string]int) {
 	tn, hasAttrs := z.TagName()
 	tnStr := string(tn)
 
 	// Tag belongs to allowed list
-	if allowedTags[tnStr] {
+	if tags[tnStr] {
 		tagAttrsStr := ""
 
 		// Tag attributes management
@@ -147,11 +175,11 @@ func handleStartTag(z *html.Tokenizer, s *lang.Stack, tagCount map[string]int) {
 	}
 }
 
-func handleEndTag(z *html.Tokenizer, s *lang.Stack, tagCount map[string]int) {
+func handleEndTag(z *html.Tokenizer, s *lang.Stack, tags map[string]bool, tagCount map[string]int) {
 	tn, _ := z.TagName()
 	tnStr := string(tn)
 
-	if allowedTags[tnStr] && tagCount[tnStr] > 0 {
+	if tags[tnStr] && tagCount[tnStr] > 0 {
 		endStr := fmt.Sprintf("</%s>", tn)
 
 		var strs []string
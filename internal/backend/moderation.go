@@ -0,0 +1,298 @@
+package backend
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"time"
+
+	goboardutils "github.com/dguihal/goboard/internal/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+/******************************************************************
+ *             Moderation
+ ******************************************************************/
+
+// Moderation log: keys are the entry ids, allocated by the bucket sequence
+const modLogBucketName string = "ModLog"
+
+// A list of moderation log actions
+const (
+	ModDelete  = "delete"
+	ModRestore = "restore"
+)
+
+// Errors returned when a moderation action does not apply to a post
+var (
+	ErrPostDeleted    = errors.New("post is deleted")
+	ErrPostNotDeleted = errors.New("post is not deleted")
+)
+
+// Moderation tells who moderated a post, when and why
+type Moderation struct {
+	Time   PostTime `xml:"time,attr" json:"time"`
+	By     string   `xml:"by,attr,omitempty" json:"by,omitempty"`
+	Reason string   `xml:"reason,attr,omitempty" json:"reason,omitempty"`
+}
+
+// ModLogEntry is an entry of the moderation log of a board
+type ModLogEntry struct {
+	XMLName xml.Name `xml:"entry" json:"-"`
+	ID      uint64   `xml:"id,attr" json:"id"`
+	Action  string   `xml:"action,attr" json:"action"`
+	PostID  uint64   `xml:"post,attr" json:"post"`
+	Moderation
+}
+
+// PostFilter selects the posts of a bulk moderation, every criteria set has to match
+type PostFilter struct {
+	Login  string    // Exact login
+	Info   string    // Substring of the info (user agent)
+	FromID uint64    // Lowest id (0 for no limit)
+	ToID   uint64    // Highest id (0 for no limit)
+	From   time.Time // Posted at or after (zero for no limit)
+	To     time.Time // Posted at or before (zero for no limit)
+}
+
+// IsEmpty tells if no criteria is set (every post would match)
+func (f PostFilter) IsEmpty() bool {
+	return len(f.Login) == 0 && len(f.Info) == 0 && f.FromID == 0 && f.ToID == 0 && f.From.IsZero() && f.To.IsZero()
+}
+
+// Match tells if a post matches the filter
+func (f PostFilter) Match(p Post) bool {
+	return (len(f.Login) == 0 || p.Login == f.Login) &&
+		(len(f.Info) == 0 || strings.Contains(p.Info, f.Info)) &&
+		p.ID >= f.FromID && (f.ToID == 0 || p.ID <= f.ToID) &&
+		(f.From.IsZero() || !p.Time.Before(f.From)) &&
+		(f.To.IsZero() || !p.Time.After(f.To))
+}
+
+// After tells if a post and the following ones are out of the filter id and time ranges
+// Posts ids are assumed to be ordered as posts times
+func (f PostFilter) After(p Post) bool {
+	return (f.ToID > 0 && p.ID > f.ToID) || (!f.To.IsZero() && p.Time.After(f.To))
+}
+
+// DeletePost turns a post into a tombstone and logs it in the moderation log
+// The message is kept so that the post can be restored, but it is removed from the search index
+// Returns the tombstone, with a 0 ID if the post does not exist
+func DeletePost(db *bolt.DB, board string, id uint64, mod Moderation) (post Post, err error) {
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if post, err = getPost(tx, board, id); err != nil || post.ID == 0 {
+			return err
+		}
+		if post.Deleted != nil {
+			return ErrPostDeleted
+		}
+		return deletePost(tx, board, &post, mod)
+	})
+	return
+}
+
+// DeleteMatchingPosts turns the posts matching a filter into tombstones in a single transaction
+// Already deleted posts are skipped. Nothing is deleted if dryRun is set
+// Returns the ids of the matching posts, oldest first
+func DeleteMatchingPosts(db *bolt.DB, board string, f PostFilter, mod Moderation, dryRun bool) (ids []uint64, err error) {
+
+	fn := func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName(backendBucketName, board))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		var k, v []byte
+		switch {
+		case f.FromID > 0:
+			k, v = c.Seek(goboardutils.IToB(f.FromID))
+		case !f.From.IsZero():
+			k, v = seekTime(c, f.From)
+		default:
+			k, v = c.First()
+		}
+
+		var posts []Post
+		for ; k != nil; k, v = c.Next() {
+			var p Post
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			if f.After(p) {
+				break
+			}
+			if p.Deleted == nil && f.Match(p) {
+				posts = append(posts, p)
+			}
+		}
+
+		// Posts are updated once the cursor is not used anymore
+		for i := range posts {
+			ids = append(ids, posts[i].ID)
+			if dryRun {
+				continue
+			}
+			if err := deletePost(tx, board, &posts[i], mod); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if dryRun {
+		err = db.View(fn)
+	} else {
+		err = db.Update(fn)
+	}
+	return
+}
+
+// deletePost turns a post into a tombstone and logs it
+func deletePost(tx *bolt.Tx, board string, post *Post, mod Moderation) error {
+	if err := unindexPost(tx, board, *post); err != nil {
+		return err
+	}
+	post.Deleted = &mod
+	if err := putPost(tx, board, *post); err != nil {
+		return err
+	}
+	return appendModLog(tx, board, ModLogEntry{Action: ModDelete, PostID: post.ID, Moderation: mod})
+}
+
+// RestorePost brings a tombstone back to life and logs it in the moderation log
+// Returns the restored post, with a 0 ID if the post does not exist
+func RestorePost(db *bolt.DB, board string, id uint64, mod Moderation) (post Post, err error) {
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if post, err = getPost(tx, board, id); err != nil || post.ID == 0 {
+			return err
+		}
+		if post.Deleted == nil {
+			return ErrPostNotDeleted
+		}
+
+		post.Deleted = nil
+		if err := putPost(tx, board, post); err != nil {
+			return err
+		}
+		if err := indexPost(tx, board, post); err != nil {
+			return err
+		}
+		return appendModLog(tx, board, ModLogEntry{Action: ModRestore, PostID: id, Moderation: mod})
+	})
+	return
+}
+
+func getPost(tx *bolt.Tx, board string, id uint64) (post Post, err error) {
+	b := tx.Bucket(bucketName(backendBucketName, board))
+	if b == nil {
+		return
+	}
+	if v := b.Get(goboardutils.IToB(id)); v != nil {
+		err = json.Unmarshal(v, &post)
+	}
+	return
+}
+
+func putPost(tx *bolt.Tx, board string, post Post) error {
+	buf, err := json.Marshal(post)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketName(backendBucketName, board)).Put(goboardutils.IToB(post.ID), buf)
+}
+
+// appendModLog adds an entry to the moderation log, its id is allocated here
+func appendModLog(tx *bolt.Tx, board string, e ModLogEntry) error {
+	mb, err := tx.CreateBucketIfNotExists(bucketName(modLogBucketName, board))
+	if err != nil {
+		return err
+	}
+
+	if e.ID, err = mb.NextSequence(); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return mb.Put(goboardutils.IToB(e.ID), buf)
+}
+
+// GetModLog returns up to limit entries of the moderation log (newest first) with ids lower than before (if not 0)
+func GetModLog(db *bolt.DB, board string, limit int, before uint64) (entries []ModLogEntry, err error) {
+
+	err = db.View(func(tx *bolt.Tx) error {
+		mb := tx.Bucket(bucketName(modLogBucketName, board))
+		if mb == nil {
+			return nil
+		}
+
+		c := mb.Cursor()
+		var k, v []byte
+		if before > 0 {
+			if k, _ = c.Seek(goboardutils.IToB(before)); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		} else {
+			k, v = c.Last()
+		}
+
+		for ; k != nil && len(entries) < limit; k, v = c.Prev() {
+			var e ModLogEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return
+}
+
+// ForEachModLogEntry calls fn for every entry of the moderation log of a board, oldest first
+func ForEachModLogEntry(db *bolt.DB, board string, fn func(ModLogEntry) error) error {
+
+	return db.View(func(tx *bolt.Tx) error {
+		mb := tx.Bucket(bucketName(modLogBucketName, board))
+		if mb == nil {
+			return nil
+		}
+
+		return mb.ForEach(func(k, v []byte) error {
+			var e ModLogEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			return fn(e)
+		})
+	})
+}
+
+// ImportModLogEntry stores a moderation log entry keeping its id
+func ImportModLogEntry(db *bolt.DB, board string, e ModLogEntry) error {
+
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		mb, err := tx.CreateBucketIfNotExists(bucketName(modLogBucketName, board))
+		if err != nil {
+			return err
+		}
+		if e.ID > mb.Sequence() {
+			if err := mb.SetSequence(e.ID); err != nil {
+				return err
+			}
+		}
+		return mb.Put(goboardutils.IToB(e.ID), buf)
+	})
+}
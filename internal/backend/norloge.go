@@ -0,0 +1,161 @@
+package backend
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/******************************************************************
+ *             Norloges (references to previous posts)
+ ******************************************************************/
+
+// Norloge represents a reference to a previous post by its time
+// (12:34, 12:34:56, 01/02#12:34:56, 2024/01/02#12:34:56¹, 12:34:56^4, 12:34:56@board)
+type Norloge struct {
+	Year       int // 0 if not specified
+	Month      int // 0 if no date is specified
+	Day        int
+	Hour       int
+	Minute     int
+	Second     int
+	HasSeconds bool
+	Index      int    // 0 if not specified, 1 for first post of that time, ...
+	Board      string // Empty for local references
+}
+
+// Same syntax as norlogify in webui
+var norlogeReg = regexp.MustCompile(
+	`(?:(?:([0-9]+)/)?(1[0-2]|0[1-9])/(3[0-1]|[1-2][0-9]|0[1-9])#)?` + // (?:y+/)?(?:(?:mm)/(?:dd))#
+		`(2[0-3]|[0-1][0-9]):([0-5][0-9])(?::([0-5][0-9]))?` + // (?:hh):(?:mm)(?::ss)?
+		`([¹²³]|[:\^][1-9][0-9]?)?` + // (?:¹²³|[:^]i|[:^]ii)?
+		`(?:@([A-Za-z0-9_]+))?`) // (?:@bouchot)?
+
+// Links and tags are not searched for norloges
+var norlogeLinkReg = regexp.MustCompile(`(?is)<a[\s>].*?</a\s*>`)
+var norlogeTagReg = regexp.MustCompile(`<[^>]*>`)
+
+var norlogeIndexes = map[string]int{"¹": 1, "²": 2, "³": 3}
+
+// ParseNorloges extracts norloges from a (sanitized) message
+func ParseNorloges(message string) (norloges []Norloge) {
+	text := norlogeLinkReg.ReplaceAllString(message, " ")
+	text = norlogeTagReg.ReplaceAllString(text, " ")
+
+	for _, m := range norlogeReg.FindAllStringSubmatch(text, -1) {
+		n := Norloge{Board: m[8]}
+
+		n.Year, _ = strconv.Atoi(m[1])
+		if n.Year > 0 && n.Year < 100 {
+			n.Year += 2000
+		}
+		n.Month, _ = strconv.Atoi(m[2])
+		n.Day, _ = strconv.Atoi(m[3])
+		n.Hour, _ = strconv.Atoi(m[4])
+		n.Minute, _ = strconv.Atoi(m[5])
+		if len(m[6]) > 0 {
+			n.HasSeconds = true
+			n.Second, _ = strconv.Atoi(m[6])
+		}
+		if i, ok := norlogeIndexes[m[7]]; ok {
+			n.Index = i
+		} else if len(m[7]) > 1 {
+			n.Index, _ = strconv.Atoi(m[7][1:])
+		}
+
+		norloges = append(norloges, n)
+	}
+	return
+}
+
+// timeRange returns the time span referenced by a norloge posted at ref
+func (n Norloge) timeRange(ref time.Time, loc *time.Location) (start time.Time, end time.Time) {
+	ref = ref.In(loc)
+
+	year, month, day := ref.Date()
+	if n.Month > 0 {
+		month, day = time.Month(n.Month), n.Day
+		if n.Year > 0 {
+			year = n.Year
+		}
+	}
+
+	start = time.Date(year, month, day, n.Hour, n.Minute, n.Second, 0, loc)
+
+	if start.After(ref) {
+		// Most recent past occurrence
+		switch {
+		case n.Month == 0:
+			start = start.AddDate(0, 0, -1)
+		case n.Year == 0:
+			start = start.AddDate(-1, 0, 0)
+		}
+	}
+
+	if n.HasSeconds {
+		end = start.Add(time.Second)
+	} else {
+		end = start.Add(time.Minute)
+	}
+	return
+}
+
+// PostsInRange returns the ids of the posts made between start (included) and end (excluded), oldest first
+type PostsInRange func(start time.Time, end time.Time) ([]uint64, error)
+
+// ResolveNorloges returns the ids of the posts referenced by norloges of a post made at ref
+func ResolveNorloges(norloges []Norloge, ref time.Time, loc *time.Location, find PostsInRange) (ids []uint64, err error) {
+	if loc == nil {
+		loc = time.Local
+	}
+
+	seen := map[uint64]bool{}
+
+	for _, n := range norloges {
+		if len(n.Board) > 0 {
+			// Reference to another board
+			continue
+		}
+
+		var matches []uint64
+		if matches, err = find(n.timeRange(ref, loc)); err != nil {
+			return
+		}
+
+		if n.Index > 0 {
+			if n.Index > len(matches) {
+				continue
+			}
+			matches = matches[n.Index-1 : n.Index]
+		}
+
+		for _, id := range matches {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return
+}
+
+// bucketPostsInRange finds posts in range in a backend bucket
+func bucketPostsInRange(b *bolt.Bucket) PostsInRange {
+	return func(start time.Time, end time.Time) (ids []uint64, err error) {
+		c := b.Cursor()
+		for k, v := seekTime(c, start); k != nil; k, v = c.Next() {
+			var p Post
+			if err = json.Unmarshal(v, &p); err != nil {
+				return
+			}
+			if !p.Time.Before(end) {
+				break
+			}
+			ids = append(ids, p.ID)
+		}
+		return
+	}
+}
@@ -0,0 +1,62 @@
+package backend
+
+import (
+	"context"
+	"sync"
+)
+
+// postNotifier wakes up waiters when a new post is stored
+type postNotifier struct {
+	lastID uint64
+	wake   chan struct{} // Closed and replaced on each new post
+}
+
+// Notifiers by board
+var notifiersMu sync.Mutex
+var notifiers = map[string]*postNotifier{}
+
+// notifierFor must be called with notifiersMu held
+func notifierFor(board string) *postNotifier {
+	n, ok := notifiers[board]
+	if !ok {
+		n = &postNotifier{wake: make(chan struct{})}
+		notifiers[board] = n
+	}
+	return n
+}
+
+// NotifyPost records a new post id of a board and wakes up all its waiters
+// It must be called by every storage once a post is stored
+func NotifyPost(board string, id uint64) {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+
+	n := notifierFor(board)
+	if id > n.lastID {
+		n.lastID = id
+	}
+	close(n.wake)
+	n.wake = make(chan struct{})
+}
+
+// WaitForPost blocks until a post with an id greater than last has been stored
+// on a board or ctx is done. It returns the id of the last post stored and true if such a post exists.
+// Only posts stored by this process are taken into account
+func WaitForPost(ctx context.Context, board string, last uint64) (uint64, bool) {
+	for {
+		notifiersMu.Lock()
+		n := notifierFor(board)
+		lastID, wake := n.lastID, n.wake
+		notifiersMu.Unlock()
+
+		if lastID > last {
+			return lastID, true
+		}
+
+		select {
+		case <-ctx.Done():
+			return lastID, false
+		case <-wake:
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"time"
+
+	goboardutils "github.com/dguihal/goboard/internal/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+/******************************************************************
+ *             Post edition
+ ******************************************************************/
+
+// Previous versions of edited posts: keys are a post id followed by a revision number
+const revisionsBucketName string = "Revisions"
+
+// PostRevision is a previous version of an edited post
+type PostRevision struct {
+	XMLName    xml.Name `xml:"revision" json:"-"`
+	Number     uint64   `xml:"number,attr" json:"number"` // 1 for the original message
+	Time       PostTime `xml:"time,attr" json:"time"`     // Time this version was posted
+	Message    string   `xml:"message" json:"message"`
+	RawMessage string   `xml:"rawmessage" json:"rawmessage"`
+}
+
+// PostHistory is a post along with its previous versions
+type PostHistory struct {
+	XMLName   xml.Name       `xml:"history" json:"-"`
+	Post      Post           `xml:"post" json:"post"`
+	Revisions []PostRevision `xml:"revisions>revision" json:"revisions"`
+}
+
+// LocalizeRevisions sets revisions times in a board location before formatting them
+func LocalizeRevisions(revs []PostRevision, loc *time.Location) {
+	for i := range revs {
+		revs[i].Time.Time = revs[i].Time.In(loc)
+	}
+}
+
+// Revision returns the current version of a post as a revision numbered n
+func (p Post) Revision(n uint64) PostRevision {
+	rev := PostRevision{Number: n, Time: p.Time, Message: p.Message, RawMessage: p.RawMessage}
+	if p.Edited != nil {
+		rev.Time = *p.Edited
+	}
+	return rev
+}
+
+// Edit replaces the message of a post, marking it edited at editTime
+// Norloges of the new message are resolved in loc, relative to the post time
+// The previous message has to be saved as a revision before
+func (p *Post) Edit(message string, rawMessage string, editTime time.Time, loc *time.Location, find PostsInRange) (err error) {
+	p.Message = message
+	p.RawMessage = rawMessage
+	p.Edited = &PostTime{editTime}
+
+	p.Refs = nil
+	if norloges := ParseNorloges(message); len(norloges) > 0 {
+		var refs []uint64
+		if refs, err = ResolveNorloges(norloges, p.Time.Time, loc, find); err != nil {
+			return
+		}
+		// Like when it was posted, a post can only reference older posts
+		for _, ref := range refs {
+			if ref < p.ID {
+				p.Refs = append(p.Refs, ref)
+			}
+		}
+	}
+	return
+}
+
+func revisionKey(id uint64, n uint64) []byte {
+	return append(goboardutils.IToB(id), goboardutils.IToB(n)...)
+}
+
+// EditPost replaces the message of a post, keeping its previous version as a revision
+// Returns the updated post, with a 0 ID if it does not exist
+func EditPost(db *bolt.DB, board string, id uint64, message string, rawMessage string, editTime time.Time, loc *time.Location) (post Post, err error) {
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName(backendBucketName, board))
+		if b == nil {
+			return nil
+		}
+
+		key := goboardutils.IToB(id)
+		v := b.Get(key)
+		if v == nil {
+			return nil
+		}
+
+		var old Post
+		if err := json.Unmarshal(v, &old); err != nil {
+			return err
+		}
+		if old.Deleted != nil {
+			return ErrPostDeleted
+		}
+
+		rb, err := tx.CreateBucketIfNotExists(bucketName(revisionsBucketName, board))
+		if err != nil {
+			return err
+		}
+
+		// Revisions are numbered from 1
+		n := uint64(1)
+		c := rb.Cursor()
+		for k, _ := c.Seek(key); k != nil && bytes.HasPrefix(k, key); k, _ = c.Next() {
+			n++
+		}
+
+		buf, err := json.Marshal(old.Revision(n))
+		if err != nil {
+			return err
+		}
+		if err := rb.Put(revisionKey(id, n), buf); err != nil {
+			return err
+		}
+
+		// Indexes are updated with the new message
+		if err := deleteReplies(tx, board, old); err != nil {
+			return err
+		}
+		if err := unindexPost(tx, board, old); err != nil {
+			return err
+		}
+
+		post = old
+		if err := post.Edit(message, rawMessage, editTime, loc, bucketPostsInRange(b)); err != nil {
+			return err
+		}
+
+		if buf, err = json.Marshal(post); err != nil {
+			return err
+		}
+		if err := b.Put(key, buf); err != nil {
+			return err
+		}
+		if err := indexPost(tx, board, post); err != nil {
+			return err
+		}
+		return putReplies(tx, board, post)
+	})
+	return
+}
+
+// GetRevisions returns the previous versions of a post, oldest first
+func GetRevisions(db *bolt.DB, board string, id uint64) (revs []PostRevision, err error) {
+
+	err = db.View(func(tx *bolt.Tx) error {
+		rb := tx.Bucket(bucketName(revisionsBucketName, board))
+		if rb == nil {
+			return nil
+		}
+
+		prefix := goboardutils.IToB(id)
+		c := rb.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var rev PostRevision
+			if err := json.Unmarshal(v, &rev); err != nil {
+				return err
+			}
+			revs = append(revs, rev)
+		}
+		return nil
+	})
+	return
+}
+
+// deleteRevisions removes the revisions of a post
+func deleteRevisions(tx *bolt.Tx, board string, id uint64) error {
+	rb := tx.Bucket(bucketName(revisionsBucketName, board))
+	if rb == nil {
+		return nil
+	}
+
+	prefix := goboardutils.IToB(id)
+	c := rb.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachRevision calls fn for every revision of a board, ordered by post
+func ForEachRevision(db *bolt.DB, board string, fn func(id uint64, rev PostRevision) error) error {
+
+	return db.View(func(tx *bolt.Tx) error {
+		rb := tx.Bucket(bucketName(revisionsBucketName, board))
+		if rb == nil {
+			return nil
+		}
+
+		return rb.ForEach(func(k, v []byte) error {
+			var rev PostRevision
+			if err := json.Unmarshal(v, &rev); err != nil {
+				return err
+			}
+			return fn(goboardutils.BToI(k[:8]), rev)
+		})
+	})
+}
+
+// ImportRevision stores a revision of a post as is
+func ImportRevision(db *bolt.DB, board string, id uint64, rev PostRevision) error {
+
+	buf, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		rb, err := tx.CreateBucketIfNotExists(bucketName(revisionsBucketName, board))
+		if err != nil {
+			return err
+		}
+		return rb.Put(revisionKey(id, rev.Number), buf)
+	})
+}
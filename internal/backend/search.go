@@ -0,0 +1,274 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"strings"
+	"time"
+	"unicode"
+
+	goboardutils "github.com/dguihal/goboard/internal/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+/******************************************************************
+ *             Full text search
+ ******************************************************************/
+
+// Inverted index: keys are a term, a 0 byte and a post id
+const searchBucketName string = "SearchIndex"
+
+// Terms shorter or longer than these limits are not indexed
+const (
+	searchTermMinLen = 2
+	searchTermMaxLen = 64
+)
+
+// Number of posts indexed per transaction when rebuilding the index
+const searchRebuildBatchSize = 1000
+
+// SearchQuery represents the criterias of a search in the history
+type SearchQuery struct {
+	Text  string    // Every term of the text must be found in the message
+	Login string    // Empty for any login
+	From  time.Time // Zero for no lower bound
+	To    time.Time // Zero for no upper bound
+}
+
+// SearchTerms returns the (lowercased, unique) terms of a message or a query
+func SearchTerms(message string) (terms []string) {
+	text := norlogeLinkReg.ReplaceAllString(message, " ")
+	text = norlogeTagReg.ReplaceAllString(text, " ")
+	text = strings.ToLower(html.UnescapeString(text))
+
+	seen := map[string]bool{}
+	for _, t := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if l := len([]rune(t)); l < searchTermMinLen || l > searchTermMaxLen || seen[t] {
+			continue
+		}
+		seen[t] = true
+		terms = append(terms, t)
+	}
+	return
+}
+
+func searchKey(term string, id uint64) []byte {
+	return append(postingsPrefix(term), goboardutils.IToB(id)...)
+}
+
+// indexPost adds a post to the search index (tombstones are not indexed)
+func indexPost(tx *bolt.Tx, board string, p Post) error {
+	terms := SearchTerms(p.Message)
+	if len(terms) == 0 || p.Deleted != nil {
+		return nil
+	}
+
+	sb, err := tx.CreateBucketIfNotExists(bucketName(searchBucketName, board))
+	if err != nil {
+		return err
+	}
+
+	for _, t := range terms {
+		if err := sb.Put(searchKey(t, p.ID), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexPost removes a post from the search index
+func unindexPost(tx *bolt.Tx, board string, p Post) error {
+	sb := tx.Bucket(bucketName(searchBucketName, board))
+	if sb == nil {
+		return nil
+	}
+
+	for _, t := range SearchTerms(p.Message) {
+		if err := sb.Delete(searchKey(t, p.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rarestTerm returns the term of the query with the fewest postings
+// The postings of every term are walked together, so that the walk stops at the end of the rarest one
+// instead of going through the postings of the common terms
+func rarestTerm(sb *bolt.Bucket, terms []string) string {
+	if len(terms) == 1 {
+		return terms[0]
+	}
+
+	cursors := make([]*bolt.Cursor, len(terms))
+	keys := make([][]byte, len(terms))
+	for i, t := range terms {
+		cursors[i] = sb.Cursor()
+		keys[i], _ = cursors[i].Seek(postingsPrefix(t))
+	}
+
+	for {
+		for i, t := range terms {
+			if !isPosting(keys[i], t) {
+				return t
+			}
+			keys[i], _ = cursors[i].Next()
+		}
+	}
+}
+
+func postingsPrefix(term string) []byte {
+	return append([]byte(term), 0)
+}
+
+// isPosting tells if k is a key of the postings of term
+func isPosting(k []byte, term string) bool {
+	return len(k) == len(term)+9 && bytes.HasPrefix(k, postingsPrefix(term))
+}
+
+// lastPosting moves c to the newest posting of term and returns its key (not a posting of term if there is none)
+func lastPosting(c *bolt.Cursor, term string) []byte {
+	// Every posting key of term sorts before term followed by a 1 byte
+	if k, _ := c.Seek(append([]byte(term), 1)); k != nil {
+		k, _ = c.Prev()
+		return k
+	}
+	k, _ := c.Last()
+	return k
+}
+
+// searchHeader holds the fields of a post checked by the filters of a query, decoded before the whole post
+type searchHeader struct {
+	Login string   `json:"login"`
+	Time  PostTime `json:"time"`
+}
+
+// Search returns up to limit posts matching a query, newest first
+func Search(db *bolt.DB, board string, q SearchQuery, limit int) (posts []Post, err error) {
+
+	terms := SearchTerms(q.Text)
+	if len(terms) == 0 || limit <= 0 {
+		return
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+
+		sb := tx.Bucket(bucketName(searchBucketName, board))
+		b := tx.Bucket(bucketName(backendBucketName, board))
+		if sb == nil || b == nil {
+			return nil
+		}
+
+		// Walk back through the postings of the rarest term, check the others directly
+		rarest := rarestTerm(sb, terms)
+		c := sb.Cursor()
+		for k := lastPosting(c, rarest); isPosting(k, rarest) && len(posts) < limit; k, _ = c.Prev() {
+			id := goboardutils.BToI(k[len(rarest)+1:])
+
+			found := true
+			for _, t := range terms {
+				if t != rarest && sb.Get(searchKey(t, id)) == nil {
+					found = false
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+
+			v := b.Get(goboardutils.IToB(id))
+			if v == nil {
+				continue
+			}
+
+			var h searchHeader
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+			// Ids follow post times: older posts are all before From
+			if !q.From.IsZero() && h.Time.Before(q.From) {
+				break
+			}
+			if len(q.Login) > 0 && h.Login != q.Login {
+				continue
+			}
+			if !q.To.IsZero() && h.Time.After(q.To) {
+				continue
+			}
+
+			var p Post
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			posts = append(posts, p)
+		}
+
+		return nil
+	})
+	return
+}
+
+// RebuildSearchIndex drops the search index of a board and indexes its whole history again
+func RebuildSearchIndex(db *bolt.DB, board string) (count int, err error) {
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketName(searchBucketName, board)) != nil {
+			if err := tx.DeleteBucket(bucketName(searchBucketName, board)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// Index by batches to keep transactions small on large histories
+	var next []byte
+	for done := false; !done; {
+		err = db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(bucketName(backendBucketName, board))
+			if b == nil {
+				done = true
+				return nil
+			}
+
+			c := b.Cursor()
+			k, v := c.First()
+			if next != nil {
+				k, v = c.Seek(next)
+			}
+
+			for n := 0; n < searchRebuildBatchSize; n++ {
+				if k == nil {
+					done = true
+					return nil
+				}
+
+				var p Post
+				if err := json.Unmarshal(v, &p); err != nil {
+					return err
+				}
+				if err := indexPost(tx, board, p); err != nil {
+					return err
+				}
+				count++
+
+				k, v = c.Next()
+			}
+
+			if k == nil {
+				done = true
+			} else {
+				next = append([]byte{}, k...)
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
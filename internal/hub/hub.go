@@ -0,0 +1,125 @@
+// Package hub provides an in-process publish/subscribe hub for board events
+package hub
+
+import (
+	"sync"
+
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+)
+
+// A list of event types published on the hub
+const (
+	PostEvent    = "post"
+	DeleteEvent  = "delete"
+	EditEvent    = "edit"
+	RestoreEvent = "restore"
+)
+
+// DefaultBufferSize is the number of pending events a subscriber can hold
+// before being considered as a slow consumer
+const DefaultBufferSize = 64
+
+// Event represents something that happened on the board
+type Event struct {
+	Type  string
+	Board string              // Name of the board
+	ID    uint64              // 0 for DeleteEvent of several posts
+	Post  goboardbackend.Post // Only set for PostEvent, EditEvent and RestoreEvent
+	IDs   []uint64            // Only set for DeleteEvent: every deleted post, so that bulk deletions are a single event
+}
+
+// Deletion returns the DeleteEvent of posts of a board
+func Deletion(board string, ids []uint64) Event {
+	e := Event{Type: DeleteEvent, Board: board, IDs: ids}
+	if len(ids) == 1 {
+		e.ID = ids[0]
+	}
+	return e
+}
+
+// Subscription is a registered listener of the hub
+// C is closed when the subscription ends (unsubscribed, too slow or hub closed)
+type Subscription struct {
+	C <-chan Event
+
+	c chan Event
+}
+
+// Hub dispatches published events to all its subscribers
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// New creates an empty Hub
+func New() *Hub {
+	return &Hub{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe registers a new listener with a buffer of bufSize events
+func (h *Hub) Subscribe(bufSize int) *Subscription {
+	if bufSize <= 0 {
+		bufSize = DefaultBufferSize
+	}
+
+	c := make(chan Event, bufSize)
+	s := &Subscription{C: c, c: c}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(c)
+		return s
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+// Unsubscribe removes a listener from the hub and closes its channel
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.drop(s)
+}
+
+// Publish sends an event to every subscriber without blocking
+// Subscribers whose buffer is full are dropped
+func (h *Hub) Publish(e Event) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subs {
+		select {
+		case s.c <- e:
+		default:
+			// Slow consumer
+			h.drop(s)
+		}
+	}
+}
+
+// Close ends all subscriptions, further subscriptions are closed immediately
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subs {
+		h.drop(s)
+	}
+	h.closed = true
+}
+
+// drop must be called with h.mu held
+func (h *Hub) drop(s *Subscription) {
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.c)
+	}
+}
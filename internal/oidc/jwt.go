@@ -0,0 +1,314 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tolerated difference between the clocks of the provider and the server
+const clockSkew = time.Minute
+
+// Minimum delay between two fetches of the provider keys caused by unknown key ids
+const keysRefreshInterval = time.Minute
+
+// Supported signature algorithms of ID tokens ("none" and shared secrets are not)
+type algorithm struct {
+	hash crypto.Hash
+	kty  string
+	crv  string // Curve of EC keys
+	pss  bool
+}
+
+var algorithms = map[string]algorithm{
+	"RS256": {hash: crypto.SHA256, kty: "RSA"},
+	"RS384": {hash: crypto.SHA384, kty: "RSA"},
+	"RS512": {hash: crypto.SHA512, kty: "RSA"},
+	"PS256": {hash: crypto.SHA256, kty: "RSA", pss: true},
+	"PS384": {hash: crypto.SHA384, kty: "RSA", pss: true},
+	"PS512": {hash: crypto.SHA512, kty: "RSA", pss: true},
+	"ES256": {hash: crypto.SHA256, kty: "EC", crv: "P-256"},
+	"ES384": {hash: crypto.SHA384, kty: "EC", crv: "P-384"},
+	"ES512": {hash: crypto.SHA512, kty: "EC", crv: "P-521"},
+}
+
+// keySet holds the public keys of the provider
+type keySet struct {
+	mu      sync.Mutex
+	keys    []jwk
+	fetched time.Time
+}
+
+// jwk is a JSON Web Key, only public keys are used
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	key crypto.PublicKey
+}
+
+// audience is the aud claim, a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks the signature and the claims of an ID token
+func (c *Client) verify(ctx context.Context, m *Metadata, raw string, nonce string) (IDToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return IDToken{}, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return IDToken{}, err
+	}
+	alg, ok := algorithms[header.Alg]
+	if !ok {
+		return IDToken{}, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return IDToken{}, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+
+	key, err := c.key(ctx, m, header.Kid, header.Alg)
+	if err != nil {
+		return IDToken{}, err
+	}
+	h := alg.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if !checkSignature(key, alg.hash, alg.pss, h.Sum(nil), sig) {
+		return IDToken{}, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var claims struct {
+		Issuer   string   `json:"iss"`
+		Subject  string   `json:"sub"`
+		Audience audience `json:"aud"`
+		Azp      string   `json:"azp"`
+		Expiry   float64  `json:"exp"`
+		IssuedAt float64  `json:"iat"`
+		Nonce    string   `json:"nonce"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return IDToken{}, err
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != m.Issuer:
+		return IDToken{}, fmt.Errorf("%w: wrong issuer %q", ErrInvalidToken, claims.Issuer)
+	case len(claims.Subject) == 0:
+		return IDToken{}, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	case !claims.Audience.contains(c.config.ClientID):
+		return IDToken{}, fmt.Errorf("%w: not issued for this client", ErrInvalidToken)
+	case len(claims.Audience) > 1 && claims.Azp != c.config.ClientID:
+		return IDToken{}, fmt.Errorf("%w: not authorized for this client", ErrInvalidToken)
+	case !now.Before(time.Unix(int64(claims.Expiry), 0).Add(clockSkew)):
+		return IDToken{}, fmt.Errorf("%w: expired", ErrInvalidToken)
+	case time.Unix(int64(claims.IssuedAt), 0).After(now.Add(clockSkew)):
+		return IDToken{}, fmt.Errorf("%w: issued in the future", ErrInvalidToken)
+	case claims.Nonce != nonce:
+		return IDToken{}, fmt.Errorf("%w: wrong nonce", ErrInvalidToken)
+	}
+
+	t := IDToken{Subject: claims.Subject}
+	if err := decodeSegment(parts[1], &t.Claims); err != nil {
+		return IDToken{}, err
+	}
+	return t, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON part of a token into v
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: malformed token: %v", ErrInvalidToken, err)
+	}
+	return nil
+}
+
+// checkSignature verifies the signature of a digest, ECDSA signatures being the concatenation of r and s
+func checkSignature(key crypto.PublicKey, hash crypto.Hash, pss bool, digest []byte, sig []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if pss {
+			return rsa.VerifyPSS(k, hash, digest, sig, nil) == nil
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		// r and s have the size of the curve each
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+// key returns the signing key kid of the provider for alg (the only key usable for alg if kid is empty)
+// Keys are fetched again when kid is unknown, as the provider may have rotated them
+func (c *Client) key(ctx context.Context, m *Metadata, kid string, alg string) (crypto.PublicKey, error) {
+	c.keys.mu.Lock()
+	defer c.keys.mu.Unlock()
+
+	if key := c.keys.find(kid, alg); key != nil {
+		return key, nil
+	}
+	if time.Since(c.keys.fetched) < keysRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := c.do(req, &set); err != nil {
+		return nil, err
+	}
+
+	c.keys.keys = c.keys.keys[:0]
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		if k.key, err = k.publicKey(); err != nil {
+			// Keys of unsupported types are skipped
+			continue
+		}
+		c.keys.keys = append(c.keys.keys, k)
+	}
+	c.keys.fetched = time.Now()
+
+	if key := c.keys.find(kid, alg); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+}
+
+// find returns the key kid usable for alg, or the only one if kid is empty, nil if none
+func (s *keySet) find(kid string, alg string) crypto.PublicKey {
+	var found crypto.PublicKey
+	for _, k := range s.keys {
+		if !k.usableFor(alg) {
+			continue
+		}
+		if len(kid) > 0 && k.Kid == kid {
+			return k.key
+		}
+		if len(kid) == 0 {
+			if found != nil {
+				return nil
+			}
+			found = k.key
+		}
+	}
+	return found
+}
+
+// usableFor tells if the key can verify signatures of algorithm alg
+func (k jwk) usableFor(alg string) bool {
+	a := algorithms[alg]
+	if k.Kty != a.kty || (len(k.Alg) > 0 && k.Alg != alg) {
+		return false
+	}
+	return k.Kty != "EC" || k.Crv == a.crv
+}
+
+// publicKey builds the public key of a JSON Web Key
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		var ec ecdh.Curve
+		switch k.Crv {
+		case "P-256":
+			curve, ec = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, ec = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, ec = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, fmt.Errorf("invalid EC key")
+		}
+		// Rejects points not on the curve
+		if _, err := ec.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
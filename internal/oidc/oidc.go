@@ -0,0 +1,257 @@
+// Package oidc implements the relying party side of the OpenID Connect authorization code flow
+// (with PKCE), verifying ID tokens with the keys published by the provider
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Path of the provider metadata, relative to the issuer URL
+const discoveryPath = "/.well-known/openid-configuration"
+
+// Maximum size of the responses of the provider
+const maxResponseSize = 1 << 20
+
+// Errors returned by the login flow
+var (
+	// ErrInvalidToken reports an ID token which could not be verified
+	ErrInvalidToken = errors.New("invalid ID token")
+	// ErrProvider reports a provider which could not be reached or answered an error
+	ErrProvider = errors.New("identity provider error")
+)
+
+// Config identifies the client at the provider
+type Config struct {
+	Issuer       string // URL of the provider, its metadata are discovered from it
+	ClientID     string
+	ClientSecret string   // Empty for public clients
+	RedirectURL  string   // URL the provider sends the user back to, with the authorization code
+	Scopes       []string // Requested in addition to "openid"
+}
+
+// Metadata is the part of the provider metadata used by the client
+type Metadata struct {
+	Issuer                   string   `json:"issuer"`
+	AuthorizationEndpoint    string   `json:"authorization_endpoint"`
+	TokenEndpoint            string   `json:"token_endpoint"`
+	UserinfoEndpoint         string   `json:"userinfo_endpoint"`
+	JWKSURI                  string   `json:"jwks_uri"`
+	TokenEndpointAuthMethods []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// Tokens is the response of the token endpoint
+type Tokens struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+}
+
+// IDToken holds the claims of a verified ID token
+type IDToken struct {
+	Subject string
+	Claims  map[string]any
+}
+
+// StringClaim returns a claim of the token, empty if it is missing or not a string
+func (t IDToken) StringClaim(name string) string {
+	s, _ := t.Claims[name].(string)
+	return s
+}
+
+// Client is an OpenID Connect relying party
+// The provider metadata are discovered on first use, until discovery succeeds
+type Client struct {
+	config Config
+	http   *http.Client
+
+	mu       sync.Mutex
+	metadata *Metadata
+	keys     keySet
+}
+
+// NewClient creates a client, httpClient is used to reach the provider
+func NewClient(config Config, httpClient *http.Client) *Client {
+	return &Client{config: config, http: httpClient}
+}
+
+// AuthCodeURL returns the URL of the provider to send the user to
+// state and nonce are checked on return, verifier is the PKCE code verifier (43 to 128 characters)
+func (c *Client) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	m, err := c.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.config.ClientID},
+		"redirect_uri":          {c.config.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, c.config.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return m.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// Exchange trades an authorization code for tokens and returns the verified ID token
+func (c *Client) Exchange(ctx context.Context, code string, verifier string, nonce string) (IDToken, Tokens, error) {
+	m, err := c.discover(ctx)
+	if err != nil {
+		return IDToken{}, Tokens{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	basic := len(c.config.ClientSecret) > 0 && c.secretBasic(m)
+	if !basic {
+		form.Set("client_id", c.config.ClientID)
+		if len(c.config.ClientSecret) > 0 {
+			form.Set("client_secret", c.config.ClientSecret)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return IDToken{}, Tokens{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basic {
+		// Credentials are form encoded first (RFC 6749 section 2.3.1)
+		req.SetBasicAuth(url.QueryEscape(c.config.ClientID), url.QueryEscape(c.config.ClientSecret))
+	}
+
+	var tokens Tokens
+	if err := c.do(req, &tokens); err != nil {
+		return IDToken{}, Tokens{}, err
+	}
+	if len(tokens.IDToken) == 0 {
+		return IDToken{}, Tokens{}, fmt.Errorf("%w: no ID token in token response", ErrProvider)
+	}
+
+	t, err := c.verify(ctx, m, tokens.IDToken, nonce)
+	if err != nil {
+		return IDToken{}, Tokens{}, err
+	}
+	return t, tokens, nil
+}
+
+// UserInfo returns the claims of the userinfo endpoint, which must be about subject
+func (c *Client) UserInfo(ctx context.Context, accessToken string, subject string) (map[string]any, error) {
+	m, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.UserinfoEndpoint) == 0 {
+		return nil, fmt.Errorf("%w: no userinfo endpoint", ErrProvider)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	var claims map[string]any
+	if err := c.do(req, &claims); err != nil {
+		return nil, err
+	}
+	if sub, _ := claims["sub"].(string); sub != subject {
+		return nil, fmt.Errorf("%w: userinfo subject does not match the ID token", ErrProvider)
+	}
+	return claims, nil
+}
+
+// secretBasic tells if the client secret is sent with HTTP Basic, the default method, rather than in the form
+func (c *Client) secretBasic(m *Metadata) bool {
+	if len(m.TokenEndpointAuthMethods) == 0 {
+		return true
+	}
+	for _, method := range m.TokenEndpointAuthMethods {
+		if method == "client_secret_basic" {
+			return true
+		}
+	}
+	return false
+}
+
+// discover fetches the provider metadata once
+func (c *Client) discover(ctx context.Context) (*Metadata, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.metadata != nil {
+		return c.metadata, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(c.config.Issuer, "/")+discoveryPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	var m Metadata
+	if err := c.do(req, &m); err != nil {
+		return nil, err
+	}
+
+	if m.Issuer != c.config.Issuer {
+		return nil, fmt.Errorf("%w: issuer %q of the metadata is not %q", ErrProvider, m.Issuer, c.config.Issuer)
+	}
+	if len(m.AuthorizationEndpoint) == 0 || len(m.TokenEndpoint) == 0 || len(m.JWKSURI) == 0 {
+		return nil, fmt.Errorf("%w: incomplete provider metadata", ErrProvider)
+	}
+
+	c.metadata = &m
+	return c.metadata, nil
+}
+
+// do sends a request to the provider and decodes its JSON response into v
+func (c *Client) do(req *http.Request, v any) error {
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProvider, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProvider, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if json.Unmarshal(body, &e) == nil && len(e.Error) > 0 {
+			return fmt.Errorf("%w: %s answered %s: %s %s", ErrProvider, req.URL.Path, resp.Status, e.Error, e.Description)
+		}
+		return fmt.Errorf("%w: %s answered %s", ErrProvider, req.URL.Path, resp.Status)
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%w: invalid response of %s: %v", ErrProvider, req.URL.Path, err)
+	}
+	return nil
+}
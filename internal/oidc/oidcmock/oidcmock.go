@@ -0,0 +1,287 @@
+// Package oidcmock is a minimal OpenID Connect provider, to try and test the OIDC login of goboard
+// Every authorization request is granted without asking anything: the user is the login_hint
+// parameter of the request, or DefaultUser. The login_hint "deny" makes the provider refuse the login
+package oidcmock
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+// Lifetime of authorization codes and tokens
+const lifetime = 5 * time.Minute
+
+const keyID = "mock"
+
+// Provider grants every login of its client
+// Its settings must not be changed once it serves requests
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // Empty for a public client
+	DefaultUser  string // Login of the users without login_hint
+	UserinfoOnly bool   // The username is given in the userinfo response only, not in the ID token
+	// Claims, if set, may change the claims of every ID token before it is signed
+	Claims func(claims map[string]any)
+
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	codes  map[string]grant
+	tokens map[string]string // Users by access token
+}
+
+// grant is an authorization code waiting to be exchanged
+type grant struct {
+	user        string
+	nonce       string
+	redirectURI string
+	challenge   string
+	expires     time.Time
+}
+
+// New creates a provider signing its tokens with a new key
+func New(issuer string, clientID string, clientSecret string) (*Provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &Provider{
+		Issuer:       issuer,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		DefaultUser:  "alice",
+		key:          key,
+		codes:        map[string]grant{},
+		tokens:       map[string]string{},
+	}, nil
+}
+
+// Handler returns the endpoints of the provider, served at the root of the issuer URL
+func (p *Provider) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.metadata)
+	mux.HandleFunc("GET /jwks", p.jwks)
+	mux.HandleFunc("GET /authorize", p.authorize)
+	mux.HandleFunc("POST /token", p.token)
+	mux.HandleFunc("GET /userinfo", p.userinfo)
+	return mux
+}
+
+// Subject returns the subject of a user at the provider
+func Subject(user string) string {
+	return "mock-" + user
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+func oauthError(w http.ResponseWriter, status int, code string, description string) {
+	log.Printf("%s: %s", code, description)
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+func (p *Provider) metadata(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                p.Issuer,
+		"authorization_endpoint":                p.Issuer + "/authorize",
+		"token_endpoint":                        p.Issuer + "/token",
+		"userinfo_endpoint":                     p.Issuer + "/userinfo",
+		"jwks_uri":                              p.Issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": keyID,
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}})
+}
+
+// authorize grants every request, sending the user back to the client with a code
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	redirectURI := q.Get("redirect_uri")
+	back, err := url.Parse(redirectURI)
+	if err != nil || !back.IsAbs() || q.Get("client_id") != p.ClientID {
+		http.Error(w, "Unknown client or invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	params := back.Query()
+	params.Set("state", q.Get("state"))
+
+	user := q.Get("login_hint")
+	if len(user) == 0 {
+		user = p.DefaultUser
+	}
+	switch {
+	case q.Get("response_type") != "code":
+		params.Set("error", "unsupported_response_type")
+	case !strings.Contains(" "+q.Get("scope")+" ", " openid "):
+		params.Set("error", "invalid_scope")
+	case q.Get("code_challenge_method") != "S256" || len(q.Get("code_challenge")) == 0:
+		params.Set("error", "invalid_request")
+		params.Set("error_description", "PKCE S256 is required")
+	case user == "deny":
+		params.Set("error", "access_denied")
+		params.Set("error_description", "The user refused the login")
+	default:
+		code := uniuri.NewLen(32)
+		p.mu.Lock()
+		p.codes[code] = grant{
+			user:        user,
+			nonce:       q.Get("nonce"),
+			redirectURI: redirectURI,
+			challenge:   q.Get("code_challenge"),
+			expires:     time.Now().Add(lifetime),
+		}
+		p.mu.Unlock()
+		params.Set("code", code)
+		log.Printf("Login of %s granted", user)
+	}
+
+	back.RawQuery = params.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+// token exchanges a code for an ID token and an access token
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if id != p.ClientID || secret != p.ClientSecret {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "wrong client credentials")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	code := r.PostFormValue("code")
+	p.mu.Lock()
+	g, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	switch {
+	case !ok || time.Now().After(g.expires):
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "unknown or expired code")
+		return
+	case g.redirectURI != r.PostFormValue("redirect_uri"):
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match")
+		return
+	case base64.RawURLEncoding.EncodeToString(verifier[:]) != g.challenge:
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "wrong code_verifier")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":   p.Issuer,
+		"sub":   Subject(g.user),
+		"aud":   p.ClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(lifetime).Unix(),
+		"nonce": g.nonce,
+	}
+	if !p.UserinfoOnly {
+		claims["preferred_username"] = g.user
+	}
+	if p.Claims != nil {
+		p.Claims(claims)
+	}
+	idToken, err := p.sign(claims)
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	accessToken := uniuri.NewLen(32)
+	p.mu.Lock()
+	p.tokens[accessToken] = g.user
+	p.mu.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(lifetime.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+func (p *Provider) userinfo(w http.ResponseWriter, r *http.Request) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+
+	p.mu.Lock()
+	user, ok := p.tokens[token]
+	p.mu.Unlock()
+
+	if !strings.EqualFold(scheme, "Bearer") || !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"sub": Subject(user), "preferred_username": user})
+}
+
+// sign returns claims as a JWT signed with RS256
+func (p *Provider) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
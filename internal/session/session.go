@@ -0,0 +1,467 @@
+// Package session provides management of user sessions in database
+// A user has one session per device, identified by the value of its cookie (the token)
+// Only a keyed hash of the token is stored, so that a copy of the database can't be used to impersonate users
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/dchest/uniuri"
+	bolt "go.etcd.io/bbolt"
+)
+
+// CookieName is the name of the session cookie
+const CookieName string = "goboard_id"
+
+// Sessions: keys are the hashes of the session tokens (the tokens for sessions not hashed yet)
+const sessionsBucketName string = "Sessions"
+
+// Index of the sessions of each user: a bucket per login, keys are the session ids and values the Sessions keys
+const sessionsByLoginBucketName string = "SessionsByLogin"
+
+// Sessions of the cookie package, replaced by sessions (keys are the cookie values)
+const legacyCookiesBucketName string = "UsersCookie"
+
+// LastSeenResolution is the minimum delay between two updates of the last activity of a session
+// It avoids a database write on every authenticated request
+const LastSeenResolution = time.Minute
+
+const (
+	idLen    = 16
+	tokenLen = 64
+)
+
+// ErrSessionNotFound is returned for unknown, revoked and expired sessions
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a logged in device of a user
+type Session struct {
+	ID        string     `json:"id"`                   // Public identifier, used to revoke the session
+	TokenHash string     `json:"token_hash,omitempty"` // Keyed hash of the cookie value
+	Token     string     `json:"token,omitempty"`      // Cookie value, only set on sessions stored before hashing
+	Login     string     `json:"login"`
+	Created   time.Time  `json:"created"`
+	Expires   time.Time  `json:"expires"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"` // Unknown if nil (session created before last activity tracking)
+	UserAgent string     `json:"user_agent,omitempty"`
+	IP        string     `json:"ip,omitempty"`
+}
+
+// LegacyCookie is a session of the cookie package, found in older databases and dumps
+type LegacyCookie struct {
+	Login  string
+	Cookie http.Cookie
+}
+
+// Hasher computes the hashes of session tokens, keyed with the server secret
+type Hasher struct {
+	key []byte
+}
+
+// NewHasher creates a Hasher keyed with secret
+// Without secret, tokens are hashed with SHA-256 only
+// Changing the secret invalidates every session
+func NewHasher(secret string) Hasher {
+	return Hasher{key: []byte(secret)}
+}
+
+// Hash returns the hash of a session token (HMAC-SHA256, hex encoded)
+func (h Hasher) Hash(token string) string {
+	if len(h.key) == 0 {
+		sum := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// New creates a session (not stored) for a device of a user and returns it with its token, which is never stored
+func New(h Hasher, login string, duration time.Duration, userAgent string, ip string) (s Session, token string) {
+	now := time.Now()
+	token = uniuri.NewLen(tokenLen)
+	return Session{
+		ID:        uniuri.NewLen(idLen),
+		TokenHash: h.Hash(token),
+		Login:     login,
+		Created:   now,
+		Expires:   now.Add(duration),
+		LastSeen:  &now,
+		UserAgent: userAgent,
+		IP:        ip,
+	}, token
+}
+
+// FromLegacyCookie converts a session of the cookie package into a session not hashed yet
+func FromLegacyCookie(lc LegacyCookie) Session {
+	return Session{
+		ID:      uniuri.NewLen(idLen),
+		Token:   lc.Cookie.Value,
+		Login:   lc.Login,
+		Created: time.Now(),
+		Expires: lc.Cookie.Expires,
+	}
+}
+
+// Cookie returns the cookie of the session, token being the value returned by New
+func (s Session) Cookie(token string) http.Cookie {
+	return http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Expires:  s.Expires,
+		Path:     "/",
+		HttpOnly: true,
+	}
+}
+
+// Expired tells if the session is expired at now
+func (s Session) Expired(now time.Time) bool {
+	return !now.Before(s.Expires)
+}
+
+// NeedsTouch tells if the last activity of the session has to be updated for a request from ip at now
+func (s Session) NeedsTouch(now time.Time, ip string) bool {
+	return s.LastSeen == nil || now.Sub(*s.LastSeen) >= LastSeenResolution || s.IP != ip
+}
+
+// Hashed tells if the token of the session has been replaced by its hash
+func (s Session) Hashed() bool {
+	return len(s.TokenHash) > 0
+}
+
+// key returns the key of the session in the Sessions bucket
+func (s Session) key() string {
+	if s.Hashed() {
+		return s.TokenHash
+	}
+	return s.Token
+}
+
+// SortSessions sorts sessions by creation date
+func SortSessions(sessions []Session) {
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].Created.Before(sessions[j].Created) })
+}
+
+// AddSession stores a new session and indexes it
+func AddSession(db *bolt.DB, s Session) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return putSession(tx, s)
+	})
+}
+
+// GetSession returns the session of a token hash, ErrSessionNotFound if it does not exist or is expired
+func GetSession(db *bolt.DB, tokenHash string) (s Session, err error) {
+
+	err = db.View(func(tx *bolt.Tx) error {
+		var err error
+		s, err = getSession(tx, tokenHash)
+		return err
+	})
+	if err == nil && (!s.Hashed() || s.Expired(time.Now())) {
+		return Session{}, ErrSessionNotFound
+	}
+	return
+}
+
+// TouchSession records the last activity of a session, revoked sessions are ignored
+func TouchSession(db *bolt.DB, tokenHash string, seen time.Time, ip string) error {
+
+	return db.Update(func(tx *bolt.Tx) error {
+		s, err := getSession(tx, tokenHash)
+		if errors.Is(err, ErrSessionNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		s.LastSeen = &seen
+		s.IP = ip
+		return putSession(tx, s)
+	})
+}
+
+// GetSessions returns the sessions of a user which are not expired, oldest first
+func GetSessions(db *bolt.DB, login string) (sessions []Session, err error) {
+
+	now := time.Now()
+	err = db.View(func(tx *bolt.Tx) error {
+		ib := loginIndex(tx, login)
+		if ib == nil {
+			return nil
+		}
+
+		return ib.ForEach(func(id, key []byte) error {
+			s, err := getSession(tx, string(key))
+			if errors.Is(err, ErrSessionNotFound) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if !s.Expired(now) {
+				sessions = append(sessions, s)
+			}
+			return nil
+		})
+	})
+	SortSessions(sessions)
+	return
+}
+
+// DeleteSession revokes a session of a user, ErrSessionNotFound if it does not exist
+func DeleteSession(db *bolt.DB, login string, id string) error {
+
+	return db.Update(func(tx *bolt.Tx) error {
+		ib := loginIndex(tx, login)
+		var key []byte
+		if ib != nil {
+			key = ib.Get([]byte(id))
+		}
+		if key == nil {
+			return ErrSessionNotFound
+		}
+		return deleteSession(tx, login, id, string(key))
+	})
+}
+
+// DeleteSessionsForUser revokes every session of a user
+func DeleteSessionsForUser(db *bolt.DB, login string) error {
+
+	return db.Update(func(tx *bolt.Tx) error {
+		ib := loginIndex(tx, login)
+		if ib == nil {
+			return nil
+		}
+
+		if b := tx.Bucket([]byte(sessionsBucketName)); b != nil {
+			if err := ib.ForEach(func(id, key []byte) error {
+				return b.Delete(key)
+			}); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte(sessionsByLoginBucketName)).DeleteBucket([]byte(login))
+	})
+}
+
+// DeleteExpiredSessions removes the sessions expired at now and returns their number
+func DeleteExpiredSessions(db *bolt.DB, now time.Time) (count int, err error) {
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sessionsBucketName))
+		if b == nil {
+			return nil
+		}
+
+		// Sessions are deleted once the cursor is not used anymore
+		var expired []Session
+		if err := b.ForEach(func(k, v []byte) error {
+			var s Session
+			if err := json.Unmarshal(v, &s); err != nil {
+				log.Printf("Could not unmarshal session data, skipping: %v", err)
+				return nil
+			}
+			if s.Expired(now) {
+				expired = append(expired, s)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, s := range expired {
+			if err := deleteSession(tx, s.Login, s.ID, s.key()); err != nil {
+				return err
+			}
+		}
+		count = len(expired)
+		return nil
+	})
+	return
+}
+
+// ForEachSession calls fn for every stored session
+func ForEachSession(db *bolt.DB, fn func(Session) error) error {
+
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sessionsBucketName))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var s Session
+			if err := json.Unmarshal(v, &s); err != nil {
+				log.Printf("Could not unmarshal session data, skipping: %v", err)
+				return nil
+			}
+			return fn(s)
+		})
+	})
+}
+
+// ImportSession stores a session as is
+func ImportSession(db *bolt.DB, s Session) error {
+	return AddSession(db, s)
+}
+
+// HashTokens replaces the tokens of the sessions not hashed yet by their hashes
+// Returns the number of sessions hashed
+func HashTokens(db *bolt.DB, h Hasher) (count int, err error) {
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sessionsBucketName))
+		if b == nil {
+			return nil
+		}
+
+		// Sessions are moved once the cursor is not used anymore
+		var plain []Session
+		if err := b.ForEach(func(k, v []byte) error {
+			var s Session
+			if err := json.Unmarshal(v, &s); err != nil {
+				log.Printf("Could not unmarshal session data, skipping: %v", err)
+				return nil
+			}
+			if !s.Hashed() {
+				plain = append(plain, s)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, s := range plain {
+			if err := deleteSession(tx, s.Login, s.ID, s.key()); err != nil {
+				return err
+			}
+			s.TokenHash = h.Hash(s.Token)
+			s.Token = ""
+			if err := putSession(tx, s); err != nil {
+				return err
+			}
+		}
+		count = len(plain)
+		return nil
+	})
+	return
+}
+
+// ForEachLegacyCookie calls fn for every session of the cookie package not migrated yet
+func ForEachLegacyCookie(db *bolt.DB, fn func(LegacyCookie) error) error {
+
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(legacyCookiesBucketName))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var lc LegacyCookie
+			if err := json.Unmarshal(v, &lc); err != nil {
+				log.Printf("Could not unmarshal cookie data, skipping: %v", err)
+				return nil
+			}
+			return fn(lc)
+		})
+	})
+}
+
+// MigrateLegacyCookies turns the sessions of the cookie package into sessions, expired ones are dropped
+// Returns the number of sessions migrated
+func MigrateLegacyCookies(db *bolt.DB) (count int, err error) {
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(legacyCookiesBucketName))
+		if b == nil {
+			return nil
+		}
+
+		now := time.Now()
+		if err := b.ForEach(func(k, v []byte) error {
+			var lc LegacyCookie
+			if err := json.Unmarshal(v, &lc); err != nil {
+				log.Printf("Could not unmarshal cookie data, skipping: %v", err)
+				return nil
+			}
+			s := FromLegacyCookie(lc)
+			if s.Expired(now) || len(s.Login) == 0 {
+				return nil
+			}
+			count++
+			return putSession(tx, s)
+		}); err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte(legacyCookiesBucketName))
+	})
+	return
+}
+
+func getSession(tx *bolt.Tx, key string) (s Session, err error) {
+	b := tx.Bucket([]byte(sessionsBucketName))
+	var v []byte
+	if b != nil {
+		v = b.Get([]byte(key))
+	}
+	if v == nil {
+		return s, ErrSessionNotFound
+	}
+	err = json.Unmarshal(v, &s)
+	return
+}
+
+func putSession(tx *bolt.Tx, s Session) error {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	b, err := tx.CreateBucketIfNotExists([]byte(sessionsBucketName))
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(s.key()), buf); err != nil {
+		return err
+	}
+
+	ib, err := tx.CreateBucketIfNotExists([]byte(sessionsByLoginBucketName))
+	if err != nil {
+		return err
+	}
+	lb, err := ib.CreateBucketIfNotExists([]byte(s.Login))
+	if err != nil {
+		return err
+	}
+	return lb.Put([]byte(s.ID), []byte(s.key()))
+}
+
+func deleteSession(tx *bolt.Tx, login string, id string, key string) error {
+	if b := tx.Bucket([]byte(sessionsBucketName)); b != nil {
+		if err := b.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+	if ib := loginIndex(tx, login); ib != nil {
+		if err := ib.Delete([]byte(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loginIndex returns the index bucket of the sessions of a user, nil if none
+func loginIndex(tx *bolt.Tx, login string) *bolt.Bucket {
+	ib := tx.Bucket([]byte(sessionsByLoginBucketName))
+	if ib == nil {
+		return nil
+	}
+	return ib.Bucket([]byte(login))
+}
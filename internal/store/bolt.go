@@ -0,0 +1,325 @@
+package store
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+	goboardsession "github.com/dguihal/goboard/internal/session"
+	goboardtoken "github.com/dguihal/goboard/internal/token"
+	goboarduser "github.com/dguihal/goboard/internal/user"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore is a Store backed by a bbolt database
+type BoltStore struct {
+	DB *bolt.DB
+}
+
+// NewBoltStore creates a Store using an opened bbolt database
+func NewBoltStore(db *bolt.DB) *BoltStore {
+	return &BoltStore{DB: db}
+}
+
+// Close closes the underlying database
+func (s *BoltStore) Close() error {
+	return s.DB.Close()
+}
+
+// PostMessage stores a new post
+func (s *BoltStore) PostMessage(board string, post goboardbackend.Post, loc *time.Location) (uint64, error) {
+	return goboardbackend.PostMessage(s.DB, board, post, loc)
+}
+
+// DeletePost turns a post into a tombstone
+func (s *BoltStore) DeletePost(board string, id uint64, mod goboardbackend.Moderation) (goboardbackend.Post, error) {
+	return goboardbackend.DeletePost(s.DB, board, id, mod)
+}
+
+// DeleteMatchingPosts turns the posts matching a filter into tombstones
+func (s *BoltStore) DeleteMatchingPosts(board string, f goboardbackend.PostFilter, mod goboardbackend.Moderation, dryRun bool) ([]uint64, error) {
+	return goboardbackend.DeleteMatchingPosts(s.DB, board, f, mod, dryRun)
+}
+
+// RestorePost brings a tombstone back to life
+func (s *BoltStore) RestorePost(board string, id uint64, mod goboardbackend.Moderation) (goboardbackend.Post, error) {
+	return goboardbackend.RestorePost(s.DB, board, id, mod)
+}
+
+// GetModLog returns a page of the moderation log
+func (s *BoltStore) GetModLog(board string, limit int, before uint64) ([]goboardbackend.ModLogEntry, error) {
+	return goboardbackend.GetModLog(s.DB, board, limit, before)
+}
+
+// PurgePosts removes posts
+func (s *BoltStore) PurgePosts(board string, ids []uint64) error {
+	return goboardbackend.PurgePosts(s.DB, board, ids)
+}
+
+// GetPost returns a post
+func (s *BoltStore) GetPost(board string, id uint64) (goboardbackend.Post, error) {
+	return goboardbackend.GetPost(s.DB, board, id)
+}
+
+// GetHistory returns a page of posts
+func (s *BoltStore) GetHistory(board string, limit int, last uint64, before uint64) ([]goboardbackend.Post, error) {
+	return goboardbackend.GetHistory(s.DB, board, limit, last, before)
+}
+
+// GetOldest returns a page of posts, oldest first
+func (s *BoltStore) GetOldest(board string, limit int, after uint64) ([]goboardbackend.Post, error) {
+	return goboardbackend.GetOldest(s.DB, board, limit, after)
+}
+
+// CountPosts returns the number of posts of a board
+func (s *BoltStore) CountPosts(board string) (int, error) {
+	return goboardbackend.CountPosts(s.DB, board)
+}
+
+// GetArchive returns the posts made in a time range
+func (s *BoltStore) GetArchive(board string, start time.Time, end time.Time) ([]goboardbackend.Post, error) {
+	return goboardbackend.GetArchive(s.DB, board, start, end)
+}
+
+// EditPost replaces the message of a post
+func (s *BoltStore) EditPost(board string, id uint64, message string, rawMessage string, editTime time.Time, loc *time.Location) (goboardbackend.Post, error) {
+	return goboardbackend.EditPost(s.DB, board, id, message, rawMessage, editTime, loc)
+}
+
+// GetRevisions returns the previous versions of a post
+func (s *BoltStore) GetRevisions(board string, id uint64) ([]goboardbackend.PostRevision, error) {
+	return goboardbackend.GetRevisions(s.DB, board, id)
+}
+
+// GetReplies returns the posts referencing a post
+func (s *BoltStore) GetReplies(board string, id uint64) ([]goboardbackend.Post, error) {
+	return goboardbackend.GetReplies(s.DB, board, id)
+}
+
+// Search returns the posts matching a query
+func (s *BoltStore) Search(board string, q goboardbackend.SearchQuery, limit int) ([]goboardbackend.Post, error) {
+	return goboardbackend.Search(s.DB, board, q, limit)
+}
+
+// RebuildSearchIndex indexes the whole history again
+func (s *BoltStore) RebuildSearchIndex(board string) (int, error) {
+	return goboardbackend.RebuildSearchIndex(s.DB, board)
+}
+
+// AddUser creates a user
+func (s *BoltStore) AddUser(login string, password string) error {
+	return goboarduser.AddUser(s.DB, login, password)
+}
+
+// AddOIDCUser creates a user authenticated by an OpenID Connect provider, without password
+func (s *BoltStore) AddOIDCUser(login string, subject string) error {
+	return goboarduser.AddOIDCUser(s.DB, login, subject)
+}
+
+// AuthUser checks a user password
+func (s *BoltStore) AuthUser(login string, password string) error {
+	return goboarduser.AuthUser(s.DB, login, password)
+}
+
+// DeleteUser removes a user
+func (s *BoltStore) DeleteUser(login string) error {
+	return goboarduser.DeleteUser(s.DB, login)
+}
+
+// GetUser returns a user
+func (s *BoltStore) GetUser(login string) (goboarduser.User, error) {
+	return goboarduser.GetUser(s.DB, login)
+}
+
+// SetUserRole changes the role of a user
+func (s *BoltStore) SetUserRole(login string, role string) error {
+	return goboarduser.SetUserRole(s.DB, login, role)
+}
+
+// SetPassword replaces the password of a user
+func (s *BoltStore) SetPassword(login string, password string) error {
+	return goboarduser.SetPassword(s.DB, login, password)
+}
+
+// AddSession stores a new session
+func (s *BoltStore) AddSession(session goboardsession.Session) error {
+	return goboardsession.AddSession(s.DB, session)
+}
+
+// GetSession returns the session of a token hash
+func (s *BoltStore) GetSession(tokenHash string) (goboardsession.Session, error) {
+	return goboardsession.GetSession(s.DB, tokenHash)
+}
+
+// TouchSession records the last activity of a session
+func (s *BoltStore) TouchSession(tokenHash string, seen time.Time, ip string) error {
+	return goboardsession.TouchSession(s.DB, tokenHash, seen, ip)
+}
+
+// GetSessions returns the sessions of a user, oldest first
+func (s *BoltStore) GetSessions(login string) ([]goboardsession.Session, error) {
+	return goboardsession.GetSessions(s.DB, login)
+}
+
+// DeleteSession revokes a session of a user
+func (s *BoltStore) DeleteSession(login string, id string) error {
+	return goboardsession.DeleteSession(s.DB, login, id)
+}
+
+// DeleteSessionsForUser revokes every session of a user
+func (s *BoltStore) DeleteSessionsForUser(login string) error {
+	return goboardsession.DeleteSessionsForUser(s.DB, login)
+}
+
+// DeleteExpiredSessions removes the expired sessions
+func (s *BoltStore) DeleteExpiredSessions(now time.Time) (int, error) {
+	return goboardsession.DeleteExpiredSessions(s.DB, now)
+}
+
+// AddToken stores a new API token
+func (s *BoltStore) AddToken(t goboardtoken.APIToken) error {
+	return goboardtoken.AddToken(s.DB, t)
+}
+
+// GetToken returns an API token
+func (s *BoltStore) GetToken(id string) (goboardtoken.APIToken, error) {
+	return goboardtoken.GetToken(s.DB, id)
+}
+
+// GetTokens returns every API token, oldest first
+func (s *BoltStore) GetTokens() ([]goboardtoken.APIToken, error) {
+	return goboardtoken.GetTokens(s.DB)
+}
+
+// GetTokensForUser returns the personal API keys of login, oldest first
+func (s *BoltStore) GetTokensForUser(login string) ([]goboardtoken.APIToken, error) {
+	return goboardtoken.GetTokensForUser(s.DB, login)
+}
+
+// DeleteToken revokes an API token
+func (s *BoltStore) DeleteToken(id string) error {
+	return goboardtoken.DeleteToken(s.DB, id)
+}
+
+// DeleteTokensForUser revokes every personal API key of login
+func (s *BoltStore) DeleteTokensForUser(login string) error {
+	return goboardtoken.DeleteTokensForUser(s.DB, login)
+}
+
+// TouchToken records the last use of an API token
+func (s *BoltStore) TouchToken(id string, lastUsed time.Time) error {
+	return goboardtoken.TouchToken(s.DB, id, lastUsed)
+}
+
+// Snapshot calls fn with the database as seen by a read transaction
+// Writes are not blocked meanwhile
+func (s *BoltStore) Snapshot(fn func(Snapshot) error) error {
+	return s.DB.View(func(tx *bolt.Tx) error {
+		return fn(tx)
+	})
+}
+
+// RestoreBoltSnapshot replaces a bbolt database file by a (possibly gzipped) snapshot
+// The snapshot is checked against its sha256 checksum (if not empty) and for consistency before replacing the database,
+// which is kept with a .before-restore-<time> suffix
+func RestoreBoltSnapshot(snapshotPath string, dbPath string, mode os.FileMode, checksum string) error {
+
+	in, err := os.Open(snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader = bufio.NewReader(in)
+	if magic, err := r.(*bufio.Reader).Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	// Written next to the database, so that it can be renamed to it
+	tmp, err := os.CreateTemp(filepath.Dir(dbPath), filepath.Base(dbPath)+".restore-*")
+	if err != nil {
+		return err
+	}
+	restored := false
+	defer func() {
+		if !restored {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); len(checksum) > 0 && !strings.EqualFold(sum, checksum) {
+		return fmt.Errorf("checksum mismatch: snapshot is %s, expected %s", sum, checksum)
+	}
+
+	if err := checkBoltFile(tmp.Name()); err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dbPath); err == nil {
+		// Fails if the database is used by a running server
+		db, err := bolt.Open(dbPath, mode, &bolt.Options{Timeout: 1 * time.Second})
+		if err != nil {
+			return fmt.Errorf("could not open %s: %w", dbPath, err)
+		}
+		db.Close()
+
+		if err := os.Rename(dbPath, dbPath+".before-restore-"+time.Now().Format("20060102150405")); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), dbPath); err != nil {
+		return err
+	}
+	restored = true
+	return nil
+}
+
+// checkBoltFile opens a bbolt database and checks its consistency
+func checkBoltFile(path string) error {
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) (err error) {
+		// Errors channel must be drained
+		for cerr := range tx.Check() {
+			if err == nil {
+				err = cerr
+			}
+		}
+		return
+	})
+}
@@ -0,0 +1,36 @@
+package store
+
+import (
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+	goboardsession "github.com/dguihal/goboard/internal/session"
+	goboardtoken "github.com/dguihal/goboard/internal/token"
+	goboarduser "github.com/dguihal/goboard/internal/user"
+)
+
+// A list of dump record types
+const (
+	RecordBoard    = "board"    // Board with its sequence, written before its posts
+	RecordPost     = "post"     // Post of a board
+	RecordRevision = "revision" // Previous version of an edited post, written after its post
+	RecordModLog   = "modlog"   // Moderation log entry of a board, written after its posts
+	RecordUser     = "user"     // User, password hash included
+	RecordSession  = "session"  // Session of a user, keyed hash of its token (cookie value of sessions not hashed yet)
+	RecordCookie   = "cookie"   // Session cookie of older dumps (cookie value included), restored as a session
+	RecordToken    = "token"    // API token, hashed secret included
+)
+
+// Record is a line of a JSON Lines dump (goboard-db dumps, retention archives)
+// Board is the storage key of a board
+type Record struct {
+	Type     string                       `json:"type"`
+	Board    string                       `json:"board,omitempty"`
+	Seq      uint64                       `json:"seq,omitempty"`
+	Post     *goboardbackend.Post         `json:"post,omitempty"`
+	PostID   uint64                       `json:"post_id,omitempty"` // Post of a revision
+	Revision *goboardbackend.PostRevision `json:"revision,omitempty"`
+	ModLog   *goboardbackend.ModLogEntry  `json:"modlog,omitempty"`
+	User     *goboarduser.User            `json:"user,omitempty"`
+	Session  *goboardsession.Session      `json:"session,omitempty"`
+	Cookie   *goboardsession.LegacyCookie `json:"cookie,omitempty"`
+	Token    *goboardtoken.APIToken       `json:"token,omitempty"`
+}
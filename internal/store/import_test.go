@@ -0,0 +1,67 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestImportPostsReplaces(t *testing.T) {
+	tests := []struct {
+		name string
+		open func(t *testing.T) (Store, func(board string, posts []goboardbackend.Post) error)
+	}{
+		{"bolt", func(t *testing.T) (Store, func(string, []goboardbackend.Post) error) {
+			db, err := bolt.Open(filepath.Join(t.TempDir(), "goboard.db"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return NewBoltStore(db), func(board string, posts []goboardbackend.Post) error {
+				return goboardbackend.ImportPosts(db, board, posts)
+			}
+		}},
+		{"sqlite", func(t *testing.T) (Store, func(string, []goboardbackend.Post) error) {
+			s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "goboard.sqlite"), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s, s.ImportPosts
+		}},
+	}
+
+	now := goboardbackend.PostTime{Time: time.Now().UTC().Truncate(time.Second)}
+	original := []goboardbackend.Post{
+		{ID: 1, Time: now, Message: "question"},
+		{ID: 2, Time: now, Message: "apple", Refs: goboardbackend.PostRefs{1}},
+	}
+	replacement := []goboardbackend.Post{{ID: 2, Time: now, Message: "banana"}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, importPosts := tc.open(t)
+			for _, posts := range [][]goboardbackend.Post{original, replacement} {
+				if err := importPosts("test", posts); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if replies, err := s.GetReplies("test", 1); err != nil || len(replies) != 0 {
+				t.Errorf("replies of post 1: %v (%v), want none", replies, err)
+			}
+			if found, err := s.Search("test", goboardbackend.SearchQuery{Text: "apple"}, 10); err != nil || len(found) != 0 {
+				t.Errorf("search of the replaced message: %v (%v), want none", found, err)
+			}
+			if found, err := s.Search("test", goboardbackend.SearchQuery{Text: "banana"}, 10); err != nil || len(found) != 1 {
+				t.Errorf("search of the new message: %v (%v), want post 2", found, err)
+			}
+			if n, err := s.CountPosts("test"); err != nil || n != 2 {
+				t.Errorf("%d posts (%v), want 2", n, err)
+			}
+		})
+	}
+}
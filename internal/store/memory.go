@@ -0,0 +1,762 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+	goboardsession "github.com/dguihal/goboard/internal/session"
+	goboardtoken "github.com/dguihal/goboard/internal/token"
+	goboarduser "github.com/dguihal/goboard/internal/user"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MemoryStore is a Store keeping everything in memory (nothing is persisted)
+type MemoryStore struct {
+	mu     sync.RWMutex
+	boards map[string]*memoryBoard
+	users  map[string]goboarduser.User
+	tokens map[string]goboardtoken.APIToken // By token id
+
+	sessions        map[string]goboardsession.Session // By token hash
+	sessionsByLogin map[string]map[string]string      // Token hashes by login and session id
+}
+
+// memoryBoard holds the posts of a board
+type memoryBoard struct {
+	seq       uint64
+	posts     []goboardbackend.Post                    // Ordered by id
+	replies   map[uint64][]uint64                      // Replying post ids by referenced post id
+	index     map[string]map[uint64]bool               // Post ids by search term
+	revisions map[uint64][]goboardbackend.PostRevision // Previous versions by post id
+	modLog    []goboardbackend.ModLogEntry             // Ordered by id
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		boards: map[string]*memoryBoard{},
+		users:  map[string]goboarduser.User{},
+		tokens: map[string]goboardtoken.APIToken{},
+
+		sessions:        map[string]goboardsession.Session{},
+		sessionsByLogin: map[string]map[string]string{},
+	}
+}
+
+// Close does nothing
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// board returns a board, creating it if needed (s.mu must be held for writing)
+func (s *MemoryStore) board(board string) *memoryBoard {
+	b, ok := s.boards[board]
+	if !ok {
+		b = &memoryBoard{
+			replies:   map[uint64][]uint64{},
+			index:     map[string]map[uint64]bool{},
+			revisions: map[uint64][]goboardbackend.PostRevision{},
+		}
+		s.boards[board] = b
+	}
+	return b
+}
+
+// find returns the position of the first post with an id >= id
+func (b *memoryBoard) find(id uint64) int {
+	return sort.Search(len(b.posts), func(i int) bool { return b.posts[i].ID >= id })
+}
+
+// findTime returns the position of the first post made at t or after
+func (b *memoryBoard) findTime(t time.Time) int {
+	return sort.Search(len(b.posts), func(i int) bool { return !b.posts[i].Time.Before(t) })
+}
+
+func (b *memoryBoard) postsInRange(start time.Time, end time.Time) (ids []uint64, err error) {
+	for i := b.findTime(start); i < len(b.posts) && b.posts[i].Time.Before(end); i++ {
+		ids = append(ids, b.posts[i].ID)
+	}
+	return
+}
+
+func (b *memoryBoard) indexPost(p goboardbackend.Post) {
+	if p.Deleted != nil {
+		return
+	}
+	for _, t := range goboardbackend.SearchTerms(p.Message) {
+		if b.index[t] == nil {
+			b.index[t] = map[uint64]bool{}
+		}
+		b.index[t][p.ID] = true
+	}
+}
+
+func (b *memoryBoard) unindexPost(p goboardbackend.Post) {
+	for _, t := range goboardbackend.SearchTerms(p.Message) {
+		delete(b.index[t], p.ID)
+	}
+}
+
+func (b *memoryBoard) putReplies(p goboardbackend.Post) {
+	for _, ref := range p.Refs {
+		b.replies[ref] = append(b.replies[ref], p.ID)
+	}
+}
+
+func (b *memoryBoard) deleteReplies(p goboardbackend.Post) {
+	for _, ref := range p.Refs {
+		replies := b.replies[ref]
+		for j, r := range replies {
+			if r == p.ID {
+				b.replies[ref] = append(replies[:j:j], replies[j+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// PostMessage stores a new post
+func (s *MemoryStore) PostMessage(board string, post goboardbackend.Post, loc *time.Location) (postID uint64, err error) {
+	s.mu.Lock()
+
+	b := s.board(board)
+
+	post.Refs = nil
+	if norloges := goboardbackend.ParseNorloges(post.Message); len(norloges) > 0 {
+		if post.Refs, err = goboardbackend.ResolveNorloges(norloges, post.Time.Time, loc, b.postsInRange); err != nil {
+			s.mu.Unlock()
+			return
+		}
+	}
+
+	b.seq++
+	postID = b.seq
+	post.ID = postID
+
+	b.posts = append(b.posts, post)
+	b.putReplies(post)
+	b.indexPost(post)
+
+	s.mu.Unlock()
+
+	goboardbackend.NotifyPost(board, postID)
+	return
+}
+
+// DeletePost turns a post into a tombstone
+func (s *MemoryStore) DeletePost(board string, id uint64, mod goboardbackend.Moderation) (goboardbackend.Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.board(board)
+	i := b.find(id)
+	if i >= len(b.posts) || b.posts[i].ID != id {
+		return goboardbackend.Post{}, nil
+	}
+	if b.posts[i].Deleted != nil {
+		return goboardbackend.Post{}, goboardbackend.ErrPostDeleted
+	}
+
+	b.deletePost(i, mod)
+	return b.posts[i], nil
+}
+
+// DeleteMatchingPosts turns the posts matching a filter into tombstones
+func (s *MemoryStore) DeleteMatchingPosts(board string, f goboardbackend.PostFilter, mod goboardbackend.Moderation, dryRun bool) (ids []uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.boards[board]
+	if !ok {
+		return
+	}
+
+	for i := b.find(f.FromID); i < len(b.posts) && !f.After(b.posts[i]); i++ {
+		if b.posts[i].Deleted != nil || !f.Match(b.posts[i]) {
+			continue
+		}
+		ids = append(ids, b.posts[i].ID)
+		if !dryRun {
+			b.deletePost(i, mod)
+		}
+	}
+	return
+}
+
+// deletePost turns the post at position i into a tombstone and logs it
+func (b *memoryBoard) deletePost(i int, mod goboardbackend.Moderation) {
+	b.unindexPost(b.posts[i])
+	b.posts[i].Deleted = &mod
+	b.appendModLog(goboardbackend.ModLogEntry{Action: goboardbackend.ModDelete, PostID: b.posts[i].ID, Moderation: mod})
+}
+
+// RestorePost brings a tombstone back to life
+func (s *MemoryStore) RestorePost(board string, id uint64, mod goboardbackend.Moderation) (goboardbackend.Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.board(board)
+	i := b.find(id)
+	if i >= len(b.posts) || b.posts[i].ID != id {
+		return goboardbackend.Post{}, nil
+	}
+	if b.posts[i].Deleted == nil {
+		return goboardbackend.Post{}, goboardbackend.ErrPostNotDeleted
+	}
+
+	b.posts[i].Deleted = nil
+	b.indexPost(b.posts[i])
+	b.appendModLog(goboardbackend.ModLogEntry{Action: goboardbackend.ModRestore, PostID: id, Moderation: mod})
+	return b.posts[i], nil
+}
+
+func (b *memoryBoard) appendModLog(e goboardbackend.ModLogEntry) {
+	e.ID = uint64(len(b.modLog) + 1)
+	b.modLog = append(b.modLog, e)
+}
+
+// GetModLog returns a page of the moderation log
+func (s *MemoryStore) GetModLog(board string, limit int, before uint64) (entries []goboardbackend.ModLogEntry, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, ok := s.boards[board]
+	if !ok {
+		return
+	}
+
+	// Entries ids are their position + 1
+	i := len(b.modLog)
+	if before > 0 && before <= uint64(i) {
+		i = int(before) - 1
+	}
+	for i--; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, b.modLog[i])
+	}
+	return
+}
+
+// PurgePosts removes posts
+func (s *MemoryStore) PurgePosts(board string, ids []uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.board(board)
+	for _, id := range ids {
+		i := b.find(id)
+		if i >= len(b.posts) || b.posts[i].ID != id {
+			continue
+		}
+		p := b.posts[i]
+
+		b.deleteReplies(p)
+		b.unindexPost(p)
+		for _, r := range b.replies[id] {
+			if j := b.find(r); j < len(b.posts) && b.posts[j].ID == r {
+				b.posts[j].Refs = b.posts[j].Refs.Without(id)
+			}
+		}
+		delete(b.replies, id)
+		delete(b.revisions, id)
+
+		b.posts = append(b.posts[:i:i], b.posts[i+1:]...)
+	}
+	return nil
+}
+
+// GetPost returns a post
+func (s *MemoryStore) GetPost(board string, id uint64) (goboardbackend.Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if b, ok := s.boards[board]; ok {
+		if i := b.find(id); i < len(b.posts) && b.posts[i].ID == id {
+			return b.posts[i], nil
+		}
+	}
+	return goboardbackend.Post{}, nil
+}
+
+// GetHistory returns a page of posts
+func (s *MemoryStore) GetHistory(board string, limit int, last uint64, before uint64) ([]goboardbackend.Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	posts := make([]goboardbackend.Post, 0, limit)
+
+	b, ok := s.boards[board]
+	if !ok {
+		return posts, nil
+	}
+
+	i := len(b.posts)
+	if before > 0 {
+		i = b.find(before)
+	}
+	for i--; i >= 0 && len(posts) < limit && b.posts[i].ID > last; i-- {
+		posts = append(posts, b.posts[i])
+	}
+	return posts, nil
+}
+
+// GetOldest returns a page of posts, oldest first
+func (s *MemoryStore) GetOldest(board string, limit int, after uint64) (posts []goboardbackend.Post, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, ok := s.boards[board]
+	if !ok {
+		return
+	}
+
+	for i := b.find(after + 1); i < len(b.posts) && len(posts) < limit; i++ {
+		posts = append(posts, b.posts[i])
+	}
+	return
+}
+
+// CountPosts returns the number of posts of a board
+func (s *MemoryStore) CountPosts(board string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if b, ok := s.boards[board]; ok {
+		return len(b.posts), nil
+	}
+	return 0, nil
+}
+
+// GetArchive returns the posts made in a time range
+func (s *MemoryStore) GetArchive(board string, start time.Time, end time.Time) (posts []goboardbackend.Post, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, ok := s.boards[board]
+	if !ok {
+		return
+	}
+
+	last := b.findTime(end)
+	for i := last - 1; i >= 0 && !b.posts[i].Time.Before(start); i-- {
+		posts = append(posts, b.posts[i])
+	}
+	return
+}
+
+// EditPost replaces the message of a post
+func (s *MemoryStore) EditPost(board string, id uint64, message string, rawMessage string, editTime time.Time, loc *time.Location) (goboardbackend.Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.board(board)
+	i := b.find(id)
+	if i >= len(b.posts) || b.posts[i].ID != id {
+		return goboardbackend.Post{}, nil
+	}
+
+	old := b.posts[i]
+	if old.Deleted != nil {
+		return goboardbackend.Post{}, goboardbackend.ErrPostDeleted
+	}
+	post := old
+	if err := post.Edit(message, rawMessage, editTime, loc, b.postsInRange); err != nil {
+		return goboardbackend.Post{}, err
+	}
+
+	b.revisions[id] = append(b.revisions[id], old.Revision(uint64(len(b.revisions[id])+1)))
+	b.deleteReplies(old)
+	b.unindexPost(old)
+	b.posts[i] = post
+	b.putReplies(post)
+	b.indexPost(post)
+	return post, nil
+}
+
+// GetRevisions returns the previous versions of a post
+func (s *MemoryStore) GetRevisions(board string, id uint64) ([]goboardbackend.PostRevision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if b, ok := s.boards[board]; ok {
+		return append([]goboardbackend.PostRevision{}, b.revisions[id]...), nil
+	}
+	return nil, nil
+}
+
+// GetReplies returns the posts referencing a post
+func (s *MemoryStore) GetReplies(board string, id uint64) (posts []goboardbackend.Post, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, ok := s.boards[board]
+	if !ok {
+		return
+	}
+
+	replies := b.replies[id]
+	for j := len(replies) - 1; j >= 0; j-- {
+		if i := b.find(replies[j]); i < len(b.posts) && b.posts[i].ID == replies[j] {
+			posts = append(posts, b.posts[i])
+		}
+	}
+	return
+}
+
+// Search returns the posts matching a query
+func (s *MemoryStore) Search(board string, q goboardbackend.SearchQuery, limit int) (posts []goboardbackend.Post, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	terms := goboardbackend.SearchTerms(q.Text)
+	b, ok := s.boards[board]
+	if !ok || len(terms) == 0 || limit <= 0 {
+		return
+	}
+
+	sort.Slice(terms, func(i, j int) bool { return len(b.index[terms[i]]) < len(b.index[terms[j]]) })
+
+	var ids []uint64
+	for id := range b.index[terms[0]] {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+
+	for _, id := range ids {
+		if len(posts) >= limit {
+			break
+		}
+
+		found := true
+		for _, t := range terms[1:] {
+			if !b.index[t][id] {
+				found = false
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		i := b.find(id)
+		if i >= len(b.posts) || b.posts[i].ID != id {
+			continue
+		}
+		p := b.posts[i]
+
+		if len(q.Login) > 0 && p.Login != q.Login {
+			continue
+		}
+		if !q.From.IsZero() && p.Time.Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && p.Time.After(q.To) {
+			continue
+		}
+
+		posts = append(posts, p)
+	}
+	return
+}
+
+// RebuildSearchIndex indexes the whole history again
+func (s *MemoryStore) RebuildSearchIndex(board string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.board(board)
+	b.index = map[string]map[uint64]bool{}
+	for _, p := range b.posts {
+		b.indexPost(p)
+	}
+	return len(b.posts), nil
+}
+
+// AddUser creates a user
+func (s *MemoryStore) AddUser(login string, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[login]; ok {
+		return goboarduser.NewError(fmt.Errorf("User already exists"), goboarduser.UserAlreadyExistsError)
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return goboarduser.NewError(err, goboarduser.DatabaseError)
+	}
+
+	s.users[login] = goboarduser.User{Login: login, HashedPassword: hashedPassword, CreationDate: time.Now(), Role: goboarduser.RoleUser}
+	return nil
+}
+
+// AddOIDCUser creates a user authenticated by an OpenID Connect provider, without password
+func (s *MemoryStore) AddOIDCUser(login string, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[login]; ok {
+		return goboarduser.NewError(fmt.Errorf("User already exists"), goboarduser.UserAlreadyExistsError)
+	}
+
+	s.users[login] = goboarduser.User{Login: login, CreationDate: time.Now(), Role: goboarduser.RoleUser, OIDCSubject: subject}
+	return nil
+}
+
+// AuthUser checks a user password
+func (s *MemoryStore) AuthUser(login string, password string) error {
+	s.mu.RLock()
+	user, ok := s.users[login]
+	s.mu.RUnlock()
+
+	if !ok {
+		return goboarduser.NewError(fmt.Errorf("authentification failed"), goboarduser.AuthenticationFailed)
+	}
+	if err := bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(password)); err != nil {
+		return goboarduser.NewError(err, goboarduser.AuthenticationFailed)
+	}
+	return nil
+}
+
+// DeleteUser removes a user
+func (s *MemoryStore) DeleteUser(login string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[login]; !ok {
+		return goboarduser.NewError(fmt.Errorf("User does not exists"), goboarduser.UserDoesNotExistsError)
+	}
+	delete(s.users, login)
+	return nil
+}
+
+// GetUser returns a user
+func (s *MemoryStore) GetUser(login string) (goboarduser.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[login]
+	if !ok {
+		return goboarduser.User{}, goboarduser.NewError(fmt.Errorf("User does not exists"), goboarduser.UserDoesNotExistsError)
+	}
+	user.HashedPassword = nil
+	return user, nil
+}
+
+// SetUserRole changes the role of a user
+func (s *MemoryStore) SetUserRole(login string, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[login]
+	if !ok {
+		return goboarduser.NewError(fmt.Errorf("User does not exists"), goboarduser.UserDoesNotExistsError)
+	}
+	user.Role = role
+	s.users[login] = user
+	return nil
+}
+
+// SetPassword replaces the password of a user
+func (s *MemoryStore) SetPassword(login string, password string) error {
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return goboarduser.NewError(err, goboarduser.DatabaseError)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[login]
+	if !ok {
+		return goboarduser.NewError(fmt.Errorf("User does not exists"), goboarduser.UserDoesNotExistsError)
+	}
+	user.HashedPassword = hashedPassword
+	s.users[login] = user
+	return nil
+}
+
+// AddSession stores a new session
+func (s *MemoryStore) AddSession(session goboardsession.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[session.TokenHash] = session
+	if s.sessionsByLogin[session.Login] == nil {
+		s.sessionsByLogin[session.Login] = map[string]string{}
+	}
+	s.sessionsByLogin[session.Login][session.ID] = session.TokenHash
+	return nil
+}
+
+// GetSession returns the session of a token hash
+func (s *MemoryStore) GetSession(tokenHash string) (goboardsession.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, ok := s.sessions[tokenHash]
+	if !ok || session.Expired(time.Now()) {
+		return goboardsession.Session{}, goboardsession.ErrSessionNotFound
+	}
+	return session, nil
+}
+
+// TouchSession records the last activity of a session
+func (s *MemoryStore) TouchSession(tokenHash string, seen time.Time, ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.sessions[tokenHash]; ok {
+		session.LastSeen = &seen
+		session.IP = ip
+		s.sessions[tokenHash] = session
+	}
+	return nil
+}
+
+// GetSessions returns the sessions of a user, oldest first
+func (s *MemoryStore) GetSessions(login string) ([]goboardsession.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	var sessions []goboardsession.Session
+	for _, tokenHash := range s.sessionsByLogin[login] {
+		if session := s.sessions[tokenHash]; !session.Expired(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	goboardsession.SortSessions(sessions)
+	return sessions, nil
+}
+
+// DeleteSession revokes a session of a user
+func (s *MemoryStore) DeleteSession(login string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokenHash, ok := s.sessionsByLogin[login][id]
+	if !ok {
+		return goboardsession.ErrSessionNotFound
+	}
+	delete(s.sessions, tokenHash)
+	delete(s.sessionsByLogin[login], id)
+	return nil
+}
+
+// DeleteSessionsForUser revokes every session of a user
+func (s *MemoryStore) DeleteSessionsForUser(login string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, tokenHash := range s.sessionsByLogin[login] {
+		delete(s.sessions, tokenHash)
+	}
+	delete(s.sessionsByLogin, login)
+	return nil
+}
+
+// DeleteExpiredSessions removes the expired sessions
+func (s *MemoryStore) DeleteExpiredSessions(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for tokenHash, session := range s.sessions {
+		if session.Expired(now) {
+			delete(s.sessions, tokenHash)
+			delete(s.sessionsByLogin[session.Login], session.ID)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// AddToken stores a new API token
+func (s *MemoryStore) AddToken(t goboardtoken.APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[t.ID] = t
+	return nil
+}
+
+// GetToken returns an API token
+func (s *MemoryStore) GetToken(id string) (goboardtoken.APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tokens[id]
+	if !ok {
+		return goboardtoken.APIToken{}, goboardtoken.ErrTokenNotFound
+	}
+	return t, nil
+}
+
+// GetTokens returns every API token, oldest first
+func (s *MemoryStore) GetTokens() ([]goboardtoken.APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tokens []goboardtoken.APIToken
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	goboardtoken.SortTokens(tokens)
+	return tokens, nil
+}
+
+// GetTokensForUser returns the personal API keys of login, oldest first
+func (s *MemoryStore) GetTokensForUser(login string) ([]goboardtoken.APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tokens []goboardtoken.APIToken
+	for _, t := range s.tokens {
+		if t.Login == login {
+			tokens = append(tokens, t)
+		}
+	}
+	goboardtoken.SortTokens(tokens)
+	return tokens, nil
+}
+
+// DeleteToken revokes an API token
+func (s *MemoryStore) DeleteToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tokens[id]; !ok {
+		return goboardtoken.ErrTokenNotFound
+	}
+	delete(s.tokens, id)
+	return nil
+}
+
+// DeleteTokensForUser revokes every personal API key of login
+func (s *MemoryStore) DeleteTokensForUser(login string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, t := range s.tokens {
+		if t.Login == login {
+			delete(s.tokens, id)
+		}
+	}
+	return nil
+}
+
+// TouchToken records the last use of an API token
+func (s *MemoryStore) TouchToken(id string, lastUsed time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.tokens[id]; ok {
+		t.LastUsed = &lastUsed
+		s.tokens[id] = t
+	}
+	return nil
+}
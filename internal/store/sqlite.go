@@ -0,0 +1,1275 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+	goboardsession "github.com/dguihal/goboard/internal/session"
+	goboardtoken "github.com/dguihal/goboard/internal/token"
+	goboarduser "github.com/dguihal/goboard/internal/user"
+	"golang.org/x/crypto/bcrypt"
+
+	// Registers the "sqlite" database/sql driver
+	_ "modernc.org/sqlite"
+)
+
+// Times are stored in UTC with a fixed width, so that they sort as text
+// and can be read by SQLite date functions
+const sqliteTimeFormat = "2006-01-02 15:04:05.000000000"
+
+// sqliteSchema lists the schema migrations, PRAGMA user_version holds the number applied
+var sqliteSchema = []string{
+	`CREATE TABLE boards (
+		board TEXT PRIMARY KEY,
+		seq   INTEGER NOT NULL DEFAULT 0 -- Last allocated post id
+	);
+	CREATE TABLE posts (
+		board       TEXT NOT NULL,
+		id          INTEGER NOT NULL,
+		time        TEXT NOT NULL,
+		login       TEXT NOT NULL DEFAULT '',
+		info        TEXT NOT NULL DEFAULT '',
+		message     TEXT NOT NULL,
+		raw_message TEXT NOT NULL DEFAULT '',
+		refs        TEXT, -- JSON array of the ids referenced by norloges
+		PRIMARY KEY (board, id)
+	);
+	CREATE INDEX posts_time ON posts (board, time);
+	CREATE INDEX posts_login ON posts (login, board, id);
+	CREATE TABLE replies (
+		board    TEXT NOT NULL,
+		post_id  INTEGER NOT NULL, -- Referenced post
+		reply_id INTEGER NOT NULL, -- Replying post
+		PRIMARY KEY (board, post_id, reply_id)
+	);
+	CREATE INDEX replies_reply ON replies (board, reply_id);
+	CREATE TABLE search_terms (
+		board   TEXT NOT NULL,
+		term    TEXT NOT NULL,
+		post_id INTEGER NOT NULL,
+		PRIMARY KEY (board, term, post_id)
+	);
+	CREATE INDEX search_terms_post ON search_terms (board, post_id);
+	CREATE TABLE users (
+		login           TEXT PRIMARY KEY,
+		hashed_password BLOB NOT NULL,
+		creation_date   TEXT NOT NULL
+	);
+	CREATE TABLE cookies (
+		value   TEXT PRIMARY KEY,
+		login   TEXT NOT NULL,
+		expires TEXT NOT NULL
+	);
+	CREATE INDEX cookies_login ON cookies (login);`,
+
+	`ALTER TABLE posts ADD COLUMN edited TEXT; -- Time of the last edit
+	CREATE TABLE revisions (
+		board       TEXT NOT NULL,
+		post_id     INTEGER NOT NULL,
+		number      INTEGER NOT NULL, -- 1 for the original message
+		time        TEXT NOT NULL,
+		message     TEXT NOT NULL,
+		raw_message TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (board, post_id, number)
+	);`,
+
+	`ALTER TABLE posts ADD COLUMN deleted TEXT; -- Tombstone moderation as JSON, NULL if not deleted
+	CREATE TABLE modlog (
+		board     TEXT NOT NULL,
+		id        INTEGER NOT NULL, -- Entry id, increasing per board
+		time      TEXT NOT NULL,
+		action    TEXT NOT NULL,
+		post_id   INTEGER NOT NULL,
+		moderator TEXT NOT NULL DEFAULT '',
+		reason    TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (board, id)
+	);`,
+
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';`,
+
+	`CREATE TABLE api_tokens (
+		id            TEXT PRIMARY KEY,
+		name          TEXT NOT NULL,
+		scopes        TEXT NOT NULL, -- JSON array
+		hashed_secret BLOB NOT NULL,
+		created       TEXT NOT NULL,
+		expires       TEXT, -- NULL if the token never expires
+		last_used     TEXT  -- NULL if the token was never used
+	);`,
+
+	`CREATE TABLE sessions (
+		token      TEXT PRIMARY KEY, -- Cookie value
+		id         TEXT NOT NULL,
+		login      TEXT NOT NULL,
+		created    TEXT NOT NULL,
+		expires    TEXT NOT NULL,
+		last_seen  TEXT, -- NULL if unknown
+		user_agent TEXT NOT NULL DEFAULT '',
+		ip         TEXT NOT NULL DEFAULT ''
+	);
+	CREATE UNIQUE INDEX sessions_login ON sessions (login, id);
+	CREATE INDEX sessions_expires ON sessions (expires);
+	INSERT INTO sessions (token, id, login, created, expires)
+		SELECT value, lower(hex(randomblob(8))), login, strftime('%Y-%m-%d %H:%M:%f000000', 'now'), expires
+		FROM cookies WHERE expires > strftime('%Y-%m-%d %H:%M:%f000000', 'now');
+	DROP TABLE cookies;`,
+
+	// Sessions are hashed by the server (HashSessionTokens), which holds the secret
+	`ALTER TABLE sessions RENAME TO unhashed_sessions;
+	DROP INDEX sessions_login;
+	DROP INDEX sessions_expires;
+	CREATE TABLE sessions (
+		token_hash TEXT PRIMARY KEY, -- Keyed hash of the cookie value
+		id         TEXT NOT NULL,
+		login      TEXT NOT NULL,
+		created    TEXT NOT NULL,
+		expires    TEXT NOT NULL,
+		last_seen  TEXT, -- NULL if unknown
+		user_agent TEXT NOT NULL DEFAULT '',
+		ip         TEXT NOT NULL DEFAULT ''
+	);
+	CREATE UNIQUE INDEX sessions_login ON sessions (login, id);
+	CREATE INDEX sessions_expires ON sessions (expires);`,
+
+	`ALTER TABLE api_tokens ADD COLUMN login TEXT NOT NULL DEFAULT ''; -- Owner of a personal API key
+	CREATE INDEX api_tokens_login ON api_tokens (login);`,
+
+	// Users of an OpenID Connect provider have an empty password hash
+	`ALTER TABLE users ADD COLUMN oidc_subject TEXT NOT NULL DEFAULT '';`,
+}
+
+const sqliteSessionColumns = "token_hash, id, login, created, expires, last_seen, user_agent, ip"
+
+// Sessions of unhashed_sessions, stored with their token instead of its hash
+const sqliteUnhashedSessionColumns = "token, id, login, created, expires, last_seen, user_agent, ip"
+
+const sqliteTokenColumns = "id, name, login, scopes, hashed_secret, created, expires, last_used"
+
+const sqlitePostColumns = "id, time, login, info, message, raw_message, refs, edited, deleted"
+
+// SQLiteStore is a Store backed by a SQLite database
+// Unlike bbolt, the database can be read by other processes while the server runs
+type SQLiteStore struct {
+	DB *sql.DB
+}
+
+// NewSQLiteStore opens (creating it with mode if needed) a SQLite database and updates its schema
+func NewSQLiteStore(path string, mode os.FileMode) (*SQLiteStore, error) {
+
+	// SQLite creates its journal files with the database file permissions
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+
+	// Immediate transactions avoid deadlocks between transactions reading then writing
+	db, err := sql.Open("sqlite", "file:"+path+
+		"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SQLiteStore{DB: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate applies the missing schema migrations
+func (s *SQLiteStore) migrate() error {
+	var version int
+	if err := s.DB.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(sqliteSchema); version++ {
+		tx, err := s.DB.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteSchema[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("schema migration %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying database
+func (s *SQLiteStore) Close() error {
+	return s.DB.Close()
+}
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+func parseSQLiteTime(s string) (time.Time, error) {
+	return time.ParseInLocation(sqliteTimeFormat, s, time.UTC)
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPost(row rowScanner) (p goboardbackend.Post, err error) {
+	var t string
+	var refs, edited, deleted sql.NullString
+
+	if err = row.Scan(&p.ID, &t, &p.Login, &p.Info, &p.Message, &p.RawMessage, &refs, &edited, &deleted); err != nil {
+		return
+	}
+	if p.Time.Time, err = parseSQLiteTime(t); err != nil {
+		return
+	}
+	if edited.Valid {
+		p.Edited = &goboardbackend.PostTime{}
+		if p.Edited.Time, err = parseSQLiteTime(edited.String); err != nil {
+			return
+		}
+	}
+	if deleted.Valid {
+		if err = json.Unmarshal([]byte(deleted.String), &p.Deleted); err != nil {
+			return
+		}
+	}
+	if refs.Valid {
+		err = json.Unmarshal([]byte(refs.String), &p.Refs)
+	}
+	return
+}
+
+func scanPosts(rows *sql.Rows) (posts []goboardbackend.Post, err error) {
+	defer rows.Close()
+
+	for rows.Next() {
+		var p goboardbackend.Post
+		if p, err = scanPost(rows); err != nil {
+			return
+		}
+		posts = append(posts, p)
+	}
+	err = rows.Err()
+	return
+}
+
+// postRow returns the refs, edited and deleted columns of a post
+func postRow(p goboardbackend.Post) (refs sql.NullString, edited sql.NullString, deleted sql.NullString, err error) {
+	if len(p.Refs) > 0 {
+		var buf []byte
+		if buf, err = json.Marshal(p.Refs); err != nil {
+			return
+		}
+		refs = sql.NullString{String: string(buf), Valid: true}
+	}
+	if p.Edited != nil {
+		edited = sql.NullString{String: sqliteTime(p.Edited.Time), Valid: true}
+	}
+	if p.Deleted != nil {
+		var buf []byte
+		if buf, err = json.Marshal(p.Deleted); err != nil {
+			return
+		}
+		deleted = sql.NullString{String: string(buf), Valid: true}
+	}
+	return
+}
+
+// insertPost stores a post with its replies and search index entries
+func insertPost(tx *sql.Tx, board string, p goboardbackend.Post) error {
+	refs, edited, deleted, err := postRow(p)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`INSERT INTO posts (board, `+sqlitePostColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		board, p.ID, sqliteTime(p.Time.Time), p.Login, p.Info, p.Message, p.RawMessage, refs, edited, deleted); err != nil {
+		return err
+	}
+
+	if err := insertReplies(tx, board, p); err != nil {
+		return err
+	}
+	return indexSQLitePost(tx, board, p)
+}
+
+func insertReplies(tx *sql.Tx, board string, p goboardbackend.Post) error {
+	for _, ref := range p.Refs {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO replies (board, post_id, reply_id) VALUES (?, ?, ?)`,
+			board, ref, p.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexSQLitePost adds a post to the search index (tombstones are not indexed)
+func indexSQLitePost(tx *sql.Tx, board string, p goboardbackend.Post) error {
+	if p.Deleted != nil {
+		return nil
+	}
+	for _, t := range goboardbackend.SearchTerms(p.Message) {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO search_terms (board, term, post_id) VALUES (?, ?, ?)`,
+			board, t, p.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postsInRange finds posts in range for norloge resolution
+func postsInRange(tx *sql.Tx, board string) goboardbackend.PostsInRange {
+	return func(start time.Time, end time.Time) (ids []uint64, err error) {
+		rows, err := tx.Query(`SELECT id FROM posts WHERE board = ? AND time >= ? AND time < ? ORDER BY id`,
+			board, sqliteTime(start), sqliteTime(end))
+		if err != nil {
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id uint64
+			if err = rows.Scan(&id); err != nil {
+				return
+			}
+			ids = append(ids, id)
+		}
+		err = rows.Err()
+		return
+	}
+}
+
+// PostMessage stores a new post
+func (s *SQLiteStore) PostMessage(board string, post goboardbackend.Post, loc *time.Location) (postID uint64, err error) {
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	post.Refs = nil
+	if norloges := goboardbackend.ParseNorloges(post.Message); len(norloges) > 0 {
+		if post.Refs, err = goboardbackend.ResolveNorloges(norloges, post.Time.Time, loc, postsInRange(tx, board)); err != nil {
+			return
+		}
+	}
+
+	if err = tx.QueryRow(`INSERT INTO boards (board, seq) VALUES (?, 1)
+		ON CONFLICT (board) DO UPDATE SET seq = seq + 1 RETURNING seq`, board).Scan(&postID); err != nil {
+		return
+	}
+	post.ID = postID
+
+	if err = insertPost(tx, board, post); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	goboardbackend.NotifyPost(board, postID)
+	return
+}
+
+// DeletePost turns a post into a tombstone
+func (s *SQLiteStore) DeletePost(board string, id uint64, mod goboardbackend.Moderation) (goboardbackend.Post, error) {
+	return s.moderatePost(board, id, goboardbackend.ModDelete, mod)
+}
+
+// RestorePost brings a tombstone back to life
+func (s *SQLiteStore) RestorePost(board string, id uint64, mod goboardbackend.Moderation) (goboardbackend.Post, error) {
+	return s.moderatePost(board, id, goboardbackend.ModRestore, mod)
+}
+
+// moderatePost deletes or restores a post and logs it in the moderation log
+func (s *SQLiteStore) moderatePost(board string, id uint64, action string, mod goboardbackend.Moderation) (goboardbackend.Post, error) {
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return goboardbackend.Post{}, err
+	}
+	defer tx.Rollback()
+
+	post, err := scanPost(tx.QueryRow(`SELECT `+sqlitePostColumns+` FROM posts WHERE board = ? AND id = ?`, board, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return goboardbackend.Post{}, nil
+	} else if err != nil {
+		return goboardbackend.Post{}, err
+	}
+
+	switch {
+	case action == goboardbackend.ModDelete && post.Deleted != nil:
+		return goboardbackend.Post{}, goboardbackend.ErrPostDeleted
+	case action == goboardbackend.ModRestore && post.Deleted == nil:
+		return goboardbackend.Post{}, goboardbackend.ErrPostNotDeleted
+	}
+
+	if err := moderateSQLitePost(tx, board, &post, action, mod); err != nil {
+		return goboardbackend.Post{}, err
+	}
+	return post, tx.Commit()
+}
+
+// moderateSQLitePost deletes or restores a post and logs it in the moderation log
+func moderateSQLitePost(tx *sql.Tx, board string, post *goboardbackend.Post, action string, mod goboardbackend.Moderation) error {
+	if action == goboardbackend.ModDelete {
+		if _, err := tx.Exec(`DELETE FROM search_terms WHERE board = ? AND post_id = ?`, board, post.ID); err != nil {
+			return err
+		}
+		post.Deleted = &mod
+	} else {
+		post.Deleted = nil
+		if err := indexSQLitePost(tx, board, *post); err != nil {
+			return err
+		}
+	}
+
+	_, _, deleted, err := postRow(*post)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE posts SET deleted = ? WHERE board = ? AND id = ?`, deleted, board, post.ID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO modlog (board, id, time, action, post_id, moderator, reason)
+		SELECT ?1, COALESCE(MAX(id), 0) + 1, ?2, ?3, ?4, ?5, ?6 FROM modlog WHERE board = ?1`,
+		board, sqliteTime(mod.Time.Time), action, post.ID, mod.By, mod.Reason)
+	return err
+}
+
+// DeleteMatchingPosts turns the posts matching a filter into tombstones
+func (s *SQLiteStore) DeleteMatchingPosts(board string, f goboardbackend.PostFilter, mod goboardbackend.Moderation, dryRun bool) (ids []uint64, err error) {
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	q := `SELECT ` + sqlitePostColumns + ` FROM posts WHERE board = ? AND deleted IS NULL AND id >= ?`
+	args := []any{board, f.FromID}
+	if f.ToID > 0 {
+		q += ` AND id <= ?`
+		args = append(args, f.ToID)
+	}
+	if len(f.Login) > 0 {
+		q += ` AND login = ?`
+		args = append(args, f.Login)
+	}
+	if !f.From.IsZero() {
+		q += ` AND time >= ?`
+		args = append(args, sqliteTime(f.From))
+	}
+	if !f.To.IsZero() {
+		q += ` AND time <= ?`
+		args = append(args, sqliteTime(f.To))
+	}
+	q += ` ORDER BY id`
+
+	rows, err := tx.Query(q, args...)
+	if err != nil {
+		return
+	}
+	posts, err := scanPosts(rows)
+	if err != nil {
+		return
+	}
+
+	for i := range posts {
+		// Info is matched here as LIKE is case insensitive
+		if !f.Match(posts[i]) {
+			continue
+		}
+		ids = append(ids, posts[i].ID)
+		if dryRun {
+			continue
+		}
+		if err = moderateSQLitePost(tx, board, &posts[i], goboardbackend.ModDelete, mod); err != nil {
+			return
+		}
+	}
+
+	if !dryRun {
+		err = tx.Commit()
+	}
+	return
+}
+
+// GetModLog returns a page of the moderation log
+func (s *SQLiteStore) GetModLog(board string, limit int, before uint64) (entries []goboardbackend.ModLogEntry, err error) {
+	q := `SELECT id, time, action, post_id, moderator, reason FROM modlog WHERE board = ?`
+	args := []any{board}
+	if before > 0 {
+		q += ` AND id < ?`
+		args = append(args, before)
+	}
+	q += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.DB.Query(q, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e goboardbackend.ModLogEntry
+		var t string
+		if err = rows.Scan(&e.ID, &t, &e.Action, &e.PostID, &e.By, &e.Reason); err != nil {
+			return
+		}
+		if e.Time.Time, err = parseSQLiteTime(t); err != nil {
+			return
+		}
+		entries = append(entries, e)
+	}
+	err = rows.Err()
+	return
+}
+
+// PurgePosts removes posts
+func (s *SQLiteStore) PurgePosts(board string, ids []uint64) error {
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		for _, q := range []string{
+			// The post is removed from the refs of its replies
+			`UPDATE posts SET refs = NULLIF((SELECT json_group_array(value) FROM json_each(posts.refs) WHERE value != ?2), '[]')
+				WHERE board = ?1 AND id IN (SELECT reply_id FROM replies WHERE board = ?1 AND post_id = ?2)`,
+			`DELETE FROM replies WHERE board = ?1 AND (reply_id = ?2 OR post_id = ?2)`,
+			`DELETE FROM search_terms WHERE board = ?1 AND post_id = ?2`,
+			`DELETE FROM revisions WHERE board = ?1 AND post_id = ?2`,
+			`DELETE FROM posts WHERE board = ?1 AND id = ?2`,
+		} {
+			if _, err := tx.Exec(q, board, id); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// GetPost returns a post
+func (s *SQLiteStore) GetPost(board string, id uint64) (goboardbackend.Post, error) {
+	p, err := scanPost(s.DB.QueryRow(`SELECT `+sqlitePostColumns+` FROM posts WHERE board = ? AND id = ?`, board, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return goboardbackend.Post{}, nil
+	}
+	return p, err
+}
+
+// GetHistory returns a page of posts
+func (s *SQLiteStore) GetHistory(board string, limit int, last uint64, before uint64) ([]goboardbackend.Post, error) {
+	q := `SELECT ` + sqlitePostColumns + ` FROM posts WHERE board = ? AND id > ?`
+	args := []any{board, last}
+	if before > 0 {
+		q += ` AND id < ?`
+		args = append(args, before)
+	}
+	q += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.DB.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	posts, err := scanPosts(rows)
+	if posts == nil {
+		posts = []goboardbackend.Post{}
+	}
+	return posts, err
+}
+
+// GetOldest returns a page of posts, oldest first
+func (s *SQLiteStore) GetOldest(board string, limit int, after uint64) ([]goboardbackend.Post, error) {
+	rows, err := s.DB.Query(`SELECT `+sqlitePostColumns+` FROM posts WHERE board = ? AND id > ? ORDER BY id LIMIT ?`,
+		board, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanPosts(rows)
+}
+
+// CountPosts returns the number of posts of a board
+func (s *SQLiteStore) CountPosts(board string) (count int, err error) {
+	err = s.DB.QueryRow(`SELECT COUNT(*) FROM posts WHERE board = ?`, board).Scan(&count)
+	return
+}
+
+// GetArchive returns the posts made in a time range
+func (s *SQLiteStore) GetArchive(board string, start time.Time, end time.Time) ([]goboardbackend.Post, error) {
+	rows, err := s.DB.Query(`SELECT `+sqlitePostColumns+` FROM posts
+		WHERE board = ? AND time >= ? AND time < ? ORDER BY id DESC`,
+		board, sqliteTime(start), sqliteTime(end))
+	if err != nil {
+		return nil, err
+	}
+	return scanPosts(rows)
+}
+
+// EditPost replaces the message of a post
+func (s *SQLiteStore) EditPost(board string, id uint64, message string, rawMessage string, editTime time.Time, loc *time.Location) (goboardbackend.Post, error) {
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return goboardbackend.Post{}, err
+	}
+	defer tx.Rollback()
+
+	old, err := scanPost(tx.QueryRow(`SELECT `+sqlitePostColumns+` FROM posts WHERE board = ? AND id = ?`, board, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return goboardbackend.Post{}, nil
+	} else if err != nil {
+		return goboardbackend.Post{}, err
+	}
+	if old.Deleted != nil {
+		return goboardbackend.Post{}, goboardbackend.ErrPostDeleted
+	}
+
+	post := old
+	if err := post.Edit(message, rawMessage, editTime, loc, postsInRange(tx, board)); err != nil {
+		return goboardbackend.Post{}, err
+	}
+
+	var n uint64
+	if err := tx.QueryRow(`SELECT COUNT(*) + 1 FROM revisions WHERE board = ? AND post_id = ?`, board, id).Scan(&n); err != nil {
+		return goboardbackend.Post{}, err
+	}
+	if err := insertRevision(tx, board, id, old.Revision(n)); err != nil {
+		return goboardbackend.Post{}, err
+	}
+
+	refs, edited, _, err := postRow(post)
+	if err != nil {
+		return goboardbackend.Post{}, err
+	}
+	for _, q := range []string{
+		`DELETE FROM replies WHERE board = ?1 AND reply_id = ?2`,
+		`DELETE FROM search_terms WHERE board = ?1 AND post_id = ?2`,
+	} {
+		if _, err := tx.Exec(q, board, id); err != nil {
+			return goboardbackend.Post{}, err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE posts SET message = ?, raw_message = ?, refs = ?, edited = ? WHERE board = ? AND id = ?`,
+		post.Message, post.RawMessage, refs, edited, board, id); err != nil {
+		return goboardbackend.Post{}, err
+	}
+	if err := insertReplies(tx, board, post); err != nil {
+		return goboardbackend.Post{}, err
+	}
+	if err := indexSQLitePost(tx, board, post); err != nil {
+		return goboardbackend.Post{}, err
+	}
+
+	return post, tx.Commit()
+}
+
+func insertRevision(tx *sql.Tx, board string, id uint64, rev goboardbackend.PostRevision) error {
+	_, err := tx.Exec(`INSERT INTO revisions (board, post_id, number, time, message, raw_message) VALUES (?, ?, ?, ?, ?, ?)`,
+		board, id, rev.Number, sqliteTime(rev.Time.Time), rev.Message, rev.RawMessage)
+	return err
+}
+
+// GetRevisions returns the previous versions of a post
+func (s *SQLiteStore) GetRevisions(board string, id uint64) (revs []goboardbackend.PostRevision, err error) {
+	rows, err := s.DB.Query(`SELECT number, time, message, raw_message FROM revisions
+		WHERE board = ? AND post_id = ? ORDER BY number`, board, id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rev goboardbackend.PostRevision
+		var t string
+		if err = rows.Scan(&rev.Number, &t, &rev.Message, &rev.RawMessage); err != nil {
+			return
+		}
+		if rev.Time.Time, err = parseSQLiteTime(t); err != nil {
+			return
+		}
+		revs = append(revs, rev)
+	}
+	err = rows.Err()
+	return
+}
+
+// GetReplies returns the posts referencing a post
+func (s *SQLiteStore) GetReplies(board string, id uint64) ([]goboardbackend.Post, error) {
+	rows, err := s.DB.Query(`SELECT `+sqlitePostColumns+` FROM posts
+		WHERE board = ? AND id IN (SELECT reply_id FROM replies WHERE board = ? AND post_id = ?)
+		ORDER BY id DESC`, board, board, id)
+	if err != nil {
+		return nil, err
+	}
+	return scanPosts(rows)
+}
+
+// Search returns the posts matching a query
+func (s *SQLiteStore) Search(board string, q goboardbackend.SearchQuery, limit int) ([]goboardbackend.Post, error) {
+
+	terms := goboardbackend.SearchTerms(q.Text)
+	if len(terms) == 0 || limit <= 0 {
+		return nil, nil
+	}
+
+	query := `SELECT ` + sqlitePostColumns + ` FROM posts WHERE board = ? AND id IN (
+		SELECT post_id FROM search_terms WHERE board = ? AND term IN (?` + strings.Repeat(", ?", len(terms)-1) + `)
+		GROUP BY post_id HAVING COUNT(*) = ?)`
+	args := []any{board, board}
+	for _, t := range terms {
+		args = append(args, t)
+	}
+	args = append(args, len(terms))
+
+	if len(q.Login) > 0 {
+		query += ` AND login = ?`
+		args = append(args, q.Login)
+	}
+	if !q.From.IsZero() {
+		query += ` AND time >= ?`
+		args = append(args, sqliteTime(q.From))
+	}
+	if !q.To.IsZero() {
+		query += ` AND time <= ?`
+		args = append(args, sqliteTime(q.To))
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanPosts(rows)
+}
+
+// RebuildSearchIndex indexes the whole history again
+func (s *SQLiteStore) RebuildSearchIndex(board string) (count int, err error) {
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`DELETE FROM search_terms WHERE board = ?`, board); err != nil {
+		return
+	}
+
+	rows, err := tx.Query(`SELECT `+sqlitePostColumns+` FROM posts WHERE board = ? ORDER BY id`, board)
+	if err != nil {
+		return
+	}
+	posts, err := scanPosts(rows)
+	if err != nil {
+		return
+	}
+
+	for _, p := range posts {
+		if err = indexSQLitePost(tx, board, p); err != nil {
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return len(posts), nil
+}
+
+// AddUser creates a user
+func (s *SQLiteStore) AddUser(login string, password string) error {
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return goboarduser.NewError(err, goboarduser.DatabaseError)
+	}
+
+	return s.addUser(goboarduser.User{Login: login, HashedPassword: hashedPassword, CreationDate: time.Now(), Role: goboarduser.RoleUser})
+}
+
+// AddOIDCUser creates a user authenticated by an OpenID Connect provider, without password
+func (s *SQLiteStore) AddOIDCUser(login string, subject string) error {
+	return s.addUser(goboarduser.User{Login: login, HashedPassword: []byte{}, CreationDate: time.Now(), Role: goboarduser.RoleUser, OIDCSubject: subject})
+}
+
+func (s *SQLiteStore) addUser(user goboarduser.User) error {
+
+	res, err := s.DB.Exec(`INSERT INTO users (login, hashed_password, creation_date, role, oidc_subject) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (login) DO NOTHING`, user.Login, user.HashedPassword, sqliteTime(user.CreationDate), user.Role, user.OIDCSubject)
+	if err != nil {
+		return goboarduser.NewError(err, goboarduser.DatabaseError)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return goboarduser.NewError(fmt.Errorf("User already exists"), goboarduser.UserAlreadyExistsError)
+	}
+	return nil
+}
+
+// AuthUser checks a user password
+func (s *SQLiteStore) AuthUser(login string, password string) error {
+
+	var hashedPassword []byte
+	err := s.DB.QueryRow(`SELECT hashed_password FROM users WHERE login = ?`, login).Scan(&hashedPassword)
+	if errors.Is(err, sql.ErrNoRows) {
+		return goboarduser.NewError(fmt.Errorf("authentification failed"), goboarduser.AuthenticationFailed)
+	} else if err != nil {
+		return goboarduser.NewError(err, goboarduser.DatabaseError)
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hashedPassword, []byte(password)); err != nil {
+		return goboarduser.NewError(err, goboarduser.AuthenticationFailed)
+	}
+	return nil
+}
+
+// DeleteUser removes a user
+func (s *SQLiteStore) DeleteUser(login string) error {
+
+	res, err := s.DB.Exec(`DELETE FROM users WHERE login = ?`, login)
+	if err != nil {
+		return goboarduser.NewError(err, goboarduser.DatabaseError)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return goboarduser.NewError(fmt.Errorf("User does not exists"), goboarduser.UserDoesNotExistsError)
+	}
+	return nil
+}
+
+// GetUser returns a user
+func (s *SQLiteStore) GetUser(login string) (goboarduser.User, error) {
+
+	user := goboarduser.User{Login: login}
+
+	var creationDate string
+	err := s.DB.QueryRow(`SELECT creation_date, role, oidc_subject FROM users WHERE login = ?`, login).
+		Scan(&creationDate, &user.Role, &user.OIDCSubject)
+	if errors.Is(err, sql.ErrNoRows) {
+		return goboarduser.User{}, goboarduser.NewError(fmt.Errorf("User does not exists"), goboarduser.UserDoesNotExistsError)
+	} else if err != nil {
+		return goboarduser.User{}, goboarduser.NewError(err, goboarduser.DatabaseError)
+	}
+
+	if user.CreationDate, err = parseSQLiteTime(creationDate); err != nil {
+		return goboarduser.User{}, goboarduser.NewError(err, goboarduser.DatabaseError)
+	}
+	return user, nil
+}
+
+// SetUserRole changes the role of a user
+func (s *SQLiteStore) SetUserRole(login string, role string) error {
+
+	res, err := s.DB.Exec(`UPDATE users SET role = ? WHERE login = ?`, role, login)
+	if err != nil {
+		return goboarduser.NewError(err, goboarduser.DatabaseError)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return goboarduser.NewError(fmt.Errorf("User does not exists"), goboarduser.UserDoesNotExistsError)
+	}
+	return nil
+}
+
+// SetPassword replaces the password of a user
+func (s *SQLiteStore) SetPassword(login string, password string) error {
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return goboarduser.NewError(err, goboarduser.DatabaseError)
+	}
+
+	res, err := s.DB.Exec(`UPDATE users SET hashed_password = ? WHERE login = ?`, hashedPassword, login)
+	if err != nil {
+		return goboarduser.NewError(err, goboarduser.DatabaseError)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return goboarduser.NewError(fmt.Errorf("User does not exists"), goboarduser.UserDoesNotExistsError)
+	}
+	return nil
+}
+
+// AddSession stores a new session
+func (s *SQLiteStore) AddSession(session goboardsession.Session) error {
+	_, err := s.DB.Exec(`INSERT INTO sessions (`+sqliteSessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.TokenHash, session.ID, session.Login, sqliteTime(session.Created), sqliteTime(session.Expires),
+		nullSQLiteTime(session.LastSeen), session.UserAgent, session.IP)
+	return err
+}
+
+// GetSession returns the session of a token hash
+func (s *SQLiteStore) GetSession(tokenHash string) (goboardsession.Session, error) {
+
+	session, err := scanSession(s.DB.QueryRow(`SELECT `+sqliteSessionColumns+` FROM sessions WHERE token_hash = ? AND expires > ?`,
+		tokenHash, sqliteTime(time.Now())))
+	if errors.Is(err, sql.ErrNoRows) {
+		return goboardsession.Session{}, goboardsession.ErrSessionNotFound
+	}
+	return session, err
+}
+
+// TouchSession records the last activity of a session
+func (s *SQLiteStore) TouchSession(tokenHash string, seen time.Time, ip string) error {
+	_, err := s.DB.Exec(`UPDATE sessions SET last_seen = ?, ip = ? WHERE token_hash = ?`, sqliteTime(seen), ip, tokenHash)
+	return err
+}
+
+// GetSessions returns the sessions of a user, oldest first
+func (s *SQLiteStore) GetSessions(login string) (sessions []goboardsession.Session, err error) {
+
+	rows, err := s.DB.Query(`SELECT `+sqliteSessionColumns+` FROM sessions WHERE login = ? AND expires > ? ORDER BY created`,
+		login, sqliteTime(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSession revokes a session of a user
+func (s *SQLiteStore) DeleteSession(login string, id string) error {
+
+	res, err := s.DB.Exec(`DELETE FROM sessions WHERE login = ? AND id = ?`, login, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return goboardsession.ErrSessionNotFound
+	}
+	return nil
+}
+
+// DeleteSessionsForUser revokes every session of a user
+func (s *SQLiteStore) DeleteSessionsForUser(login string) error {
+	_, err := s.DB.Exec(`DELETE FROM sessions WHERE login = ?`, login)
+	return err
+}
+
+// DeleteExpiredSessions removes the expired sessions
+func (s *SQLiteStore) DeleteExpiredSessions(now time.Time) (int, error) {
+
+	res, err := s.DB.Exec(`DELETE FROM sessions WHERE expires <= ?`, sqliteTime(now))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// HashSessionTokens moves the sessions of unhashed_sessions to sessions, replacing their tokens by their hashes
+// Expired sessions are dropped, the database is vacuumed if sessions were hashed. Returns the number of sessions hashed
+func (s *SQLiteStore) HashSessionTokens(h goboardsession.Hasher) (int, error) {
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT `+sqliteUnhashedSessionColumns+` FROM unhashed_sessions WHERE expires > ?`, sqliteTime(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	var sessions []goboardsession.Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		// The token is read in place of the hash
+		session.Token, session.TokenHash = session.TokenHash, ""
+		sessions = append(sessions, session)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, session := range sessions {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO sessions (`+sqliteSessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			h.Hash(session.Token), session.ID, session.Login, sqliteTime(session.Created), sqliteTime(session.Expires),
+			nullSQLiteTime(session.LastSeen), session.UserAgent, session.IP); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM unhashed_sessions`); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	// Deleted rows stay in free pages and in the WAL until they are reused
+	if len(sessions) > 0 {
+		if _, err := s.DB.Exec(`VACUUM`); err != nil {
+			return 0, err
+		}
+		if _, err := s.DB.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+			return 0, err
+		}
+	}
+	return len(sessions), nil
+}
+
+func scanSession(row rowScanner) (session goboardsession.Session, err error) {
+	var created, expires string
+	var lastSeen sql.NullString
+
+	if err = row.Scan(&session.TokenHash, &session.ID, &session.Login, &created, &expires, &lastSeen, &session.UserAgent, &session.IP); err != nil {
+		return
+	}
+	if session.Created, err = parseSQLiteTime(created); err != nil {
+		return
+	}
+	if session.Expires, err = parseSQLiteTime(expires); err != nil {
+		return
+	}
+	session.LastSeen, err = parseNullSQLiteTime(lastSeen)
+	return
+}
+
+// AddToken stores a new API token
+func (s *SQLiteStore) AddToken(t goboardtoken.APIToken) error {
+
+	scopes, err := json.Marshal(t.Scopes)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.Exec(`INSERT INTO api_tokens (`+sqliteTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.ID, t.Name, t.Login, string(scopes), t.HashedSecret, sqliteTime(t.Created), nullSQLiteTime(t.Expires), nullSQLiteTime(t.LastUsed))
+	return err
+}
+
+// GetToken returns an API token
+func (s *SQLiteStore) GetToken(id string) (goboardtoken.APIToken, error) {
+
+	t, err := scanToken(s.DB.QueryRow(`SELECT `+sqliteTokenColumns+` FROM api_tokens WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return goboardtoken.APIToken{}, goboardtoken.ErrTokenNotFound
+	}
+	return t, err
+}
+
+// GetTokens returns every API token, oldest first
+func (s *SQLiteStore) GetTokens() (tokens []goboardtoken.APIToken, err error) {
+
+	rows, err := s.DB.Query(`SELECT ` + sqliteTokenColumns + ` FROM api_tokens ORDER BY created`)
+	if err != nil {
+		return nil, err
+	}
+	return scanTokens(rows)
+}
+
+// GetTokensForUser returns the personal API keys of login, oldest first
+func (s *SQLiteStore) GetTokensForUser(login string) (tokens []goboardtoken.APIToken, err error) {
+
+	rows, err := s.DB.Query(`SELECT `+sqliteTokenColumns+` FROM api_tokens WHERE login = ? ORDER BY created`, login)
+	if err != nil {
+		return nil, err
+	}
+	return scanTokens(rows)
+}
+
+// DeleteToken revokes an API token
+func (s *SQLiteStore) DeleteToken(id string) error {
+
+	res, err := s.DB.Exec(`DELETE FROM api_tokens WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return goboardtoken.ErrTokenNotFound
+	}
+	return nil
+}
+
+// DeleteTokensForUser revokes every personal API key of login
+func (s *SQLiteStore) DeleteTokensForUser(login string) error {
+	_, err := s.DB.Exec(`DELETE FROM api_tokens WHERE login = ?`, login)
+	return err
+}
+
+// TouchToken records the last use of an API token
+func (s *SQLiteStore) TouchToken(id string, lastUsed time.Time) error {
+	_, err := s.DB.Exec(`UPDATE api_tokens SET last_used = ? WHERE id = ?`, sqliteTime(lastUsed), id)
+	return err
+}
+
+func scanTokens(rows *sql.Rows) (tokens []goboardtoken.APIToken, err error) {
+	defer rows.Close()
+
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func scanToken(row rowScanner) (t goboardtoken.APIToken, err error) {
+	var scopes, created string
+	var expires, lastUsed sql.NullString
+
+	if err = row.Scan(&t.ID, &t.Name, &t.Login, &scopes, &t.HashedSecret, &created, &expires, &lastUsed); err != nil {
+		return
+	}
+	if err = json.Unmarshal([]byte(scopes), &t.Scopes); err != nil {
+		return
+	}
+	if t.Created, err = parseSQLiteTime(created); err != nil {
+		return
+	}
+	if t.Expires, err = parseNullSQLiteTime(expires); err != nil {
+		return
+	}
+	t.LastUsed, err = parseNullSQLiteTime(lastUsed)
+	return
+}
+
+func nullSQLiteTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: sqliteTime(*t), Valid: true}
+}
+
+func parseNullSQLiteTime(s sql.NullString) (*time.Time, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	t, err := parseSQLiteTime(s.String)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+/******************************************************************
+ *             Import (database migrations)
+ ******************************************************************/
+
+// ImportPosts stores posts keeping their ids and references, replacing the posts with the same ids
+func (s *SQLiteStore) ImportPosts(board string, posts []goboardbackend.Post) error {
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, p := range posts {
+		// A replaced post leaves neither its refs nor its terms behind
+		for _, q := range []string{
+			`DELETE FROM replies WHERE board = ?1 AND reply_id = ?2`,
+			`DELETE FROM search_terms WHERE board = ?1 AND post_id = ?2`,
+			`DELETE FROM posts WHERE board = ?1 AND id = ?2`,
+		} {
+			if _, err := tx.Exec(q, board, p.ID); err != nil {
+				return fmt.Errorf("post %d: %w", p.ID, err)
+			}
+		}
+		if err := insertPost(tx, board, p); err != nil {
+			return fmt.Errorf("post %d: %w", p.ID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// SetSequence sets the last allocated post id of a board
+func (s *SQLiteStore) SetSequence(board string, seq uint64) error {
+	_, err := s.DB.Exec(`INSERT INTO boards (board, seq) VALUES (?, ?)
+		ON CONFLICT (board) DO UPDATE SET seq = excluded.seq`, board, seq)
+	return err
+}
+
+// ImportRevision stores a revision of a post
+func (s *SQLiteStore) ImportRevision(board string, id uint64, rev goboardbackend.PostRevision) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertRevision(tx, board, id, rev); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ImportModLogEntry stores a moderation log entry keeping its id
+func (s *SQLiteStore) ImportModLogEntry(board string, e goboardbackend.ModLogEntry) error {
+	_, err := s.DB.Exec(`INSERT INTO modlog (board, id, time, action, post_id, moderator, reason) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		board, e.ID, sqliteTime(e.Time.Time), e.Action, e.PostID, e.By, e.Reason)
+	return err
+}
+
+// ImportUser stores a user with its password hash
+func (s *SQLiteStore) ImportUser(user goboarduser.User) error {
+	role := user.Role
+	if len(role) == 0 {
+		role = goboarduser.RoleUser
+	}
+	hashedPassword := user.HashedPassword
+	if hashedPassword == nil {
+		hashedPassword = []byte{}
+	}
+	_, err := s.DB.Exec(`INSERT INTO users (login, hashed_password, creation_date, role, oidc_subject) VALUES (?, ?, ?, ?, ?)`,
+		user.Login, hashedPassword, sqliteTime(user.CreationDate), role, user.OIDCSubject)
+	return err
+}
+
+// ImportSession stores a session, already stored ones are skipped
+// Sessions not hashed yet are kept apart until the server hashes them (see HashSessionTokens)
+func (s *SQLiteStore) ImportSession(session goboardsession.Session) error {
+	table, columns, key := "sessions", sqliteSessionColumns, session.TokenHash
+	if !session.Hashed() {
+		table, columns, key = "unhashed_sessions", sqliteUnhashedSessionColumns, session.Token
+	}
+	_, err := s.DB.Exec(`INSERT OR IGNORE INTO `+table+` (`+columns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		key, session.ID, session.Login, sqliteTime(session.Created), sqliteTime(session.Expires),
+		nullSQLiteTime(session.LastSeen), session.UserAgent, session.IP)
+	return err
+}
+
+// ImportToken stores an API token, hashed secret included
+func (s *SQLiteStore) ImportToken(t goboardtoken.APIToken) error {
+	return s.AddToken(t)
+}
@@ -0,0 +1,133 @@
+// Package store defines the storage used by goboard handlers and its implementations
+package store
+
+import (
+	"io"
+	"time"
+
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+	goboardsession "github.com/dguihal/goboard/internal/session"
+	goboardtoken "github.com/dguihal/goboard/internal/token"
+	goboarduser "github.com/dguihal/goboard/internal/user"
+)
+
+// Store gathers every storage operation of a board server
+type Store interface {
+	PostStore
+	UserStore
+	SessionStore
+	TokenStore
+
+	// Close releases the storage resources
+	Close() error
+}
+
+// PostStore stores the posts of every board
+// Board is the storage key of a board (goboardbackend.DefaultBoard for the default one)
+type PostStore interface {
+	// PostMessage stores a new post, resolving its norloges in loc, and returns its id
+	PostMessage(board string, post goboardbackend.Post, loc *time.Location) (uint64, error)
+	// DeletePost turns a post into a tombstone and logs it in the moderation log
+	// It returns the tombstone, with a 0 ID if the post does not exist (goboardbackend.ErrPostDeleted if already deleted)
+	DeletePost(board string, id uint64, mod goboardbackend.Moderation) (goboardbackend.Post, error)
+	// DeleteMatchingPosts turns the posts matching a filter into tombstones in a single transaction, logging each one
+	// Already deleted posts are skipped, nothing is deleted if dryRun is set. It returns the matching ids, oldest first
+	DeleteMatchingPosts(board string, f goboardbackend.PostFilter, mod goboardbackend.Moderation, dryRun bool) ([]uint64, error)
+	// RestorePost brings a tombstone back to life and logs it in the moderation log
+	// It returns the restored post, with a 0 ID if the post does not exist (goboardbackend.ErrPostNotDeleted if not deleted)
+	RestorePost(board string, id uint64, mod goboardbackend.Moderation) (goboardbackend.Post, error)
+	// GetModLog returns up to limit moderation log entries (newest first) with ids lower than before (ignored if 0)
+	GetModLog(board string, limit int, before uint64) ([]goboardbackend.ModLogEntry, error)
+	// PurgePosts removes posts in a single transaction, without tombstones nor moderation log entries
+	// Purged posts are removed from the refs of their replies
+	PurgePosts(board string, ids []uint64) error
+	// GetPost returns a post, with a 0 ID if it does not exist
+	GetPost(board string, id uint64) (goboardbackend.Post, error)
+	// GetHistory returns up to limit posts (newest first) with ids in ]last, before[ (before ignored if 0)
+	GetHistory(board string, limit int, last uint64, before uint64) ([]goboardbackend.Post, error)
+	// GetOldest returns up to limit posts (oldest first) with ids greater than after
+	GetOldest(board string, limit int, after uint64) ([]goboardbackend.Post, error)
+	// CountPosts returns the number of posts of a board
+	CountPosts(board string) (int, error)
+	// GetArchive returns the posts made in [start, end[, newest first
+	GetArchive(board string, start time.Time, end time.Time) ([]goboardbackend.Post, error)
+	// EditPost replaces the message of a post, keeping its previous version as a revision
+	// It returns the updated post, with a 0 ID if it does not exist (goboardbackend.ErrPostDeleted on tombstones)
+	EditPost(board string, id uint64, message string, rawMessage string, editTime time.Time, loc *time.Location) (goboardbackend.Post, error)
+	// GetRevisions returns the previous versions of a post, oldest first
+	GetRevisions(board string, id uint64) ([]goboardbackend.PostRevision, error)
+	// GetReplies returns the posts referencing a post, newest first
+	GetReplies(board string, id uint64) ([]goboardbackend.Post, error)
+	// Search returns up to limit posts matching a query, newest first
+	Search(board string, q goboardbackend.SearchQuery, limit int) ([]goboardbackend.Post, error)
+	// RebuildSearchIndex indexes the whole history again and returns the number of posts indexed
+	RebuildSearchIndex(board string) (int, error)
+}
+
+// UserStore stores user accounts
+// Errors are *goboarduser.Error
+type UserStore interface {
+	AddUser(login string, password string) error
+	// AddOIDCUser creates a user authenticated by an OpenID Connect provider as subject, without password
+	AddOIDCUser(login string, subject string) error
+	AuthUser(login string, password string) error
+	DeleteUser(login string) error
+	// GetUser returns a user without its password hash
+	GetUser(login string) (goboarduser.User, error)
+	// SetUserRole changes the role of a user (one of the goboarduser.Role constants)
+	SetUserRole(login string, role string) error
+	// SetPassword replaces the password of a user
+	SetPassword(login string, password string) error
+}
+
+// SessionStore stores the sessions of logged in users, one per device
+// Sessions are identified by the hash of their token, tokens are never stored
+// Missing and expired sessions are reported as goboardsession.ErrSessionNotFound
+type SessionStore interface {
+	// AddSession stores a new session
+	AddSession(s goboardsession.Session) error
+	// GetSession returns the session of a token hash (see goboardsession.Hasher)
+	GetSession(tokenHash string) (goboardsession.Session, error)
+	// TouchSession records the last activity of a session, revoked sessions are ignored
+	TouchSession(tokenHash string, seen time.Time, ip string) error
+	// GetSessions returns the sessions of a user which are not expired, oldest first
+	GetSessions(login string) ([]goboardsession.Session, error)
+	// DeleteSession revokes a session of a user by its id
+	DeleteSession(login string, id string) error
+	// DeleteSessionsForUser revokes every session of a user
+	DeleteSessionsForUser(login string) error
+	// DeleteExpiredSessions removes the sessions expired at now and returns their number
+	DeleteExpiredSessions(now time.Time) (int, error)
+}
+
+// TokenStore stores API tokens
+// Missing tokens are reported as goboardtoken.ErrTokenNotFound
+type TokenStore interface {
+	// AddToken stores a new API token
+	AddToken(t goboardtoken.APIToken) error
+	// GetToken returns an API token, hashed secret included
+	GetToken(id string) (goboardtoken.APIToken, error)
+	// GetTokens returns every API token (oldest first), hashed secrets included
+	GetTokens() ([]goboardtoken.APIToken, error)
+	// GetTokensForUser returns the personal API keys of login (oldest first), hashed secrets included
+	GetTokensForUser(login string) ([]goboardtoken.APIToken, error)
+	// DeleteToken revokes an API token
+	DeleteToken(id string) error
+	// DeleteTokensForUser revokes every personal API key of login
+	DeleteTokensForUser(login string) error
+	// TouchToken records the last use of an API token, revoked tokens are ignored
+	TouchToken(id string, lastUsed time.Time) error
+}
+
+// Snapshotter is implemented by stores able to provide a consistent copy of their database
+type Snapshotter interface {
+	// Snapshot calls fn with a snapshot of the database, valid until fn returns
+	Snapshot(fn func(Snapshot) error) error
+}
+
+// Snapshot is a consistent copy of a database, it can be written several times
+type Snapshot interface {
+	// Size returns the size of the copy in bytes
+	Size() int64
+	WriteTo(w io.Writer) (int64, error)
+}
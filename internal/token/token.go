@@ -0,0 +1,276 @@
+// Package token provides management of API tokens in database
+package token
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	bolt "go.etcd.io/bbolt"
+)
+
+// API tokens: keys are the token ids
+const apiTokensBucketName string = "APITokens"
+
+// A list of API token scopes
+const (
+	ScopePost       = "post"        // Post messages, signed with the token name (or its owner login)
+	ScopeAdminPosts = "admin:posts" // Moderate posts and rebuild search indexes
+	ScopeAdminUsers = "admin:users" // Manage users, API tokens and backups
+)
+
+var validScopes = map[string]bool{ScopePost: true, ScopeAdminPosts: true, ScopeAdminUsers: true}
+
+// LastUsedResolution is the minimum delay between two updates of the last use of a token
+// It avoids a database write on every authenticated request
+const LastUsedResolution = time.Minute
+
+const (
+	idLen     = 16
+	secretLen = 40
+)
+
+// Errors returned by API token operations
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrInvalidToken  = errors.New("invalid token")
+)
+
+// APIToken is a named API token, only the hash of its secret is stored
+// Tokens with a Login are the personal API keys of a user, created by the user
+type APIToken struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Login        string     `json:"login,omitempty"` // Owner of a personal API key
+	Scopes       []string   `json:"scopes"`
+	HashedSecret []byte     `json:"hashed_secret,omitempty"`
+	Created      time.Time  `json:"created"`
+	Expires      *time.Time `json:"expires,omitempty"`   // Never expires if nil
+	LastUsed     *time.Time `json:"last_used,omitempty"` // Never used if nil
+}
+
+// ValidScope tells if scope is a known scope
+func ValidScope(scope string) bool {
+	return validScopes[scope]
+}
+
+// New creates an API token (not stored) and returns it with its value, which is never stored
+// The value is the token id and its secret separated by a dot
+func New(name string, scopes []string, expires *time.Time) (t APIToken, value string) {
+	secret := uniuri.NewLen(secretLen)
+	hashed := sha256.Sum256([]byte(secret))
+
+	t = APIToken{
+		ID:           uniuri.NewLen(idLen),
+		Name:         name,
+		Scopes:       scopes,
+		HashedSecret: hashed[:],
+		Created:      time.Now(),
+		Expires:      expires,
+	}
+	return t, t.ID + "." + secret
+}
+
+// Parse splits a token value into its id and secret
+func Parse(value string) (id string, secret string, err error) {
+	id, secret, ok := strings.Cut(value, ".")
+	if !ok || len(id) == 0 || len(secret) == 0 {
+		return "", "", ErrInvalidToken
+	}
+	return id, secret, nil
+}
+
+// Check tells if secret is the token secret and the token is not expired at now
+func (t APIToken) Check(secret string, now time.Time) bool {
+	hashed := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(hashed[:], t.HashedSecret) != 1 {
+		return false
+	}
+	return t.Expires == nil || now.Before(*t.Expires)
+}
+
+// Author returns the login of the posts made with the token: its owner login, or its name
+func (t APIToken) Author() string {
+	if len(t.Login) > 0 {
+		return t.Login
+	}
+	return t.Name
+}
+
+// HasScope tells if the token is granted scope
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsTouch tells if the last use of the token has to be updated at now
+func (t APIToken) NeedsTouch(now time.Time) bool {
+	return t.LastUsed == nil || now.Sub(*t.LastUsed) >= LastUsedResolution
+}
+
+// AddToken stores a new API token
+func AddToken(db *bolt.DB, t APIToken) error {
+
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(apiTokensBucketName))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(t.ID), buf)
+	})
+}
+
+// GetToken returns an API token, ErrTokenNotFound if it does not exist
+func GetToken(db *bolt.DB, id string) (t APIToken, err error) {
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiTokensBucketName))
+		var v []byte
+		if b != nil {
+			v = b.Get([]byte(id))
+		}
+		if v == nil {
+			return ErrTokenNotFound
+		}
+		return json.Unmarshal(v, &t)
+	})
+	return
+}
+
+// GetTokens returns every API token, oldest first
+func GetTokens(db *bolt.DB) (tokens []APIToken, err error) {
+
+	err = ForEachToken(db, func(t APIToken) error {
+		tokens = append(tokens, t)
+		return nil
+	})
+	SortTokens(tokens)
+	return
+}
+
+// GetTokensForUser returns the personal API keys of login, oldest first
+func GetTokensForUser(db *bolt.DB, login string) (tokens []APIToken, err error) {
+
+	err = ForEachToken(db, func(t APIToken) error {
+		if t.Login == login {
+			tokens = append(tokens, t)
+		}
+		return nil
+	})
+	SortTokens(tokens)
+	return
+}
+
+// DeleteToken revokes an API token, ErrTokenNotFound if it does not exist
+func DeleteToken(db *bolt.DB, id string) error {
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiTokensBucketName))
+		if b == nil || b.Get([]byte(id)) == nil {
+			return ErrTokenNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// DeleteTokensForUser revokes every personal API key of login
+func DeleteTokensForUser(db *bolt.DB, login string) error {
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiTokensBucketName))
+		if b == nil {
+			return nil
+		}
+
+		var ids [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var t APIToken
+			if err := json.Unmarshal(v, &t); err == nil && t.Login == login {
+				ids = append(ids, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := b.Delete(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TouchToken records the last use of an API token, revoked tokens are ignored
+func TouchToken(db *bolt.DB, id string, lastUsed time.Time) error {
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiTokensBucketName))
+		var v []byte
+		if b != nil {
+			v = b.Get([]byte(id))
+		}
+		if v == nil {
+			return nil
+		}
+
+		var t APIToken
+		if err := json.Unmarshal(v, &t); err != nil {
+			return err
+		}
+		t.LastUsed = &lastUsed
+
+		buf, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), buf)
+	})
+}
+
+// ForEachToken calls fn for every API token, hashed secret included
+func ForEachToken(db *bolt.DB, fn func(APIToken) error) error {
+
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiTokensBucketName))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var t APIToken
+			if err := json.Unmarshal(v, &t); err != nil {
+				log.Printf("Could not unmarshal API token data, skipping: %v", err)
+				return nil
+			}
+			return fn(t)
+		})
+	})
+}
+
+// ImportToken stores an API token as is
+func ImportToken(db *bolt.DB, t APIToken) error {
+	return AddToken(db, t)
+}
+
+// SortTokens sorts tokens by creation date
+func SortTokens(tokens []APIToken) {
+	sort.SliceStable(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+}
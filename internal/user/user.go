@@ -27,13 +27,58 @@ type Error struct {
 
 func (e *Error) Error() string { return e.error.Error() }
 
+// NewError creates an Error with an error code
+func NewError(err error, errCode int) *Error { return &Error{error: err, ErrCode: errCode} }
+
+// A list of user roles, each one granting the rights of the previous ones
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator" // Can moderate posts
+	RoleAdmin     = "admin"     // Can also manage users and the server
+)
+
+var roleLevels = map[string]int{RoleUser: 1, RoleModerator: 2, RoleAdmin: 3}
+
+// ValidRole tells if role is a known role
+func ValidRole(role string) bool {
+	_, ok := roleLevels[role]
+	return ok
+}
+
 type User struct {
 	Login          string
 	CreationDate   time.Time
 	HashedPassword []byte `json:"HashedPassword,omitempty"`
+	Role           string // Users created before roles have an empty role, equivalent to RoleUser
+	// Subject of the users created by an OpenID Connect login at the provider, these users have no password
+	OIDCSubject string `json:"OIDCSubject,omitempty"`
+}
+
+// HasRole tells if a user has the rights of a role
+func (u User) HasRole(role string) bool {
+	if len(u.Role) == 0 {
+		return roleLevels[RoleUser] >= roleLevels[role]
+	}
+	return roleLevels[u.Role] >= roleLevels[role]
+}
+
+func AddUser(db *bolt.DB, login string, password string) error {
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return &Error{error: err, ErrCode: DatabaseError}
+	}
+
+	return addUser(db, User{Login: login, HashedPassword: hashedPassword, CreationDate: time.Now(), Role: RoleUser})
+}
+
+// AddOIDCUser creates a user authenticated by an OpenID Connect provider as subject, without password
+func AddOIDCUser(db *bolt.DB, login string, subject string) error {
+	return addUser(db, User{Login: login, CreationDate: time.Now(), Role: RoleUser, OIDCSubject: subject})
 }
 
-func AddUser(db *bolt.DB, login string, password string) (uerr error) {
+// addUser stores a new user, UserAlreadyExistsError if the login is taken
+func addUser(db *bolt.DB, user User) (uerr error) {
 
 	uerr = db.Batch(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucketIfNotExists([]byte(usersBucketName))
@@ -42,21 +87,12 @@ func AddUser(db *bolt.DB, login string, password string) (uerr error) {
 			return uerr
 		}
 
-		v := b.Get([]byte(login))
+		v := b.Get([]byte(user.Login))
 		if v != nil {
 			uerr = &Error{error: fmt.Errorf("User already exists"), ErrCode: UserAlreadyExistsError}
 			return uerr
 		}
 
-		// Else we have a really new user
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-		if err != nil {
-			uerr = &Error{error: err, ErrCode: DatabaseError}
-			return uerr
-		}
-
-		user := User{Login: login, HashedPassword: hashedPassword, CreationDate: time.Now()}
-
 		buf, err := json.Marshal(user)
 		if err != nil {
 			uerr = &Error{error: err, ErrCode: DatabaseError}
@@ -100,7 +136,7 @@ func AuthUser(db *bolt.DB, login string, password string) (uerr error) {
 			err := bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(password))
 			if err != nil {
 				uerr = &Error{error: err, ErrCode: AuthenticationFailed}
-				return err
+				return uerr
 			}
 		}
 
@@ -157,8 +193,109 @@ func GetUser(db *bolt.DB, login string) (user User, uerr error) {
 			return uerr
 		}
 		user.HashedPassword = nil
+		if len(user.Role) == 0 {
+			user.Role = RoleUser
+		}
 		return nil
 	})
 
 	return
 }
+
+// SetUserRole changes the role of a user
+func SetUserRole(db *bolt.DB, login string, role string) error {
+	return updateUser(db, login, func(user *User) error {
+		user.Role = role
+		return nil
+	})
+}
+
+// SetPassword replaces the password of a user
+func SetPassword(db *bolt.DB, login string, password string) error {
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return &Error{error: err, ErrCode: DatabaseError}
+	}
+
+	return updateUser(db, login, func(user *User) error {
+		user.HashedPassword = hashedPassword
+		return nil
+	})
+}
+
+// updateUser applies fn to a stored user
+func updateUser(db *bolt.DB, login string, fn func(*User) error) (uerr error) {
+
+	uerr = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(usersBucketName))
+		var v []byte
+
+		if b != nil {
+			v = b.Get([]byte(login))
+		}
+
+		if v == nil {
+			return &Error{error: fmt.Errorf("User does not exists"), ErrCode: UserDoesNotExistsError}
+		}
+
+		user := User{}
+		if err := json.Unmarshal(v, &user); err != nil {
+			return &Error{error: err, ErrCode: DatabaseError}
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+
+		buf, err := json.Marshal(user)
+		if err != nil {
+			return &Error{error: err, ErrCode: DatabaseError}
+		}
+		if err := b.Put([]byte(login), buf); err != nil {
+			return &Error{error: err, ErrCode: DatabaseError}
+		}
+		return nil
+	})
+
+	return
+}
+
+// ForEachUser calls fn for every user, password hash included
+func ForEachUser(db *bolt.DB, fn func(User) error) error {
+
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(usersBucketName))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var user User
+			if err := json.Unmarshal(v, &user); err != nil {
+				return &Error{error: err, ErrCode: DatabaseError}
+			}
+			return fn(user)
+		})
+	})
+}
+
+// ImportUser stores a user as is, password hash included
+func ImportUser(db *bolt.DB, user User) error {
+
+	buf, err := json.Marshal(user)
+	if err != nil {
+		return &Error{error: err, ErrCode: DatabaseError}
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(usersBucketName))
+		if err != nil {
+			return &Error{error: err, ErrCode: DatabaseError}
+		}
+
+		if err := b.Put([]byte(user.Login), buf); err != nil {
+			return &Error{error: err, ErrCode: DatabaseError}
+		}
+		return nil
+	})
+}
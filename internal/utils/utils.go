@@ -10,3 +10,8 @@ func IToB(v uint64) []byte {
 	binary.BigEndian.PutUint64(b, v)
 	return b
 }
+
+// BToI returns the uint64 value of an 8-byte big endian representation.
+func BToI(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	goboardoidc "github.com/dguihal/goboard/internal/oidc"
+	goboarduser "github.com/dguihal/goboard/internal/user"
+)
+
+// Time given to users to log in at the provider
+const oidcLoginTimeout = 10 * time.Minute
+
+// Maximum number of logins in progress, others are rejected until some complete or time out
+const maxPendingOIDCLogins = 10000
+
+// Timeout of the requests to the provider
+const oidcRequestTimeout = 10 * time.Second
+
+// Cookie binding a login in progress to the browser which started it
+const oidcStateCookieName = "goboard_oidc"
+
+// OIDCConfig holds the settings of the login through an OpenID Connect provider (disabled if Issuer is not set)
+// Users are identified by their subject at the provider: changing Issuer locks out the users it created
+type OIDCConfig struct {
+	Issuer       string   `yaml:"Issuer"`       // URL of the provider, its metadata are discovered from it
+	ClientID     string   `yaml:"ClientID"`     // Client registered at the provider
+	ClientSecret string   `yaml:"ClientSecret"` // Empty for public clients
+	RedirectURL  string   `yaml:"RedirectURL"`  // Public URL of /user/oidc/callback, registered at the provider
+	Scopes       []string `yaml:"Scopes"`       // Requested in addition to openid (default: profile)
+	// Claim of the ID token (or of the userinfo response) giving the login of users (default: preferred_username)
+	UsernameClaim string `yaml:"UsernameClaim"`
+}
+
+// check validates the configuration and sets its defaults
+func (c *OIDCConfig) check() error {
+	if len(c.Issuer) == 0 {
+		return nil
+	}
+	if u, err := url.Parse(c.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+		return fmt.Errorf("invalid OIDC.Issuer %q", c.Issuer)
+	}
+	if len(c.ClientID) == 0 {
+		return fmt.Errorf("OIDC.ClientID is required")
+	}
+	if u, err := url.Parse(c.RedirectURL); err != nil || !u.IsAbs() {
+		return fmt.Errorf("OIDC.RedirectURL must be the absolute URL of /user/oidc/callback")
+	}
+	if c.Scopes == nil {
+		c.Scopes = []string{"profile"}
+	}
+	if len(c.UsernameClaim) == 0 {
+		c.UsernameClaim = "preferred_username"
+	}
+	return nil
+}
+
+// OIDCLogin runs the logins through an OpenID Connect provider
+type OIDCLogin struct {
+	client        *goboardoidc.Client
+	usernameClaim string
+
+	mu        sync.Mutex
+	pending   map[string]pendingOIDCLogin // By state
+	lastSweep time.Time
+}
+
+// pendingOIDCLogin is a login started by a user, waiting for the provider to send the user back
+type pendingOIDCLogin struct {
+	nonce    string
+	verifier string // PKCE code verifier
+	returnTo string // Path the user is sent to once logged in
+	expires  time.Time
+}
+
+// NewOIDCLogin creates the OIDC login from the configuration, nil if it is disabled
+func NewOIDCLogin(config OIDCConfig) *OIDCLogin {
+	if len(config.Issuer) == 0 {
+		return nil
+	}
+
+	client := goboardoidc.NewClient(goboardoidc.Config{
+		Issuer:       config.Issuer,
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		RedirectURL:  config.RedirectURL,
+		Scopes:       config.Scopes,
+	}, &http.Client{Timeout: oidcRequestTimeout})
+
+	return &OIDCLogin{client: client, usernameClaim: config.UsernameClaim, pending: map[string]pendingOIDCLogin{}}
+}
+
+// start records a login in progress, false if too many are
+func (o *OIDCLogin) start(state string, p pendingOIDCLogin) bool {
+	now := time.Now()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if now.Sub(o.lastSweep) >= oidcLoginTimeout || len(o.pending) >= maxPendingOIDCLogins {
+		for s, p := range o.pending {
+			if !now.Before(p.expires) {
+				delete(o.pending, s)
+			}
+		}
+		o.lastSweep = now
+	}
+	if len(o.pending) >= maxPendingOIDCLogins {
+		return false
+	}
+	o.pending[state] = p
+	return true
+}
+
+// finish returns and forgets a login in progress, ok is false if it is unknown or timed out
+func (o *OIDCLogin) finish(state string) (p pendingOIDCLogin, ok bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	p, ok = o.pending[state]
+	delete(o.pending, state)
+	return p, ok && time.Now().Before(p.expires)
+}
+
+// oidcLogin sends the user to the provider, back to the path given by the return parameter once logged in
+func (u *UserHandler) oidcLogin(w http.ResponseWriter, r *http.Request) {
+
+	returnTo := r.URL.Query().Get("return")
+	// Only local paths, so that the board can't be used to redirect to other sites
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.Contains(returnTo, "\\") {
+		returnTo = "/"
+	}
+
+	state := uniuri.NewLen(32)
+	p := pendingOIDCLogin{
+		nonce:    uniuri.NewLen(32),
+		verifier: uniuri.NewLen(64),
+		returnTo: returnTo,
+		expires:  time.Now().Add(oidcLoginTimeout),
+	}
+
+	authURL, err := u.oidc.client.AuthCodeURL(r.Context(), state, p.nonce, p.verifier)
+	if err != nil {
+		u.logger.Printf("Could not start OIDC login: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	if !u.oidc.start(state, p) {
+		http.Error(w, "Too many logins in progress, please retry later", http.StatusServiceUnavailable)
+		return
+	}
+
+	http.SetCookie(w, u.oidcStateCookie(state, int(oidcLoginTimeout.Seconds())))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcStateCookie returns the cookie holding the state of a login in progress
+// It must be sent back when the provider redirects the user, a cross-site navigation: SameSite strict can't be used
+func (u *UserHandler) oidcStateCookie(state string, maxAge int) *http.Cookie {
+	cookie := &http.Cookie{Name: oidcStateCookieName, Value: state, Path: "/user/oidc/", MaxAge: maxAge, HttpOnly: true}
+	u.cookies.apply(cookie)
+	if cookie.SameSite == http.SameSiteStrictMode {
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	return cookie
+}
+
+// oidcCallback completes a login when the provider sends the user back with an authorization code
+// The user whose login is given by the provider is created on first login, then a session is opened
+func (u *UserHandler) oidcCallback(w http.ResponseWriter, r *http.Request) {
+
+	q := r.URL.Query()
+	state := q.Get("state")
+
+	// The login can only be completed by the browser which started it
+	http.SetCookie(w, u.oidcStateCookie("", -1))
+	c, err := r.Cookie(oidcStateCookieName)
+	if err != nil || len(state) == 0 || c.Value != state {
+		http.Error(w, "Invalid login request, please log in again", http.StatusBadRequest)
+		return
+	}
+	p, ok := u.oidc.finish(state)
+	if !ok {
+		http.Error(w, "Login request expired, please log in again", http.StatusBadRequest)
+		return
+	}
+
+	if e := q.Get("error"); len(e) > 0 {
+		http.Error(w, strings.TrimSpace("Login refused by the identity provider: "+e+" "+q.Get("error_description")), http.StatusUnauthorized)
+		return
+	}
+	code := q.Get("code")
+	if len(code) == 0 {
+		http.Error(w, "Missing authorization code", http.StatusBadRequest)
+		return
+	}
+
+	token, tokens, err := u.oidc.client.Exchange(r.Context(), code, p.verifier, p.nonce)
+	if err != nil {
+		u.logger.Printf("OIDC login failed: %v", err)
+		if errors.Is(err, goboardoidc.ErrInvalidToken) {
+			http.Error(w, "Authentication failed", http.StatusUnauthorized)
+		} else {
+			http.Error(w, "Login failed at the identity provider", http.StatusBadGateway)
+		}
+		return
+	}
+
+	login := token.StringClaim(u.oidc.usernameClaim)
+	if len(login) == 0 && len(tokens.AccessToken) > 0 {
+		claims, err := u.oidc.client.UserInfo(r.Context(), tokens.AccessToken, token.Subject)
+		if err != nil {
+			u.logger.Printf("Could not get OIDC userinfo of %s: %v", token.Subject, err)
+		}
+		login, _ = claims[u.oidc.usernameClaim].(string)
+	}
+	if len(login) == 0 {
+		u.logger.Printf("No %s claim for OIDC subject %s", u.oidc.usernameClaim, token.Subject)
+		http.Error(w, "The identity provider did not give a username", http.StatusForbidden)
+		return
+	}
+
+	if !u.oidcUser(w, login, token.Subject) {
+		return
+	}
+
+	if err := u.startSession(w, r, login); err != nil {
+		u.logger.Printf("Failed to create session for user %s: %v", login, err)
+		http.Error(w, "Failed to generate session", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, p.returnTo, http.StatusSeeOther)
+}
+
+// oidcUser checks that login belongs to subject at the provider, creating the user if it does not exist
+// Answers the error and returns false if the login can't be used
+func (u *UserHandler) oidcUser(w http.ResponseWriter, login string, subject string) bool {
+
+	user, err := u.Store.GetUser(login)
+	if uerr, ok := err.(*goboarduser.Error); ok && uerr.ErrCode == goboarduser.UserDoesNotExistsError {
+		err = u.Store.AddOIDCUser(login, subject)
+		if err == nil {
+			u.logger.Printf("User %s created by OIDC login", login)
+			return true
+		}
+		// Created in between
+		if uerr, ok := err.(*goboarduser.Error); ok && uerr.ErrCode == goboarduser.UserAlreadyExistsError {
+			user, err = u.Store.GetUser(login)
+		}
+	}
+	if err != nil {
+		u.logger.Printf("Could not get user %s for OIDC login: %v", login, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+
+	// Local accounts and accounts of other subjects can't be taken over
+	if user.OIDCSubject != subject {
+		u.logger.Printf("OIDC login of subject %s refused: login %s belongs to another account", subject, login)
+		http.Error(w, fmt.Sprintf("Login %s is already used by another account", login), http.StatusConflict)
+		return false
+	}
+	return true
+}
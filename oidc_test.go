@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	goboardoidcmock "github.com/dguihal/goboard/internal/oidc/oidcmock"
+)
+
+// Never requested: the test sends the redirections of the provider to the board itself
+const testOIDCRedirectURL = "http://goboard.test/user/oidc/callback"
+
+// newOIDCTestServer starts a board logging in at a mock provider, both closed at the end of the test
+func newOIDCTestServer(t *testing.T) (*testServer, *goboardoidcmock.Provider) {
+	t.Helper()
+
+	provider, err := goboardoidcmock.New("", "goboard", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := httptest.NewServer(provider.Handler())
+	t.Cleanup(issuer.Close)
+	provider.Issuer = issuer.URL
+
+	config := testConfig()
+	config.OIDC = OIDCConfig{Issuer: issuer.URL, ClientID: "goboard", ClientSecret: "secret", RedirectURL: testOIDCRedirectURL}
+	if err := config.OIDC.check(); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, config, nil)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Client().Jar = jar
+	s.Client().CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	return s, provider
+}
+
+// redirection sends a GET request and returns the location it is redirected to
+func (s *testServer) redirection(t *testing.T, rawURL string, status int) *url.URL {
+	t.Helper()
+
+	resp, err := s.Client().Get(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Fatalf("GET %s: status %d, want %d", rawURL, resp.StatusCode, status)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatalf("GET %s: %v", rawURL, err)
+	}
+	return location
+}
+
+// oidcLogin logs in as user at the provider and returns the callback query the provider sends the user back with
+func (s *testServer) oidcLogin(t *testing.T, user string) url.Values {
+	t.Helper()
+
+	authURL := s.redirection(t, s.URL+"/user/oidc/login?return=/b/tribune", http.StatusFound)
+	q := authURL.Query()
+	q.Set("login_hint", user)
+	authURL.RawQuery = q.Encode()
+
+	back := s.redirection(t, authURL.String(), http.StatusFound)
+	if got := back.Scheme + "://" + back.Host + back.Path; got != testOIDCRedirectURL {
+		t.Fatalf("sent back to %s, want %s", got, testOIDCRedirectURL)
+	}
+	return back.Query()
+}
+
+func TestOIDCLogin(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   string
+		setup  func(t *testing.T, s *testServer, p *goboardoidcmock.Provider)
+		tamper func(s *testServer, q url.Values) // Changes the callback query or the cookies
+		status int
+		login  string // Logged in user, if any
+	}{
+		{"first login creates the user", "bob", nil, nil, http.StatusSeeOther, "bob"},
+		{"next logins of the subject", "bob", func(t *testing.T, s *testServer, p *goboardoidcmock.Provider) {
+			if err := s.Store.AddOIDCUser("bob", goboardoidcmock.Subject("bob")); err != nil {
+				t.Fatal(err)
+			}
+		}, nil, http.StatusSeeOther, "bob"},
+		{"state mismatch", "bob", nil, func(s *testServer, q url.Values) { q.Set("state", "forged") }, http.StatusBadRequest, ""},
+		{"state cookie of another login", "bob", nil, func(s *testServer, q url.Values) {
+			u, _ := url.Parse(s.URL + "/user/oidc/")
+			s.Client().Jar.SetCookies(u, []*http.Cookie{{Name: oidcStateCookieName, Value: "other", Path: "/user/oidc/"}})
+		}, http.StatusBadRequest, ""},
+		{"nonce mismatch", "bob", func(t *testing.T, s *testServer, p *goboardoidcmock.Provider) {
+			p.Claims = func(claims map[string]any) { claims["nonce"] = "replayed" }
+		}, nil, http.StatusUnauthorized, ""},
+		{"login refused by the provider", "deny", nil, nil, http.StatusUnauthorized, ""},
+		{"login of a local account", "alice", func(t *testing.T, s *testServer, p *goboardoidcmock.Provider) {
+			if err := s.Store.AddUser("alice", "secret"); err != nil {
+				t.Fatal(err)
+			}
+		}, nil, http.StatusConflict, ""},
+		{"login of another subject", "carol", func(t *testing.T, s *testServer, p *goboardoidcmock.Provider) {
+			if err := s.Store.AddOIDCUser("carol", "elsewhere-carol"); err != nil {
+				t.Fatal(err)
+			}
+		}, nil, http.StatusConflict, ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, p := newOIDCTestServer(t)
+			if tc.setup != nil {
+				tc.setup(t, s, p)
+			}
+
+			q := s.oidcLogin(t, tc.user)
+			if tc.tamper != nil {
+				tc.tamper(s, q)
+			}
+
+			resp, err := s.Client().Get(s.URL + "/user/oidc/callback?" + q.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Fatalf("callback: status %d, want %d", resp.StatusCode, tc.status)
+			}
+			if tc.status == http.StatusSeeOther {
+				if location := resp.Header.Get("Location"); location != "/b/tribune" {
+					t.Errorf("sent to %s, want /b/tribune", location)
+				}
+			}
+
+			status, body := s.do(t, http.MethodGet, "/user/whoami", nil, nil)
+			switch {
+			case len(tc.login) == 0 && status != http.StatusForbidden:
+				t.Errorf("whoami: status %d, want nobody logged in", status)
+			case len(tc.login) > 0 && (status != http.StatusOK || !strings.Contains(body, `"`+tc.login+`"`)):
+				t.Errorf("whoami: status %d: %s, want %s logged in", status, body, tc.login)
+			}
+
+			if len(tc.login) > 0 {
+				user, err := s.Store.GetUser(tc.login)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if user.OIDCSubject != goboardoidcmock.Subject(tc.login) {
+					t.Errorf("user %s has subject %q, want %q", tc.login, user.OIDCSubject, goboardoidcmock.Subject(tc.login))
+				}
+			}
+		})
+	}
+}
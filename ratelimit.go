@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delay between two removals of the idle entries of limiters and lockouts
+const rateLimitSweepInterval = time.Minute
+
+// RateLimitConfig holds the flood protection settings, limits are kept in memory
+type RateLimitConfig struct {
+	Post   LimitConfig `yaml:"Post"`   // Posting, by client IP and by login
+	Signup LimitConfig `yaml:"Signup"` // Account creation, by client IP
+	Login  LimitConfig `yaml:"Login"`  // Authentication, by client IP and by attempted login
+
+	// Addresses or networks (CIDR) of the reverse proxies whose X-Forwarded-For header is honored
+	TrustedProxies []string `yaml:"TrustedProxies"`
+
+	// Consecutive failed authentications after which a login is locked (0 to disable lockouts)
+	LockoutThreshold int           `yaml:"LockoutThreshold"`
+	LockoutDuration  time.Duration `yaml:"LockoutDuration"`
+}
+
+// LimitConfig is a token bucket: Burst requests at once, then one request every Every
+// Requests are not limited if Every is 0
+type LimitConfig struct {
+	Every time.Duration `yaml:"Every"`
+	Burst int           `yaml:"Burst"`
+}
+
+// FloodGuard rejects the requests over the configured limits with 429 Too Many Requests
+type FloodGuard struct {
+	trusted []*net.IPNet
+	post    *limiter // nil if not limited
+	signup  *limiter // nil if not limited
+	login   *limiter // nil if not limited
+	lockout *lockout // nil if disabled
+}
+
+// NewFloodGuard creates a FloodGuard from the configuration
+func NewFloodGuard(config RateLimitConfig) (*FloodGuard, error) {
+	g := &FloodGuard{
+		post:   newLimiter(config.Post),
+		signup: newLimiter(config.Signup),
+		login:  newLimiter(config.Login),
+	}
+
+	for _, p := range config.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+		}
+		g.trusted = append(g.trusted, n)
+	}
+
+	if config.LockoutThreshold > 0 {
+		if config.LockoutDuration <= 0 {
+			return nil, fmt.Errorf("LockoutDuration is required with LockoutThreshold")
+		}
+		g.lockout = &lockout{
+			threshold: config.LockoutThreshold,
+			duration:  config.LockoutDuration,
+			logins:    map[string]*lockoutState{},
+		}
+	}
+	return g, nil
+}
+
+// AllowPost tells if a post can be made, answering 429 if not
+func (g *FloodGuard) AllowPost(w http.ResponseWriter, r *http.Request, login string) bool {
+	if wait := g.PostWait(g.ClientIP(r), login); wait > 0 {
+		tooManyRequests(w, wait, "Too many posts, slow down")
+		return false
+	}
+	return true
+}
+
+// PostWait counts a post from ip (and login if not empty) and returns 0, or the delay before posting is allowed
+func (g *FloodGuard) PostWait(ip string, login string) time.Duration {
+	keys := []string{"ip:" + ip}
+	if len(login) > 0 {
+		keys = append(keys, "login:"+login)
+	}
+	return g.wait(g.post, keys...)
+}
+
+// AllowSignup tells if an account can be created, answering 429 if not
+func (g *FloodGuard) AllowSignup(w http.ResponseWriter, r *http.Request) bool {
+	return g.allow(w, g.signup, "ip:"+g.ClientIP(r))
+}
+
+// AllowLogin tells if an authentication can be attempted for login, answering 429 if not
+// Locked logins are rejected without consuming the limits
+func (g *FloodGuard) AllowLogin(w http.ResponseWriter, r *http.Request, login string) bool {
+	if g == nil {
+		return true
+	}
+	if wait := g.lockout.locked(login, time.Now()); wait > 0 {
+		tooManyRequests(w, wait, "Too many failed authentications, try again later")
+		return false
+	}
+	return g.allow(w, g.login, "ip:"+g.ClientIP(r), "login:"+login)
+}
+
+// LoginFailed records a failed authentication for login
+func (g *FloodGuard) LoginFailed(login string) {
+	if g != nil {
+		g.lockout.fail(login, time.Now())
+	}
+}
+
+// LoginSucceeded resets the failed authentications of login
+func (g *FloodGuard) LoginSucceeded(login string) {
+	if g != nil {
+		g.lockout.reset(login)
+	}
+}
+
+// ClientIP returns the address of the client of a request
+// X-Forwarded-For is only used when the request comes from a trusted proxy: the rightmost address
+// not belonging to a trusted proxy is the client
+func (g *FloodGuard) ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if g == nil || !g.isTrusted(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			// Garbage inserted by the client or an unknown proxy, the last trusted hop is the client
+			break
+		}
+		ip = hop
+		if !g.isTrusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (g *FloodGuard) isTrusted(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range g.trusted {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allow takes a token for every key from l, answering 429 if one of them is exhausted
+func (g *FloodGuard) allow(w http.ResponseWriter, l *limiter, keys ...string) bool {
+	if wait := g.wait(l, keys...); wait > 0 {
+		tooManyRequests(w, wait, "Too many requests, slow down")
+		return false
+	}
+	return true
+}
+
+// wait takes a token for every key from l and returns 0, or the delay before all of them are available
+func (g *FloodGuard) wait(l *limiter, keys ...string) time.Duration {
+	if g == nil || l == nil {
+		return 0
+	}
+	return l.take(time.Now(), keys...)
+}
+
+// tooManyRequests answers 429 with a Retry-After header in seconds (rounded up)
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// limiter holds a token bucket per key
+type limiter struct {
+	every time.Duration
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // Time of the last refill
+}
+
+func newLimiter(config LimitConfig) *limiter {
+	if config.Every <= 0 {
+		return nil
+	}
+	burst := config.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{every: config.Every, burst: float64(burst), buckets: map[string]*tokenBucket{}}
+}
+
+// take takes a token from the bucket of every key and returns 0, or the delay before they all have one
+// No token is taken if a bucket is empty, so that rejected requests don't drain the other buckets
+func (l *limiter) take(now time.Time, keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	buckets := make([]*tokenBucket, len(keys))
+	var wait time.Duration
+	for i, key := range keys {
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: l.burst, last: now}
+			l.buckets[key] = b
+		}
+
+		b.tokens = math.Min(l.burst, b.tokens+float64(now.Sub(b.last))/float64(l.every))
+		b.last = now
+		if b.tokens < 1 {
+			wait = max(wait, time.Duration((1-b.tokens)*float64(l.every)))
+		}
+		buckets[i] = b
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0
+}
+
+// sweep removes the buckets refilled since their last use (l.mu must be held)
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	full := time.Duration(l.burst * float64(l.every))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// lockout counts the consecutive failed authentications of logins
+type lockout struct {
+	threshold int
+	duration  time.Duration
+
+	mu        sync.Mutex
+	logins    map[string]*lockoutState
+	lastSweep time.Time
+}
+
+type lockoutState struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// locked returns the remaining lockout time of login, 0 if not locked
+func (l *lockout) locked(login string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if s, ok := l.logins[login]; ok && now.Before(s.lockedUntil) {
+		return s.lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// fail records a failed authentication, locking login once the threshold is reached
+// Failures older than the lockout duration are forgotten
+func (l *lockout) fail(login string, now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	s, ok := l.logins[login]
+	if !ok || now.Sub(s.lastFailure) >= l.duration {
+		s = &lockoutState{}
+		l.logins[login] = s
+	}
+	s.failures++
+	s.lastFailure = now
+	if s.failures >= l.threshold {
+		s.failures = 0
+		s.lockedUntil = now.Add(l.duration)
+	}
+}
+
+func (l *lockout) reset(login string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.logins, login)
+}
+
+// sweep removes the logins neither locked nor recently failed (l.mu must be held)
+func (l *lockout) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for login, s := range l.logins {
+		if now.After(s.lockedUntil) && now.Sub(s.lastFailure) >= l.duration {
+			delete(l.logins, login)
+		}
+	}
+}
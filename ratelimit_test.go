@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterTake(t *testing.T) {
+	// Every take of a case, in order
+	type take struct {
+		at   time.Duration // Since the start of the case
+		keys []string
+		wait time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		takes []take
+	}{
+		{"burst then wait", []take{
+			{0, []string{"ip"}, 0},
+			{0, []string{"ip"}, 0},
+			{0, []string{"ip"}, 10 * time.Second},
+			{10 * time.Second, []string{"ip"}, 0},
+		}},
+		{"partial refill", []take{
+			{0, []string{"ip"}, 0},
+			{0, []string{"ip"}, 0},
+			{4 * time.Second, []string{"ip"}, 6 * time.Second},
+		}},
+		{"rejected takes leave the other buckets", []take{
+			{0, []string{"ip"}, 0},
+			{0, []string{"ip"}, 0},
+			{0, []string{"ip", "login"}, 10 * time.Second},
+			{0, []string{"ip", "login"}, 10 * time.Second},
+			{0, []string{"login"}, 0},
+			{0, []string{"login"}, 0},
+			{0, []string{"login"}, 10 * time.Second},
+		}},
+		{"accepted takes drain every bucket", []take{
+			{0, []string{"ip", "login"}, 0},
+			{0, []string{"ip", "login"}, 0},
+			{0, []string{"ip"}, 10 * time.Second},
+			{0, []string{"login"}, 10 * time.Second},
+		}},
+		{"wait for the emptiest bucket", []take{
+			{0, []string{"a"}, 0},
+			{0, []string{"a"}, 0},
+			{5 * time.Second, []string{"b"}, 0},
+			{5 * time.Second, []string{"b"}, 0},
+			{6 * time.Second, []string{"a", "b"}, 9 * time.Second},
+		}},
+	}
+
+	start := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newLimiter(LimitConfig{Every: 10 * time.Second, Burst: 2})
+			for i, tk := range tc.takes {
+				if wait := l.take(start.Add(tk.at), tk.keys...); wait != tk.wait {
+					t.Fatalf("take %d of %v: wait %v, want %v", i, tk.keys, wait, tk.wait)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+	goboardstore "github.com/dguihal/goboard/internal/store"
+)
+
+// Pause between two pruning batches, so that posting is not delayed
+const retentionBatchPause = 100 * time.Millisecond
+
+// RetentionConfig holds the history retention policy applied to every board
+// Nothing is pruned if MaxAge and MaxPosts are both 0
+type RetentionConfig struct {
+	MaxAge         time.Duration `yaml:"MaxAge"`         // Posts older than this are pruned (0 for no age limit)
+	MaxPosts       int           `yaml:"MaxPosts"`       // Only the newest MaxPosts posts are kept (0 for no count limit)
+	RepliedMaxAge  time.Duration `yaml:"RepliedMaxAge"`  // Posts having replies are kept until this age (0 to prune them as others)
+	Interval       time.Duration `yaml:"Interval"`       // Delay between two prunings
+	BatchSize      int           `yaml:"BatchSize"`      // Number of posts deleted per transaction
+	ArchiveDir     string        `yaml:"ArchiveDir"`     // Pruned posts are archived in this directory (not archived if empty)
+	ArchiveMaxSize int64         `yaml:"ArchiveMaxSize"` // Size in bytes from which a new archive file is started
+}
+
+// Enabled tells if posts have to be pruned
+func (rc RetentionConfig) Enabled() bool {
+	return rc.MaxAge > 0 || rc.MaxPosts > 0
+}
+
+// Pruner deletes the posts out of the retention policy
+type Pruner struct {
+	config  RetentionConfig
+	store   goboardstore.PostStore
+	boards  *Boards
+	archive *archiveSink // nil if pruned posts are not archived
+}
+
+// NewPruner creates a Pruner for every board
+func NewPruner(config RetentionConfig, store goboardstore.PostStore, boards *Boards) (*Pruner, error) {
+	p := &Pruner{config: config, store: store, boards: boards}
+
+	if len(config.ArchiveDir) > 0 {
+		if err := os.MkdirAll(config.ArchiveDir, 0700); err != nil {
+			return nil, err
+		}
+		p.archive = &archiveSink{dir: config.ArchiveDir, maxSize: config.ArchiveMaxSize}
+	}
+	return p, nil
+}
+
+// Run prunes every board each Interval until ctx is done
+func (p *Pruner) Run(ctx context.Context) {
+	defer p.archive.Close()
+
+	for {
+		for _, board := range p.boards.All() {
+			count, err := p.prune(ctx, board, time.Now())
+			if count > 0 {
+				log.Printf("Board %s: %d posts pruned", board.Name, count)
+			}
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Board %s: pruning failed: %v", board.Name, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.config.Interval):
+		}
+	}
+}
+
+// prune deletes the posts of a board out of the retention policy at now, oldest first
+func (p *Pruner) prune(ctx context.Context, board *BoardSettings, now time.Time) (count int, err error) {
+
+	// Number of posts over MaxPosts
+	excess := 0
+	if p.config.MaxPosts > 0 {
+		total, err := p.store.CountPosts(board.Key)
+		if err != nil {
+			return 0, err
+		}
+		excess = total - p.config.MaxPosts
+	}
+
+	// Posts made before these times are too old (zero for no limit)
+	var maxTime, repliedMaxTime time.Time
+	if p.config.MaxAge > 0 {
+		maxTime = now.Add(-p.config.MaxAge)
+	}
+	if p.config.RepliedMaxAge > 0 {
+		repliedMaxTime = now.Add(-p.config.RepliedMaxAge)
+	}
+
+	var after uint64
+	for done := false; !done; {
+		posts, err := p.store.GetOldest(board.Key, p.config.BatchSize, after)
+		if err != nil || len(posts) == 0 {
+			return count, err
+		}
+
+		var expired []goboardbackend.Post
+		for _, post := range posts {
+			after = post.ID
+
+			if excess <= 0 && !post.Time.Before(maxTime) {
+				// Next posts are newer
+				done = true
+				break
+			}
+
+			if !repliedMaxTime.IsZero() && !post.Time.Before(repliedMaxTime) {
+				replies, err := p.store.GetReplies(board.Key, post.ID)
+				if err != nil {
+					return count, err
+				}
+				if len(replies) > 0 {
+					continue
+				}
+			}
+
+			expired = append(expired, post)
+			excess--
+		}
+
+		if len(expired) > 0 {
+			if err := p.archive.Write(board.Key, expired); err != nil {
+				return count, err
+			}
+
+			ids := make([]uint64, len(expired))
+			for i, post := range expired {
+				ids[i] = post.ID
+			}
+			if err := p.store.PurgePosts(board.Key, ids); err != nil {
+				return count, err
+			}
+			count += len(expired)
+		}
+
+		select {
+		case <-ctx.Done():
+			return count, ctx.Err()
+		case <-time.After(retentionBatchPause):
+		}
+	}
+	return
+}
+
+// archiveSink writes posts to JSON Lines files (goboard-db dump format)
+// A new file is started when the current one reaches maxSize
+type archiveSink struct {
+	dir     string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+// Write appends posts of a board to the archive, they are synced to disk when it returns
+// Does nothing on a nil archiveSink
+func (a *archiveSink) Write(board string, posts []goboardbackend.Post) error {
+	if a == nil {
+		return nil
+	}
+
+	if a.file == nil || a.size >= a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range posts {
+		if err := enc.Encode(goboardstore.Record{Type: goboardstore.RecordPost, Board: board, Post: &posts[i]}); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.Write(buf.Bytes())
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// rotate closes the current file and starts a new one
+func (a *archiveSink) rotate() error {
+	a.Close()
+
+	name := filepath.Join(a.dir, "goboard-archive-"+time.Now().UTC().Format("20060102T150405.000Z")+".jsonl")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Archiving pruned posts to %s", name)
+	a.file, a.size = f, 0
+	return nil
+}
+
+// Close closes the current file
+// Does nothing on a nil archiveSink
+func (a *archiveSink) Close() {
+	if a == nil || a.file == nil {
+		return
+	}
+	if err := a.file.Close(); err != nil {
+		log.Printf("Error closing archive: %v", err)
+	}
+	a.file = nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+	goboardstore "github.com/dguihal/goboard/internal/store"
+	bolt "go.etcd.io/bbolt"
+)
+
+// testStores opens an empty store of every kind, closed at the end of the test
+func testStores(t *testing.T) map[string]goboardstore.Store {
+	t.Helper()
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "goboard.db"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite, err := goboardstore.NewSQLiteStore(filepath.Join(t.TempDir(), "goboard.sqlite"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]goboardstore.Store{
+		"memory": goboardstore.NewMemoryStore(),
+		"bolt":   goboardstore.NewBoltStore(db),
+		"sqlite": sqlite,
+	}
+	t.Cleanup(func() {
+		for _, s := range stores {
+			s.Close()
+		}
+	})
+	return stores
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	// Posts 1 to 10 are made a minute apart, the last one at now
+	postTime := func(id int) time.Time { return now.Add(time.Duration(id-10) * time.Minute) }
+
+	tests := []struct {
+		name    string
+		config  RetentionConfig
+		replied bool     // Post 9 answers post 2
+		kept    []uint64 // Posts of the board once pruned
+	}{
+		{"max posts", RetentionConfig{MaxPosts: 4}, false, []uint64{7, 8, 9, 10}},
+		{"max age", RetentionConfig{MaxAge: 150 * time.Second}, false, []uint64{8, 9, 10}},
+		{"max posts and age", RetentionConfig{MaxPosts: 4, MaxAge: 90 * time.Second}, false, []uint64{9, 10}},
+		{"replied posts are kept", RetentionConfig{MaxPosts: 4, RepliedMaxAge: time.Hour}, true, []uint64{2, 8, 9, 10}},
+		{"replied posts expire", RetentionConfig{MaxPosts: 4, RepliedMaxAge: 5 * time.Minute}, true, []uint64{7, 8, 9, 10}},
+		{"nothing to prune", RetentionConfig{MaxPosts: 20, MaxAge: time.Hour}, false, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+	}
+
+	for _, tc := range tests {
+		for name, store := range testStores(t) {
+			t.Run(tc.name+"/"+name, func(t *testing.T) {
+				board := &BoardSettings{Name: "main", Key: "main", Location: time.UTC}
+				other := &BoardSettings{Name: "other", Key: "other", Location: time.UTC}
+
+				for id := 1; id <= 10; id++ {
+					p := goboardbackend.Post{Time: goboardbackend.PostTime{Time: postTime(id)}, Message: "post"}
+					if id == 9 && tc.replied {
+						p.Message = postTime(2).Format("15:04:05") + " answer"
+					}
+					for _, b := range []*BoardSettings{board, other} {
+						if _, err := store.PostMessage(b.Key, p, time.UTC); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+
+				tc.config.BatchSize = 3
+				p, err := NewPruner(tc.config, store, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				count, err := p.prune(context.Background(), board, now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := 10 - len(tc.kept); count != want {
+					t.Errorf("%d posts pruned, want %d", count, want)
+				}
+
+				posts, err := store.GetOldest(board.Key, 20, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var kept []uint64
+				for _, post := range posts {
+					kept = append(kept, post.ID)
+				}
+				if !slices.Equal(kept, tc.kept) {
+					t.Errorf("posts %v kept, want %v", kept, tc.kept)
+				}
+
+				// Counts are kept by board
+				for b, want := range map[*BoardSettings]int{board: len(tc.kept), other: 10} {
+					if n, err := store.CountPosts(b.Key); err != nil || n != want {
+						t.Errorf("board %s: %d posts counted (%v), want %d", b.Name, n, err, want)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	goboardsession "github.com/dguihal/goboard/internal/session"
+	goboardstore "github.com/dguihal/goboard/internal/store"
+)
+
+// Delay between two removals of the expired sessions
+const sessionSweepInterval = time.Hour
+
+// sessionFromCookies returns the session of the first valid session cookie of the request, ok is false if none
+// The last activity of the session is recorded, at most once per goboardsession.LastSeenResolution
+func (h *GoBoardHandler) sessionFromCookies(r *http.Request) (s goboardsession.Session, ok bool) {
+	for _, c := range r.Cookies() {
+		if c.Name != goboardsession.CookieName {
+			continue
+		}
+
+		s, err := h.Store.GetSession(h.SessionHasher.Hash(c.Value))
+		if errors.Is(err, goboardsession.ErrSessionNotFound) {
+			continue
+		} else if err != nil {
+			log.Printf("Could not get session: %v", err)
+			continue
+		}
+
+		now, ip := time.Now(), h.Guard.ClientIP(r)
+		if s.NeedsTouch(now, ip) {
+			if err := h.Store.TouchSession(s.TokenHash, now, ip); err != nil {
+				log.Printf("Could not record activity of a session of %s: %v", s.Login, err)
+			}
+		}
+		return s, true
+	}
+	return s, false
+}
+
+// loginFromCookies returns the login of the session of the request, empty if none
+func (h *GoBoardHandler) loginFromCookies(r *http.Request) string {
+	if s, ok := h.sessionFromCookies(r); ok {
+		return s.Login
+	}
+	return ""
+}
+
+// sweepSessions removes the expired sessions every sessionSweepInterval until ctx is done
+func sweepSessions(ctx context.Context, s goboardstore.SessionStore) {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.DeleteExpiredSessions(time.Now())
+			if err != nil {
+				log.Printf("Could not remove expired sessions: %v", err)
+			} else if n > 0 {
+				log.Printf("%d expired sessions removed", n)
+			}
+		}
+	}
+}
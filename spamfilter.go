@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+	goboardstore "github.com/dguihal/goboard/internal/store"
+	"gopkg.in/yaml.v2"
+)
+
+// SpamConfig holds the anti-spam filters applied to new posts (every filter is disabled if not set)
+type SpamConfig struct {
+	MaxLength       int           `yaml:"MaxLength"`       // Maximum number of characters of a message
+	MaxURLs         int           `yaml:"MaxURLs"`         // Maximum number of URLs in a message
+	DuplicateWindow time.Duration `yaml:"DuplicateWindow"` // Identical messages of an author are rejected during this time
+	RulesFile       string        `yaml:"RulesFile"`       // Blocklists and shadow bans, reloaded when modified
+	RulesReload     time.Duration `yaml:"RulesReload"`     // Delay between two checks of the rules file
+}
+
+// SpamRules is the content of the rules file
+type SpamRules struct {
+	Words        []string `yaml:"Words"`        // Rejected words (whole words, case insensitive)
+	Patterns     []string `yaml:"Patterns"`     // Rejected regular expressions
+	ShadowBanned []string `yaml:"ShadowBanned"` // Logins whose posts are silently dropped
+}
+
+// SpamCandidate is a post going through the filters
+type SpamCandidate struct {
+	Board *BoardSettings
+	Post  goboardbackend.Post // Sanitized post
+	IP    string              // Client address
+}
+
+// author identifies the author of a candidate: its login, or its address if anonymous
+func (c SpamCandidate) author() string {
+	if len(c.Post.Login) > 0 {
+		return "login:" + c.Post.Login
+	}
+	return "ip:" + c.IP
+}
+
+// Rejection tells why a post has been rejected
+// Shadow rejections are not reported to the author: the post is dropped as if it was stored
+type Rejection struct {
+	Filter string
+	Status int // HTTP status answered
+	Reason string
+	Shadow bool
+}
+
+// SpamFilter is a step of a SpamChain, Check returns nil if the post is accepted
+type SpamFilter interface {
+	Name() string
+	Check(c SpamCandidate, now time.Time) *Rejection
+}
+
+// spamRecorder is implemented by the filters which remember the posts once they are stored
+type spamRecorder interface {
+	Remember(c SpamCandidate, now time.Time)
+}
+
+// SpamChain runs filters in order until one of them rejects the post, and counts rejections
+type SpamChain struct {
+	filters  []SpamFilter
+	counters map[string]*atomic.Uint64
+
+	rulesFile   string
+	rulesReload time.Duration
+	rules       atomic.Pointer[compiledSpamRules]
+	rulesTime   time.Time // Modification time of the loaded rules file
+
+	shadowMu  sync.Mutex
+	shadowIDs map[string]uint64 // Last id given to a dropped post, by board key
+}
+
+// NewSpamChain creates the filters enabled in the configuration
+// The rules file is loaded here, an invalid file is an error
+func NewSpamChain(config SpamConfig) (*SpamChain, error) {
+	ch := &SpamChain{counters: map[string]*atomic.Uint64{}, rulesFile: config.RulesFile, rulesReload: config.RulesReload, shadowIDs: map[string]uint64{}}
+	ch.rules.Store(&compiledSpamRules{})
+
+	if len(config.RulesFile) > 0 {
+		if err := ch.loadRules(); err != nil {
+			return nil, err
+		}
+		ch.Add(shadowBanFilter{ch})
+	}
+	if config.MaxLength > 0 {
+		ch.Add(maxLengthFilter(config.MaxLength))
+	}
+	if config.MaxURLs > 0 {
+		ch.Add(maxURLsFilter(config.MaxURLs))
+	}
+	if len(config.RulesFile) > 0 {
+		ch.Add(blocklistFilter{ch})
+	}
+	if config.DuplicateWindow > 0 {
+		ch.Add(&duplicateFilter{window: config.DuplicateWindow, seen: map[string]time.Time{}})
+	}
+	return ch, nil
+}
+
+// Add appends a filter to the chain, it must be called before the chain is used
+func (ch *SpamChain) Add(f SpamFilter) {
+	ch.filters = append(ch.filters, f)
+	ch.counters[f.Name()] = &atomic.Uint64{}
+}
+
+// Check runs the filters on a post, returns nil if it is accepted
+func (ch *SpamChain) Check(c SpamCandidate) *Rejection {
+	if ch == nil {
+		return nil
+	}
+
+	now := time.Now()
+	for _, f := range ch.filters {
+		if rej := f.Check(c, now); rej != nil {
+			rej.Filter = f.Name()
+			ch.counters[rej.Filter].Add(1)
+			log.Printf("Post of %s on board %s rejected by %s filter: %s", c.author(), c.Board.Name, rej.Filter, rej.Reason)
+			return rej
+		}
+	}
+	return nil
+}
+
+// Remember records a post accepted by Check once it is stored, posts which could not be stored are not
+func (ch *SpamChain) Remember(c SpamCandidate) {
+	if ch == nil {
+		return
+	}
+
+	now := time.Now()
+	for _, f := range ch.filters {
+		if r, ok := f.(spamRecorder); ok {
+			r.Remember(c, now)
+		}
+	}
+}
+
+// ShadowPostID returns the id a silently dropped post would have had, so that shadow bans go unnoticed
+// Ids follow the latest stored post and are never given twice to dropped posts
+func (ch *SpamChain) ShadowPostID(s goboardstore.PostStore, board *BoardSettings) (uint64, error) {
+	posts, err := s.GetHistory(board.Key, 1, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	var id uint64
+	if len(posts) > 0 {
+		id = posts[0].ID
+	}
+	if ch == nil {
+		return id + 1, nil
+	}
+
+	ch.shadowMu.Lock()
+	defer ch.shadowMu.Unlock()
+
+	id = max(id, ch.shadowIDs[board.Key]) + 1
+	ch.shadowIDs[board.Key] = id
+	return id, nil
+}
+
+// Stats returns the number of posts rejected by each filter
+func (ch *SpamChain) Stats() map[string]uint64 {
+	stats := map[string]uint64{}
+	if ch == nil {
+		return stats
+	}
+	for name, c := range ch.counters {
+		stats[name] = c.Load()
+	}
+	return stats
+}
+
+// Run reloads the rules file when it is modified until ctx is done
+func (ch *SpamChain) Run(ctx context.Context) {
+	if ch == nil || len(ch.rulesFile) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(ch.rulesReload)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fi, err := os.Stat(ch.rulesFile)
+			if err != nil {
+				log.Printf("Could not check spam rules file: %v", err)
+				continue
+			}
+			if fi.ModTime().Equal(ch.rulesTime) {
+				continue
+			}
+			// Previous rules are kept if the new ones are invalid, until the file is modified again
+			if err := ch.loadRules(); err != nil {
+				ch.rulesTime = fi.ModTime()
+				log.Printf("Could not reload spam rules, keeping previous ones: %v", err)
+				continue
+			}
+			log.Printf("Spam rules reloaded from %s", ch.rulesFile)
+		}
+	}
+}
+
+// compiledSpamRules are the rules ready to be matched
+type compiledSpamRules struct {
+	words        *regexp.Regexp // nil if no word is blocked
+	patterns     []*regexp.Regexp
+	shadowBanned map[string]bool
+}
+
+// loadRules reads and compiles the rules file, then replaces the current rules
+func (ch *SpamChain) loadRules() error {
+	fi, err := os.Stat(ch.rulesFile)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(ch.rulesFile)
+	if err != nil {
+		return err
+	}
+
+	var rules SpamRules
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		return fmt.Errorf("could not parse spam rules file %s: %w", ch.rulesFile, err)
+	}
+
+	compiled := &compiledSpamRules{shadowBanned: map[string]bool{}}
+	if len(rules.Words) > 0 {
+		quoted := make([]string, len(rules.Words))
+		for i, w := range rules.Words {
+			quoted[i] = regexp.QuoteMeta(w)
+		}
+		// \b only knows ASCII word characters, blocked words may start or end with accented letters
+		compiled.words = regexp.MustCompile(`(?i)(?:^|[^\p{L}\p{N}_])(?:` + strings.Join(quoted, "|") + `)(?:$|[^\p{L}\p{N}_])`)
+	}
+	for _, p := range rules.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("invalid spam pattern %q: %w", p, err)
+		}
+		compiled.patterns = append(compiled.patterns, re)
+	}
+	for _, login := range rules.ShadowBanned {
+		compiled.shadowBanned[login] = true
+	}
+
+	ch.rules.Store(compiled)
+	ch.rulesTime = fi.ModTime()
+	return nil
+}
+
+// shadowBanFilter drops the posts of shadow banned logins
+type shadowBanFilter struct{ ch *SpamChain }
+
+func (f shadowBanFilter) Name() string { return "shadowban" }
+
+func (f shadowBanFilter) Check(c SpamCandidate, now time.Time) *Rejection {
+	if len(c.Post.Login) > 0 && f.ch.rules.Load().shadowBanned[c.Post.Login] {
+		return &Rejection{Status: http.StatusNoContent, Reason: "login is shadow banned", Shadow: true}
+	}
+	return nil
+}
+
+// maxLengthFilter rejects messages longer than a number of characters (before sanitization)
+type maxLengthFilter int
+
+func (f maxLengthFilter) Name() string { return "length" }
+
+func (f maxLengthFilter) Check(c SpamCandidate, now time.Time) *Rejection {
+	if n := utf8.RuneCountInString(c.Post.RawMessage); n > int(f) {
+		return &Rejection{Status: http.StatusBadRequest, Reason: fmt.Sprintf("message is too long (%d characters, %d allowed)", n, int(f))}
+	}
+	return nil
+}
+
+var spamURLReg = regexp.MustCompile(`(?i)https?://`)
+
+// maxURLsFilter rejects messages with too many URLs
+type maxURLsFilter int
+
+func (f maxURLsFilter) Name() string { return "urls" }
+
+func (f maxURLsFilter) Check(c SpamCandidate, now time.Time) *Rejection {
+	if n := len(spamURLReg.FindAllStringIndex(c.Post.RawMessage, -1)); n > int(f) {
+		return &Rejection{Status: http.StatusBadRequest, Reason: fmt.Sprintf("message has too many URLs (%d, %d allowed)", n, int(f))}
+	}
+	return nil
+}
+
+// blocklistFilter rejects messages containing blocked words or matching blocked patterns
+type blocklistFilter struct{ ch *SpamChain }
+
+func (f blocklistFilter) Name() string { return "blocklist" }
+
+func (f blocklistFilter) Check(c SpamCandidate, now time.Time) *Rejection {
+	rules := f.ch.rules.Load()
+	if rules.words != nil && rules.words.MatchString(c.Post.RawMessage) {
+		return &Rejection{Status: http.StatusForbidden, Reason: "message contains a blocked word"}
+	}
+	for _, re := range rules.patterns {
+		if re.MatchString(c.Post.RawMessage) {
+			return &Rejection{Status: http.StatusForbidden, Reason: "message matches a blocked pattern"}
+		}
+	}
+	return nil
+}
+
+// duplicateFilter rejects a message already posted by the same author on the same board within a window
+type duplicateFilter struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time // Last time by board, author and message
+	lastSweep time.Time
+}
+
+func (f *duplicateFilter) Name() string { return "duplicate" }
+
+func (f *duplicateFilter) key(c SpamCandidate) string {
+	return c.Board.Key + "\x00" + c.author() + "\x00" + c.Post.Message
+}
+
+func (f *duplicateFilter) Check(c SpamCandidate, now time.Time) *Rejection {
+	key := f.key(c)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if t, ok := f.seen[key]; ok && now.Sub(t) < f.window {
+		return &Rejection{Status: http.StatusBadRequest, Reason: "message already posted, please wait before posting it again"}
+	}
+	return nil
+}
+
+// Remember records a stored message, so that it is rejected during the window
+func (f *duplicateFilter) Remember(c SpamCandidate, now time.Time) {
+	key := f.key(c)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now.Sub(f.lastSweep) >= f.window {
+		for k, t := range f.seen {
+			if now.Sub(t) >= f.window {
+				delete(f.seen, k)
+			}
+		}
+		f.lastSweep = now
+	}
+	f.seen[key] = now
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+	goboardstore "github.com/dguihal/goboard/internal/store"
+)
+
+// failingHistoryStore fails every GetHistory call
+type failingHistoryStore struct {
+	goboardstore.Store
+}
+
+func (s failingHistoryStore) GetHistory(board string, limit int, last uint64, before uint64) ([]goboardbackend.Post, error) {
+	return nil, errors.New("history is unavailable")
+}
+
+func TestShadowPostID(t *testing.T) {
+	store := goboardstore.NewMemoryStore()
+	board := &BoardSettings{Name: "test", Key: "test", Location: time.UTC}
+	ch, err := NewSpamChain(SpamConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	save := func() uint64 {
+		id, err := store.PostMessage(board.Key, goboardbackend.Post{Time: goboardbackend.PostTime{Time: time.Now()}, Message: "real"}, board.Location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	shadow := func() uint64 {
+		id, err := ch.ShadowPostID(store, board)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	save()
+	save()
+	// Consecutive dropped posts, then a real one in between
+	got := []uint64{shadow(), shadow(), shadow(), save(), shadow()}
+	want := []uint64{3, 4, 5, 3, 6}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("ids %v, want %v", got, want)
+		}
+	}
+
+	if _, err := ch.ShadowPostID(failingHistoryStore{store}, board); err == nil {
+		t.Error("no error when history can't be read")
+	}
+}
+
+func TestDuplicateFilter(t *testing.T) {
+	const window = time.Minute
+
+	board := &BoardSettings{Name: "main", Key: "main"}
+	other := &BoardSettings{Name: "other", Key: "other"}
+	candidate := func(b *BoardSettings, login string, ip string, message string) SpamCandidate {
+		return SpamCandidate{Board: b, Post: goboardbackend.Post{Login: login, Message: message}, IP: ip}
+	}
+	posted := candidate(board, "alice", "192.0.2.1", "hello")
+
+	tests := []struct {
+		name     string
+		remember bool // The first post was stored
+		next     SpamCandidate
+		after    time.Duration
+		rejected bool
+	}{
+		{"same message in the window", true, posted, window - time.Second, true},
+		{"same message after the window", true, posted, window, false},
+		{"first post rejected", false, posted, time.Second, false},
+		{"other message", true, candidate(board, "alice", "192.0.2.1", "hello!"), time.Second, false},
+		{"other login", true, candidate(board, "bob", "192.0.2.1", "hello"), time.Second, false},
+		{"same login from another address", true, candidate(board, "alice", "192.0.2.2", "hello"), time.Second, true},
+		{"other board", true, candidate(other, "alice", "192.0.2.1", "hello"), time.Second, false},
+	}
+
+	start := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &duplicateFilter{window: window, seen: map[string]time.Time{}}
+			if rej := f.Check(posted, start); rej != nil {
+				t.Fatalf("first post rejected: %s", rej.Reason)
+			}
+			if tc.remember {
+				f.Remember(posted, start)
+			}
+
+			if rej := f.Check(tc.next, start.Add(tc.after)); (rej != nil) != tc.rejected {
+				t.Errorf("rejected: %v, want %v", rej != nil, tc.rejected)
+			}
+		})
+	}
+
+	t.Run("anonymous posts", func(t *testing.T) {
+		f := &duplicateFilter{window: window, seen: map[string]time.Time{}}
+		f.Remember(candidate(board, "", "192.0.2.1", "hello"), start)
+
+		for ip, rejected := range map[string]bool{"192.0.2.1": true, "192.0.2.2": false} {
+			if rej := f.Check(candidate(board, "", ip, "hello"), start.Add(time.Second)); (rej != nil) != rejected {
+				t.Errorf("from %s: rejected: %v, want %v", ip, rej != nil, rejected)
+			}
+		}
+	})
+
+	t.Run("expired messages are swept", func(t *testing.T) {
+		f := &duplicateFilter{window: window, seen: map[string]time.Time{}}
+		f.Remember(posted, start)
+		f.Remember(candidate(board, "alice", "192.0.2.1", "later"), start.Add(2*window))
+
+		if len(f.seen) != 1 {
+			t.Errorf("%d messages remembered, want 1", len(f.seen))
+		}
+	})
+}
@@ -0,0 +1,149 @@
+// bolt2sqlite copies a goboard bbolt database (posts of every board with their revisions
+// and moderation log, users, sessions and API tokens) to a new SQLite database
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dguihal/goboard/internal/backend"
+	"github.com/dguihal/goboard/internal/session"
+	"github.com/dguihal/goboard/internal/store"
+	"github.com/dguihal/goboard/internal/token"
+	"github.com/dguihal/goboard/internal/user"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Number of posts written per SQLite transaction
+const batchSize = 1000
+
+var from = flag.String("from", "goboard.db", "bbolt database to read (the server must be stopped)")
+var to = flag.String("to", "goboard.sqlite", "SQLite database to create")
+var mode = flag.Uint("mode", 0600, "SQLite database file permissions")
+
+func main() {
+	flag.Parse()
+
+	if _, err := os.Stat(*to); err == nil {
+		log.Fatalf("%s already exists, refusing to overwrite it", *to)
+	}
+
+	src, err := bolt.Open(*from, 0600, &bolt.Options{ReadOnly: true, Timeout: 1 * time.Second})
+	if err != nil {
+		log.Fatalf("Could not open %s (is the server running?): %v", *from, err)
+	}
+	defer src.Close()
+
+	dst, err := store.NewSQLiteStore(*to, os.FileMode(*mode))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dst.Close()
+
+	if err := migrate(src, dst); err != nil {
+		dst.Close()
+		os.Remove(*to)
+		log.Fatalf("Migration failed, %s removed: %v", *to, err)
+	}
+}
+
+func migrate(src *bolt.DB, dst *store.SQLiteStore) error {
+
+	seqs, err := backend.BoardSequences(src)
+	if err != nil {
+		return err
+	}
+
+	for board, seq := range seqs {
+		count := 0
+		batch := make([]backend.Post, 0, batchSize)
+
+		err := backend.ForEachPost(src, board, func(p backend.Post) error {
+			batch = append(batch, p)
+			if len(batch) < batchSize {
+				return nil
+			}
+			count += len(batch)
+			err := dst.ImportPosts(board, batch)
+			batch = batch[:0]
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := dst.ImportPosts(board, batch); err != nil {
+			return err
+		}
+		count += len(batch)
+
+		revCount := 0
+		err = backend.ForEachRevision(src, board, func(id uint64, rev backend.PostRevision) error {
+			revCount++
+			return dst.ImportRevision(board, id, rev)
+		})
+		if err != nil {
+			return err
+		}
+
+		modCount := 0
+		err = backend.ForEachModLogEntry(src, board, func(e backend.ModLogEntry) error {
+			modCount++
+			return dst.ImportModLogEntry(board, e)
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := dst.SetSequence(board, seq); err != nil {
+			return err
+		}
+		log.Printf("Board %q: %d posts, %d revisions and %d moderation log entries copied", board, count, revCount, modCount)
+	}
+
+	count := 0
+	err = user.ForEachUser(src, func(u user.User) error {
+		count++
+		return dst.ImportUser(u)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("%d users copied", count)
+
+	count = 0
+	err = session.ForEachSession(src, func(s session.Session) error {
+		count++
+		return dst.ImportSession(s)
+	})
+	if err != nil {
+		return err
+	}
+	// Databases not opened by the server since sessions replaced cookies
+	now := time.Now()
+	err = session.ForEachLegacyCookie(src, func(lc session.LegacyCookie) error {
+		s := session.FromLegacyCookie(lc)
+		if s.Expired(now) {
+			return nil
+		}
+		count++
+		return dst.ImportSession(s)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("%d sessions copied", count)
+
+	count = 0
+	err = token.ForEachToken(src, func(t token.APIToken) error {
+		count++
+		return dst.ImportToken(t)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("%d API tokens copied", count)
+
+	return nil
+}
@@ -0,0 +1,390 @@
+// goboard-db dumps a goboard bbolt database (posts of every board with their revisions
+// and moderation log, users, sessions and API tokens) to JSON Lines
+// and restores such a dump into a new database
+//
+// Usage:
+//
+//	goboard-db dump -db goboard.db [-f dump.jsonl] [-board name] [-login login] [-from date] [-to date]
+//	goboard-db restore -db new.db [-f dump.jsonl] [-board name] [-login login] [-from date] [-to date]
+//
+// The server must be stopped as bbolt databases can only be opened by one process
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dguihal/goboard/internal/backend"
+	"github.com/dguihal/goboard/internal/session"
+	"github.com/dguihal/goboard/internal/store"
+	"github.com/dguihal/goboard/internal/token"
+	"github.com/dguihal/goboard/internal/user"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Number of posts written per transaction on restore
+const batchSize = 1000
+
+// Maximum length of a dump line
+const maxLineSize = 16 * 1024 * 1024
+
+// filter selects the records dumped or restored
+type filter struct {
+	board    string
+	allBoard bool
+	login    string
+	from     time.Time
+	to       time.Time
+}
+
+func (f filter) keepBoard(board string) bool {
+	return f.allBoard || board == f.board
+}
+
+// keepLogin tells if a record of a user is kept (posts, users and sessions)
+func (f filter) keepLogin(login string) bool {
+	return len(f.login) == 0 || login == f.login
+}
+
+// keepTokens tells if API tokens are kept, they do not belong to any user
+func (f filter) keepTokens() bool {
+	return len(f.login) == 0
+}
+
+func (f filter) keepPost(p backend.Post) bool {
+	if !f.keepLogin(p.Login) {
+		return false
+	}
+	if !f.from.IsZero() && p.Time.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && p.Time.After(f.to) {
+		return false
+	}
+	return true
+}
+
+// parseDate parses a date (2006-01-02, first or last nanosecond of the day) or a RFC3339 time
+func parseDate(str string, endOfDay bool) (time.Time, error) {
+	if len(str) == 0 {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", str, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %s", str)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s dump|restore [options]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Run %s dump -h or %s restore -h for the options\n", os.Args[0], os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	dbPath := fs.String("db", "goboard.db", "bbolt database")
+	file := fs.String("f", "-", "Dump file (- for standard output or input)")
+	board := fs.String("board", "", "Only keep the posts of a board (empty for the default board)")
+	login := fs.String("login", "", "Only keep the posts, account and sessions of a user")
+	from := fs.String("from", "", "Only keep posts made from this date (2006-01-02 in local time or RFC3339)")
+	to := fs.String("to", "", "Only keep posts made until this date (2006-01-02 in local time or RFC3339)")
+
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+
+	f := filter{board: *board, login: *login}
+	f.allBoard = true
+	fs.Visit(func(fl *flag.Flag) {
+		if fl.Name == "board" {
+			f.allBoard = false
+		}
+	})
+
+	var err error
+	if f.from, err = parseDate(*from, false); err != nil {
+		log.Fatal(err)
+	}
+	if f.to, err = parseDate(*to, true); err != nil {
+		log.Fatal(err)
+	}
+
+	switch os.Args[1] {
+	case "dump":
+		err = dump(*dbPath, *file, f)
+	case "restore":
+		err = restore(*dbPath, *file, f)
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func dump(dbPath string, file string, f filter) error {
+
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{ReadOnly: true, Timeout: 1 * time.Second})
+	if err != nil {
+		return fmt.Errorf("could not open %s (is the server running?): %w", dbPath, err)
+	}
+	defer db.Close()
+
+	out := os.Stdout
+	if file != "-" {
+		if out, err = os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+
+	seqs, err := backend.BoardSequences(db)
+	if err != nil {
+		return err
+	}
+
+	for board, seq := range seqs {
+		if !f.keepBoard(board) {
+			continue
+		}
+		if err := enc.Encode(store.Record{Type: store.RecordBoard, Board: board, Seq: seq}); err != nil {
+			return err
+		}
+
+		kept := map[uint64]bool{}
+		err := backend.ForEachPost(db, board, func(p backend.Post) error {
+			if !f.keepPost(p) {
+				return nil
+			}
+			kept[p.ID] = true
+			return enc.Encode(store.Record{Type: store.RecordPost, Board: board, Post: &p})
+		})
+		if err != nil {
+			return err
+		}
+
+		// Revisions of the dumped posts only
+		revCount := 0
+		err = backend.ForEachRevision(db, board, func(id uint64, rev backend.PostRevision) error {
+			if !kept[id] {
+				return nil
+			}
+			revCount++
+			return enc.Encode(store.Record{Type: store.RecordRevision, Board: board, PostID: id, Revision: &rev})
+		})
+		if err != nil {
+			return err
+		}
+
+		// Moderation of the dumped posts only
+		modCount := 0
+		err = backend.ForEachModLogEntry(db, board, func(e backend.ModLogEntry) error {
+			if !kept[e.PostID] {
+				return nil
+			}
+			modCount++
+			return enc.Encode(store.Record{Type: store.RecordModLog, Board: board, ModLog: &e})
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Board %q: %d posts, %d revisions and %d moderation log entries dumped", board, len(kept), revCount, modCount)
+	}
+
+	count := 0
+	err = user.ForEachUser(db, func(u user.User) error {
+		if !f.keepLogin(u.Login) {
+			return nil
+		}
+		count++
+		return enc.Encode(store.Record{Type: store.RecordUser, User: &u})
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("%d users dumped", count)
+
+	count = 0
+	err = session.ForEachSession(db, func(s session.Session) error {
+		if !f.keepLogin(s.Login) {
+			return nil
+		}
+		count++
+		return enc.Encode(store.Record{Type: store.RecordSession, Session: &s})
+	})
+	if err != nil {
+		return err
+	}
+	// Databases not opened by the server since sessions replaced cookies
+	err = session.ForEachLegacyCookie(db, func(lc session.LegacyCookie) error {
+		if !f.keepLogin(lc.Login) {
+			return nil
+		}
+		count++
+		return enc.Encode(store.Record{Type: store.RecordCookie, Cookie: &lc})
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("%d sessions dumped", count)
+
+	if f.keepTokens() {
+		count = 0
+		err = token.ForEachToken(db, func(t token.APIToken) error {
+			count++
+			return enc.Encode(store.Record{Type: store.RecordToken, Token: &t})
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("%d API tokens dumped", count)
+	}
+
+	return w.Flush()
+}
+
+func restore(dbPath string, file string, f filter) (err error) {
+
+	if _, err := os.Stat(dbPath); err == nil {
+		return fmt.Errorf("%s already exists, restore only creates new databases", dbPath)
+	}
+
+	in := os.Stdin
+	if file != "-" {
+		if in, err = os.Open(file); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		db.Close()
+		if err != nil {
+			os.Remove(dbPath)
+			err = fmt.Errorf("restore failed, %s removed: %w", dbPath, err)
+		}
+	}()
+
+	posts := map[string][]backend.Post{} // Pending posts by board
+	kept := map[string]map[uint64]bool{} // Restored post ids by board
+	counts := map[string]int{}           // Records restored by type
+
+	flush := func(board string) error {
+		if err := backend.ImportPosts(db, board, posts[board]); err != nil {
+			return err
+		}
+		posts[board] = posts[board][:0]
+		return nil
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var r store.Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		switch {
+		case r.Type == store.RecordBoard:
+			if !f.keepBoard(r.Board) {
+				continue
+			}
+			// Sequences are kept even if posts are filtered out, so that ids are never reused
+			err = backend.SetSequence(db, r.Board, r.Seq)
+		case r.Type == store.RecordPost && r.Post != nil:
+			if !f.keepBoard(r.Board) || !f.keepPost(*r.Post) {
+				continue
+			}
+			if kept[r.Board] == nil {
+				kept[r.Board] = map[uint64]bool{}
+			}
+			kept[r.Board][r.Post.ID] = true
+			posts[r.Board] = append(posts[r.Board], *r.Post)
+			if len(posts[r.Board]) >= batchSize {
+				err = flush(r.Board)
+			}
+		case r.Type == store.RecordRevision && r.Revision != nil:
+			if !kept[r.Board][r.PostID] {
+				continue
+			}
+			err = backend.ImportRevision(db, r.Board, r.PostID, *r.Revision)
+		case r.Type == store.RecordModLog && r.ModLog != nil:
+			if !kept[r.Board][r.ModLog.PostID] {
+				continue
+			}
+			err = backend.ImportModLogEntry(db, r.Board, *r.ModLog)
+		case r.Type == store.RecordUser && r.User != nil:
+			if !f.keepLogin(r.User.Login) {
+				continue
+			}
+			err = user.ImportUser(db, *r.User)
+		case r.Type == store.RecordSession && r.Session != nil:
+			if !f.keepLogin(r.Session.Login) {
+				continue
+			}
+			err = session.ImportSession(db, *r.Session)
+		case r.Type == store.RecordCookie && r.Cookie != nil:
+			s := session.FromLegacyCookie(*r.Cookie)
+			if !f.keepLogin(s.Login) || s.Expired(time.Now()) {
+				continue
+			}
+			err = session.ImportSession(db, s)
+		case r.Type == store.RecordToken && r.Token != nil:
+			if !f.keepTokens() {
+				continue
+			}
+			err = token.ImportToken(db, *r.Token)
+		default:
+			err = errors.New("invalid record")
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		counts[r.Type]++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for board := range posts {
+		if err := flush(board); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Restored %d boards, %d posts, %d revisions, %d moderation log entries, %d users, %d sessions and %d API tokens",
+		counts[store.RecordBoard], counts[store.RecordPost], counts[store.RecordRevision], counts[store.RecordModLog],
+		counts[store.RecordUser], counts[store.RecordSession]+counts[store.RecordCookie], counts[store.RecordToken])
+	return nil
+}
@@ -0,0 +1,46 @@
+// oidc-mock is a minimal OpenID Connect provider to try the OIDC login of goboard locally
+// Every authorization request is granted without asking anything: the user is the login_hint
+// parameter of the request, or -user. The login_hint "deny" makes the provider refuse the login
+//
+// Example: oidc-mock -listen 127.0.0.1:9000, with this goboard configuration
+//
+//	OIDC:
+//	  Issuer: http://127.0.0.1:9000
+//	  ClientID: goboard
+//	  ClientSecret: secret
+//	  RedirectURL: http://localhost:8080/user/oidc/callback
+//
+// then open http://localhost:8080/user/oidc/login?return=/ (or add login_hint=bob to the provider URL)
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	goboardoidcmock "github.com/dguihal/goboard/internal/oidc/oidcmock"
+)
+
+var listen = flag.String("listen", "127.0.0.1:9000", "Address to listen on")
+var issuer = flag.String("issuer", "", "Issuer URL (default: http:// and the listen address)")
+var clientID = flag.String("client-id", "goboard", "Client id accepted")
+var clientSecret = flag.String("client-secret", "secret", "Client secret accepted (empty for a public client)")
+var defaultUser = flag.String("user", "alice", "Login of the users without login_hint")
+var userinfoOnly = flag.Bool("userinfo-only", false, "Give the username in the userinfo response only, not in the ID token")
+
+func main() {
+	flag.Parse()
+	if len(*issuer) == 0 {
+		*issuer = "http://" + *listen
+	}
+
+	p, err := goboardoidcmock.New(*issuer, *clientID, *clientSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.DefaultUser = *defaultUser
+	p.UserinfoOnly = *userinfoOnly
+
+	log.Printf("Mock OIDC provider %s listening on %s", *issuer, *listen)
+	log.Fatal(http.ListenAndServe(*listen, p.Handler()))
+}
@@ -2,37 +2,67 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"os"
-	"strings"
+	"strconv"
+	"time"
 
-	goboardcookie "github.com/dguihal/goboard/internal/cookie"
+	goboardsession "github.com/dguihal/goboard/internal/session"
+	goboardtoken "github.com/dguihal/goboard/internal/token"
 	goboarduser "github.com/dguihal/goboard/internal/user"
+	"github.com/gorilla/mux"
 )
 
+// Maximum number of personal API keys of a user
+const maxAPIKeysPerUser = 10
+
 // UserHandler represents the handler of user URLs
 type UserHandler struct {
 	GoBoardHandler
 
 	cookieDurationD int
+	cookies         CookieConfig
+	oidc            *OIDCLogin // nil if OIDC login is disabled
 	logger          *log.Logger
 }
 
 // NewUserHandler creates an UserHandler object
-func NewUserHandler(cookieDuration int) (u *UserHandler) {
+func NewUserHandler(cookieDuration int, cookies CookieConfig, oidc *OIDCLogin) (u *UserHandler) {
 	u = &UserHandler{}
 
 	u.logger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
 
 	u.supportedOps = []SupportedOp{
-		{"/user/add", "/user/add", "POST", u.addUser},         // Add a user
-		{"/user/login", "/user/login", "POST", u.authUser},    // Authenticate a user
-		{"/user/logout", "/user/logout", "GET", u.unAuthUser}, // Unauthenticate a user
-		{"/user/whoami", "/user/whoami", "GET", u.whoAmI},     // Get self account infos
+		{"/user/add", "/user/add", "POST", u.addUser},                         // Add a user
+		{"/user/login", "/user/login", "POST", u.authUser},                    // Authenticate a user
+		{"/user/logout", "/user/logout", "POST", u.unAuthUser},                // Unauthenticate a user
+		{"/user/whoami", "/user/whoami", "GET", u.whoAmI},                     // Get self account infos
+		{"/user/password", "/user/password", "POST", u.changePassword},        // Change own password
+		{"/user/me", "/user/me", "DELETE", u.deleteMe},                        // Delete own account
+		{"/user/sessions", "/user/sessions", "GET", u.getSessions},            // List own sessions
+		{"/user/sessions", "/user/sessions", "DELETE", u.deleteOtherSessions}, // Revoke own other sessions
+		{"/user/sessions", "/user/sessions/{id}", "DELETE", u.deleteSession},  // Revoke an own session
+		{"/user/apikeys", "/user/apikeys", "GET", u.getAPIKeys},               // List own API keys
+		{"/user/apikeys", "/user/apikeys", "POST", u.createAPIKey},            // Create an API key
+		{"/user/apikeys", "/user/apikeys/{id}", "DELETE", u.deleteAPIKey},     // Revoke an own API key
+	}
+
+	// Compatibility with older clients, exposed to cross-site requests
+	if cookies.GetLogout {
+		u.supportedOps = append(u.supportedOps, SupportedOp{"/user/logout", "/user/logout", "GET", u.unAuthUser})
+	}
+	if oidc != nil {
+		u.supportedOps = append(u.supportedOps,
+			SupportedOp{"/user/oidc/login", "/user/oidc/login", "GET", u.oidcLogin},          // Log in at the identity provider
+			SupportedOp{"/user/oidc/callback", "/user/oidc/callback", "GET", u.oidcCallback}, // Complete a login at the identity provider
+		)
 	}
 
 	u.cookieDurationD = cookieDuration
+	u.cookies = cookies
+	u.oidc = oidc
 
 	return
 }
@@ -40,7 +70,7 @@ func NewUserHandler(cookieDuration int) (u *UserHandler) {
 func (u *UserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	for _, op := range u.supportedOps {
-		if r.Method == op.Method && strings.HasPrefix(r.URL.Path, op.PathBase) {
+		if op.matches(r) {
 			// Call specific handling method
 			op.handler(w, r)
 			return
@@ -66,7 +96,11 @@ func (u *UserHandler) addUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := goboarduser.AddUser(u.Db, login, passwd); err != nil {
+	if !u.Guard.AllowSignup(w, r) {
+		return
+	}
+
+	if err := u.Store.AddUser(login, passwd); err != nil {
 		if uerr, ok := err.(*goboarduser.Error); ok {
 			if uerr.ErrCode == goboarduser.UserAlreadyExistsError {
 				http.Error(w, "User login already exists", http.StatusConflict)
@@ -79,11 +113,10 @@ func (u *UserHandler) addUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// User created: Send him a cookie
-	if cookie, err := goboardcookie.ForUser(u.Db, login, u.cookieDurationD); err == nil {
-		http.SetCookie(w, &cookie)
+	if err := u.startSession(w, r, login); err == nil {
 		w.WriteHeader(http.StatusOK)
 	} else {
-		u.logger.Printf("User created, but failed to create cookie for %s: %v", login, err)
+		u.logger.Printf("User created, but failed to create session for %s: %v", login, err)
 		http.Error(w, "User created, but failed to generate session", http.StatusInternalServerError)
 	}
 }
@@ -106,9 +139,15 @@ func (u *UserHandler) authUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := goboarduser.AuthUser(u.Db, login, passwd); err != nil {
+	// Checked before bcrypt runs
+	if !u.Guard.AllowLogin(w, r, login) {
+		return
+	}
+
+	if err := u.Store.AuthUser(login, passwd); err != nil {
 		u.logger.Println(err.Error())
 		if uerr, ok := err.(*goboarduser.Error); ok && uerr.ErrCode == goboarduser.AuthenticationFailed {
+			u.Guard.LoginFailed(login)
 			http.Error(w, "Authentication failed", http.StatusUnauthorized)
 		} else {
 			http.Error(w, "Internal server error during authentication", http.StatusInternalServerError)
@@ -116,8 +155,10 @@ func (u *UserHandler) authUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	u.Guard.LoginSucceeded(login)
+
 	// User authenticated: Get user data, cookie, and marshal to JSON
-	user, err := goboarduser.GetUser(u.Db, login)
+	user, err := u.Store.GetUser(login)
 	if err != nil {
 		u.logger.Printf("Auth successful, but failed to get user %s: %v", login, err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -131,14 +172,12 @@ func (u *UserHandler) authUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cookie, err := goboardcookie.ForUser(u.Db, login, u.cookieDurationD)
-	if err != nil {
-		u.logger.Printf("Failed to create cookie for user %s: %v", login, err)
+	if err := u.startSession(w, r, login); err != nil {
+		u.logger.Printf("Failed to create session for user %s: %v", login, err)
 		http.Error(w, "Failed to generate session", http.StatusInternalServerError)
 		return
 	}
 
-	http.SetCookie(w, &cookie)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write(userJSON); err != nil {
@@ -146,34 +185,42 @@ func (u *UserHandler) authUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// startSession creates a session for the device sending the request and sends its cookie
+func (u *UserHandler) startSession(w http.ResponseWriter, r *http.Request, login string) error {
+	s, token := goboardsession.New(u.SessionHasher, login, time.Duration(u.cookieDurationD)*24*time.Hour, r.UserAgent(), u.Guard.ClientIP(r))
+	if err := u.Store.AddSession(s); err != nil {
+		return err
+	}
+
+	cookie := s.Cookie(token)
+	u.cookies.apply(&cookie)
+	http.SetCookie(w, &cookie)
+	return nil
+}
+
+// unAuthUser closes the session of the request and expires the session cookie of the client
 func (u *UserHandler) unAuthUser(w http.ResponseWriter, r *http.Request) {
 
-	for _, cookie := range r.Cookies() {
-		cookie.MaxAge = 0
-		cookie.Value = ""
-		cookie.Path = "/"
-		http.SetCookie(w, cookie)
+	if s, ok := u.sessionFromCookies(r); ok {
+		if err := u.Store.DeleteSession(s.Login, s.ID); err != nil && !errors.Is(err, goboardsession.ErrSessionNotFound) {
+			u.logger.Printf("Failed to delete session of %s: %v", s.Login, err)
+		}
 	}
+
+	cookie := http.Cookie{Name: goboardsession.CookieName, Path: "/", MaxAge: -1, HttpOnly: true}
+	u.cookies.apply(&cookie)
+	http.SetCookie(w, &cookie)
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (u *UserHandler) whoAmI(w http.ResponseWriter, r *http.Request) {
-	var login string
-	for _, c := range r.Cookies() {
-		// Check for a valid login from any of the cookies
-		l, err := goboardcookie.LoginForCookie(u.Db, c)
-		if err == nil && len(l) > 0 {
-			login = l
-			break
-		}
-	}
-
+	login := u.loginFromCookies(r)
 	if len(login) == 0 {
 		http.Error(w, "You need to be authenticated", http.StatusForbidden)
 		return
 	}
 
-	user, err := goboarduser.GetUser(u.Db, login)
+	user, err := u.Store.GetUser(login)
 	if err != nil {
 		u.logger.Printf("Could not get user data for authenticated user %s: %v", login, err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -193,3 +240,331 @@ func (u *UserHandler) whoAmI(w http.ResponseWriter, r *http.Request) {
 		u.logger.Printf("Failed to write whoAmI response: %v", err)
 	}
 }
+
+// changePassword replaces the password of the logged in user, checking the current one first
+// If logout_others is set, every other session of the user is closed and a new cookie is sent
+func (u *UserHandler) changePassword(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	login := u.loginFromCookies(r)
+	if len(login) == 0 {
+		http.Error(w, "You need to be authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	current := r.FormValue("current_password")
+	passwd := r.FormValue("new_password")
+	if len(current) == 0 || len(passwd) == 0 {
+		http.Error(w, "Current and new passwords can't be empty", http.StatusBadRequest)
+		return
+	}
+
+	// Users of the identity provider have no password here
+	if user, err := u.Store.GetUser(login); err == nil && len(user.OIDCSubject) > 0 {
+		http.Error(w, "Password is managed by the identity provider", http.StatusForbidden)
+		return
+	}
+
+	// Checking the current password is an authentication, limited as such
+	if !u.Guard.AllowLogin(w, r, login) {
+		return
+	}
+
+	if err := u.Store.AuthUser(login, current); err != nil {
+		if uerr, ok := err.(*goboarduser.Error); ok && uerr.ErrCode == goboarduser.AuthenticationFailed {
+			u.Guard.LoginFailed(login)
+			http.Error(w, "Current password is wrong", http.StatusForbidden)
+		} else {
+			u.logger.Println(err.Error())
+			http.Error(w, "Internal server error during authentication", http.StatusInternalServerError)
+		}
+		return
+	}
+	u.Guard.LoginSucceeded(login)
+
+	if err := u.Store.SetPassword(login, passwd); err != nil {
+		u.logger.Printf("Failed to change password of %s: %v", login, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	u.BasicAuth.Forget(login)
+
+	if logoutOthers, _ := strconv.ParseBool(r.FormValue("logout_others")); logoutOthers {
+		if err := u.Store.DeleteSessionsForUser(login); err != nil {
+			u.logger.Printf("Password changed, but failed to delete sessions of %s: %v", login, err)
+			http.Error(w, "Password changed, but failed to close other sessions", http.StatusInternalServerError)
+			return
+		}
+
+		if err := u.startSession(w, r, login); err != nil {
+			u.logger.Printf("Failed to create session for user %s: %v", login, err)
+			http.Error(w, "Password changed, but failed to generate session", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteMe deletes the account of the logged in user, its sessions and API keys, posts are kept
+func (u *UserHandler) deleteMe(w http.ResponseWriter, r *http.Request) {
+
+	login := u.loginFromCookies(r)
+	if len(login) == 0 {
+		http.Error(w, "You need to be authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	if err := u.Store.DeleteUser(login); err != nil {
+		if uerr, ok := err.(*goboarduser.Error); ok && uerr.ErrCode == goboarduser.UserDoesNotExistsError {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		u.logger.Printf("Failed to delete user %s: %v", login, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := u.Store.DeleteSessionsForUser(login); err != nil {
+		u.logger.Printf("User %s deleted, but failed to delete sessions: %v", login, err)
+		http.Error(w, "User deleted, but failed to close sessions", http.StatusInternalServerError)
+		return
+	}
+	u.BasicAuth.Forget(login)
+
+	if err := u.Store.DeleteTokensForUser(login); err != nil {
+		u.logger.Printf("User %s deleted, but failed to revoke API keys: %v", login, err)
+		http.Error(w, "User deleted, but failed to revoke API keys", http.StatusInternalServerError)
+		return
+	}
+
+	u.unAuthUser(w, r)
+}
+
+// userSession is a session as listed to its user, without its token hash
+type userSession struct {
+	goboardsession.Session
+	Current bool `json:"current"` // Session of the request
+}
+
+// getSessions lists the sessions of the logged in user, oldest first
+func (u *UserHandler) getSessions(w http.ResponseWriter, r *http.Request) {
+
+	current, ok := u.sessionFromCookies(r)
+	if !ok {
+		http.Error(w, "You need to be authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	sessions, err := u.Store.GetSessions(current.Login)
+	if err != nil {
+		u.logger.Printf("Failed to get sessions of %s: %v", current.Login, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]userSession, 0, len(sessions))
+	for _, s := range sessions {
+		s.TokenHash = ""
+		list = append(list, userSession{Session: s, Current: s.ID == current.ID})
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		u.logger.Printf("Could not marshal sessions of %s: %v", current.Login, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		u.logger.Printf("Failed to write sessions response: %v", err)
+	}
+}
+
+// deleteSession revokes a session of the logged in user, expiring the cookie if it is the current one
+func (u *UserHandler) deleteSession(w http.ResponseWriter, r *http.Request) {
+
+	current, ok := u.sessionFromCookies(r)
+	if !ok {
+		http.Error(w, "You need to be authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	id := (mux.Vars(r))["id"]
+	if err := u.Store.DeleteSession(current.Login, id); err != nil {
+		if errors.Is(err, goboardsession.ErrSessionNotFound) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		u.logger.Printf("Failed to delete session of %s: %v", current.Login, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if id == current.ID {
+		u.unAuthUser(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteOtherSessions revokes every session of the logged in user but the current one
+func (u *UserHandler) deleteOtherSessions(w http.ResponseWriter, r *http.Request) {
+
+	current, ok := u.sessionFromCookies(r)
+	if !ok {
+		http.Error(w, "You need to be authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	sessions, err := u.Store.GetSessions(current.Login)
+	if err != nil {
+		u.logger.Printf("Failed to get sessions of %s: %v", current.Login, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	for _, s := range sessions {
+		if s.ID == current.ID {
+			continue
+		}
+		if err := u.Store.DeleteSession(s.Login, s.ID); err != nil && !errors.Is(err, goboardsession.ErrSessionNotFound) {
+			u.logger.Printf("Failed to delete session of %s: %v", current.Login, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getAPIKeys lists the personal API keys of the logged in user, without their hashed secrets
+func (u *UserHandler) getAPIKeys(w http.ResponseWriter, r *http.Request) {
+
+	login := u.loginFromCookies(r)
+	if len(login) == 0 {
+		http.Error(w, "You need to be authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	keys, err := u.Store.GetTokensForUser(login)
+	if err != nil {
+		u.logger.Printf("Failed to get API keys of %s: %v", login, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range keys {
+		keys[i].HashedSecret = nil
+	}
+	if keys == nil {
+		keys = []goboardtoken.APIToken{}
+	}
+
+	data, err := json.Marshal(keys)
+	if err != nil {
+		u.logger.Printf("Could not marshal API keys of %s: %v", login, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		u.logger.Printf("Failed to write API keys response: %v", err)
+	}
+}
+
+// createAPIKey creates a personal API key of the logged in user from the name and expires (RFC3339, optional) parameters
+// The key can only post, signed with the user login, its value is only given in this response
+func (u *UserHandler) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	login := u.loginFromCookies(r)
+	if len(login) == 0 {
+		http.Error(w, "You need to be authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	name := r.FormValue("name")
+	if len(name) == 0 {
+		http.Error(w, "Name can't be empty", http.StatusBadRequest)
+		return
+	}
+
+	expires, err := parseTokenExpires(r.FormValue("expires"))
+	if err != nil {
+		http.Error(w, "Invalid expires parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	keys, err := u.Store.GetTokensForUser(login)
+	if err != nil {
+		u.logger.Printf("Failed to get API keys of %s: %v", login, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(keys) >= maxAPIKeysPerUser {
+		http.Error(w, "Too many API keys, revoke one first", http.StatusConflict)
+		return
+	}
+
+	t, value := goboardtoken.New(name, []string{goboardtoken.ScopePost}, expires)
+	t.Login = login
+	if err := u.Store.AddToken(t); err != nil {
+		u.logger.Printf("Failed to create API key for %s: %v", login, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	t.HashedSecret = nil
+	data, err := json.Marshal(newAPIToken{APIToken: t, Token: value})
+	if err != nil {
+		u.logger.Printf("Could not marshal API key of %s: %v", login, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write(data); err != nil {
+		u.logger.Printf("Failed to write API key response: %v", err)
+	}
+}
+
+// deleteAPIKey revokes a personal API key of the logged in user
+func (u *UserHandler) deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+
+	login := u.loginFromCookies(r)
+	if len(login) == 0 {
+		http.Error(w, "You need to be authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	// Keys of other users are reported as not found
+	id := (mux.Vars(r))["id"]
+	t, err := u.Store.GetToken(id)
+	if err == nil && t.Login != login {
+		err = goboardtoken.ErrTokenNotFound
+	}
+	if err == nil {
+		err = u.Store.DeleteToken(id)
+	}
+	if err != nil {
+		if errors.Is(err, goboardtoken.ErrTokenNotFound) {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		u.logger.Printf("Failed to delete API key of %s: %v", login, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
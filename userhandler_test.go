@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+)
+
+func TestUserRoundTrip(t *testing.T) {
+	s := newTestServer(t, testConfig(), nil)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Client().Jar = jar
+
+	credentials := url.Values{"login": {"alice"}, "password": {"secret"}}
+	for _, step := range []struct {
+		name   string
+		method string
+		path   string
+		form   url.Values
+		status int
+	}{
+		{"sign up", http.MethodPost, "/user/add", credentials, http.StatusOK},
+		{"sign up again", http.MethodPost, "/user/add", credentials, http.StatusConflict},
+		{"who am i", http.MethodGet, "/user/whoami", nil, http.StatusOK},
+		{"post", http.MethodPost, "/post", url.Values{"message": {"signed"}}, http.StatusNoContent},
+		{"log out", http.MethodPost, "/user/logout", nil, http.StatusNoContent},
+		{"who am i once logged out", http.MethodGet, "/user/whoami", nil, http.StatusForbidden},
+		{"log in with a wrong password", http.MethodPost, "/user/login", url.Values{"login": {"alice"}, "password": {"wrong"}}, http.StatusUnauthorized},
+		{"log in", http.MethodPost, "/user/login", credentials, http.StatusOK},
+		{"delete account", http.MethodDelete, "/user/me", nil, http.StatusNoContent},
+		{"who am i once deleted", http.MethodGet, "/user/whoami", nil, http.StatusForbidden},
+		{"log in once deleted", http.MethodPost, "/user/login", credentials, http.StatusUnauthorized},
+	} {
+		status, body := s.do(t, step.method, step.path, step.form, nil)
+		if status != step.status {
+			t.Fatalf("%s: status %d, want %d: %s", step.name, status, step.status, body)
+		}
+		if step.path == "/user/whoami" && status == http.StatusOK {
+			var user struct{ Login string }
+			if err := json.Unmarshal([]byte(body), &user); err != nil || user.Login != "alice" {
+				t.Errorf("%s: %s (%v), want alice", step.name, body, err)
+			}
+		}
+	}
+
+	if posts := s.backend(t, ""); len(posts) != 1 || posts[0].Login != "alice" {
+		t.Errorf("backend %+v, want a post of alice", posts)
+	}
+}
@@ -260,7 +260,7 @@ function login () {
 
 function logout () {
   $.ajax({
-    method: 'GET',
+    method: 'POST',
     url: '../user/logout'
   }).always(function () {
     whoami()
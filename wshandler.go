@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+	goboardhub "github.com/dguihal/goboard/internal/hub"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a frame to the peer
+	wsWriteWait = 10 * time.Second
+	// Time allowed to read the next pong from the peer
+	wsPongWait = 60 * time.Second
+	// Send pings to peer with this period (must be less than wsPongWait)
+	wsPingPeriod = (wsPongWait * 9) / 10
+	// Maximum size of a frame sent by the peer
+	wsMaxFrameSize = 64 * 1024
+	// Number of outgoing frames queued before a client is considered too slow
+	wsSendBufferSize = 16
+)
+
+// A list of frame types exchanged on the websocket
+const (
+	wsFramePost    = "post"    // Server -> Client: new post (data in json backend format)
+	wsFrameEdit    = "edit"    // Server -> Client: edited post (data in json backend format)
+	wsFrameRestore = "restore" // Server -> Client: restored post (data in json backend format)
+	wsFrameDelete  = "delete"  // Server -> Client: deleted posts ids (and id if a single post is deleted)
+	wsFramePosted  = "posted"  // Server -> Client: id of the post stored for the client
+	wsFrameError   = "error"   // Server -> Client: error while handling a client frame
+	wsFrameMessage = "message" // Client -> Server: new message to post
+)
+
+// wsFrame is the JSON envelope of every websocket message
+type wsFrame struct {
+	Type    string          `json:"type"`
+	ID      uint64          `json:"id,omitempty"`
+	IDs     []uint64        `json:"ids,omitempty"` // Deleted posts
+	Data    json.RawMessage `json:"data,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Info    string          `json:"info,omitempty"`
+}
+
+// WSHandler represents the handler of websocket URLs
+type WSHandler struct {
+	GoBoardHandler
+
+	upgrader websocket.Upgrader
+}
+
+// NewWSHandler creates an WSHandler object
+func NewWSHandler() (ws *WSHandler) {
+	ws = &WSHandler{}
+
+	ws.supportedOps = []SupportedOp{
+		{"/ws", "/ws", "GET", ws.serveWS}, // Post and receive messages over a websocket
+	}
+
+	// Every board has its own websocket
+	ws.boardOps = ws.supportedOps
+
+	// Default CheckOrigin rejects cross origin requests, which protects cookie authentication
+	ws.upgrader = websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+	}
+
+	return
+}
+
+func (ws *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if ws.Boards.ForRequest(r) == nil {
+		http.Error(w, "Unknown board", http.StatusNotFound)
+		return
+	}
+
+	for _, op := range ws.supportedOps {
+		if op.matches(r) {
+			// Call specific handling method
+			op.handler(w, r)
+			return
+		}
+	}
+
+	// If we are here : not methods has been found (shouldn't happen)
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// wsClient holds the state of a websocket connection
+type wsClient struct {
+	board *BoardSettings
+	conn  *websocket.Conn
+	send  chan wsFrame
+	login string
+	info  string
+	ip    string // Client address, for flood protection
+}
+
+func (ws *WSHandler) serveWS(w http.ResponseWriter, r *http.Request) {
+
+	if ws.Hub == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	// Same authentication as a form post
+	login := ws.loginFromCookies(r)
+
+	conn, err := ws.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied to the client
+		log.Printf("Websocket upgrade failed: %v", err)
+		return
+	}
+
+	c := &wsClient{
+		board: ws.Boards.ForRequest(r),
+		conn:  conn,
+		send:  make(chan wsFrame, wsSendBufferSize),
+		login: login,
+		info:  r.Header.Get("User-Agent"),
+		ip:    ws.Guard.ClientIP(r),
+	}
+
+	sub := ws.Hub.Subscribe(goboardhub.DefaultBufferSize)
+	done := make(chan struct{})
+
+	go ws.writePump(c, sub, done)
+	ws.readPump(c)
+
+	close(done)
+	ws.Hub.Unsubscribe(sub)
+}
+
+// readPump handles frames sent by the client until the connection fails
+func (ws *WSHandler) readPump(c *wsClient) {
+
+	c.conn.SetReadLimit(wsMaxFrameSize)
+	if err := c.conn.SetReadDeadline(time.Now().Add(wsPongWait)); err != nil {
+		return
+	}
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var in wsFrame
+		if err := c.conn.ReadJSON(&in); err != nil {
+			var synErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &synErr) || errors.As(err, &typeErr) {
+				if !c.reply(wsFrame{Type: wsFrameError, Error: "invalid frame"}) {
+					return
+				}
+				continue
+			}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("Websocket read error: %v", err)
+			}
+			return
+		}
+
+		if in.Type != wsFrameMessage {
+			if !c.reply(wsFrame{Type: wsFrameError, Error: "unknown frame type"}) {
+				return
+			}
+			continue
+		}
+
+		rawInfo := in.Info
+		if len(rawInfo) == 0 {
+			rawInfo = c.info
+		}
+
+		if wait := ws.Guard.PostWait(c.ip, c.login); wait > 0 {
+			if !c.reply(wsFrame{Type: wsFrameError, Error: "too many requests, retry in " + wait.Round(time.Second).String()}) {
+				return
+			}
+			continue
+		}
+
+		p, err := newPost(c.board, in.Message, rawInfo, c.login)
+		if err != nil {
+			if !c.reply(wsFrame{Type: wsFrameError, Error: err.Error()}) {
+				return
+			}
+			continue
+		}
+
+		candidate := SpamCandidate{Board: c.board, Post: p, IP: c.ip}
+		if rej := ws.Spam.Check(candidate); rej != nil {
+			f := wsFrame{Type: wsFrameError, Error: rej.Reason}
+			if rej.Shadow {
+				if id, err := ws.Spam.ShadowPostID(ws.Store, c.board); err != nil {
+					log.Printf("Websocket post failed: %v", err)
+					f = wsFrame{Type: wsFrameError, Error: "internal server error"}
+				} else {
+					f = wsFrame{Type: wsFramePosted, ID: id}
+				}
+			}
+			if !c.reply(f) {
+				return
+			}
+			continue
+		}
+
+		postID, err := savePost(ws.Store, ws.Hub, c.board, p)
+		if err != nil {
+			log.Printf("Websocket post failed: %v", err)
+			if !c.reply(wsFrame{Type: wsFrameError, Error: "internal server error"}) {
+				return
+			}
+			continue
+		}
+		ws.Spam.Remember(candidate)
+
+		if !c.reply(wsFrame{Type: wsFramePosted, ID: postID}) {
+			return
+		}
+	}
+}
+
+// reply queues a frame for the client, returns false if the client is too slow
+func (c *wsClient) reply(f wsFrame) bool {
+	select {
+	case c.send <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+// writePump sends hub events, replies and pings to the client
+// It is the only goroutine writing on the connection
+func (ws *WSHandler) writePump(c *wsClient, sub *goboardhub.Subscription, done <-chan struct{}) {
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		// Unblocks readPump
+		c.conn.Close()
+	}()
+
+	for {
+		var f wsFrame
+
+		select {
+		case <-done:
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				// Slow consumer or server shutting down
+				if err := c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
+					log.Printf("Websocket close failed: %v", err)
+					return
+				}
+				if err := c.conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "")); err != nil {
+					log.Printf("Websocket close failed: %v", err)
+				}
+				return
+			}
+			if e.Board != c.board.Name {
+				continue
+			}
+			switch e.Type {
+			case goboardhub.PostEvent, goboardhub.EditEvent, goboardhub.RestoreEvent:
+				posts := []goboardbackend.Post{e.Post}
+				goboardbackend.Localize(posts, c.board.Location)
+				f = wsFrame{Type: wsFramePost, ID: e.ID, Data: postsToJSON(posts)}
+				switch e.Type {
+				case goboardhub.EditEvent:
+					f.Type = wsFrameEdit
+				case goboardhub.RestoreEvent:
+					f.Type = wsFrameRestore
+				}
+			case goboardhub.DeleteEvent:
+				f = wsFrame{Type: wsFrameDelete, ID: e.ID, IDs: e.IDs}
+			default:
+				continue
+			}
+		case f = <-c.send:
+		case <-ticker.C:
+			if err := c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+			continue
+		}
+
+		if err := c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
+			return
+		}
+		if err := c.conn.WriteJSON(f); err != nil {
+			return
+		}
+	}
+}
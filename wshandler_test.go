@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	goboardbackend "github.com/dguihal/goboard/internal/backend"
+	goboardhub "github.com/dguihal/goboard/internal/hub"
+	"github.com/gorilla/websocket"
+)
+
+// dialWS opens a websocket on the default board, once the server listens to the hub
+func (s *testServer) dialWS(t *testing.T) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// The subscription is made before frames are read
+	if err := conn.WriteJSON(wsFrame{Type: "ping"}); err != nil {
+		t.Fatal(err)
+	}
+	var f wsFrame
+	if err := conn.ReadJSON(&f); err != nil || f.Type != wsFrameError {
+		t.Fatalf("frame %+v (%v), want an error frame", f, err)
+	}
+	return conn
+}
+
+func TestWSClose(t *testing.T) {
+	// Large enough to fill the socket buffers of a client which doesn't read
+	big := goboardbackend.Post{ID: 1, Time: goboardbackend.PostTime{Time: time.Now()}, Message: strings.Repeat("x", 64*1024)}
+
+	tests := []struct {
+		name  string
+		close func(s *testServer) // Ends the subscription of the client
+	}{
+		{"slow client", func(s *testServer) {
+			for i := 0; i < 8*goboardhub.DefaultBufferSize; i++ {
+				s.Hub.Publish(goboardhub.Event{Type: goboardhub.PostEvent, Board: defaultBoardName, ID: big.ID, Post: big})
+			}
+		}},
+		{"server shutting down", func(s *testServer) { s.Hub.Close() }},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, testConfig(), nil)
+			conn := s.dialWS(t)
+
+			tc.close(s)
+
+			// Frames sent before the subscription ended come first
+			if err := conn.SetReadDeadline(time.Now().Add(wsWriteWait / 2)); err != nil {
+				t.Fatal(err)
+			}
+			for {
+				_, _, err := conn.ReadMessage()
+				if err == nil {
+					continue
+				}
+				var closeErr *websocket.CloseError
+				if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+					t.Fatalf("read error %v, want a going away close frame", err)
+				}
+				return
+			}
+		})
+	}
+}